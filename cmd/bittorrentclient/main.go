@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"strings"
 
@@ -11,6 +13,9 @@ import (
 	session "github.com/dmsRosa6/bittorrent-client/internal/session"
 )
 
+// where the torrents and the DHT routing table are kept between runs
+const sessionFile = "session.json"
+
 func main() {
 	r := &handler.Handler{}
 
@@ -19,6 +24,20 @@ func main() {
 	fmt.Println("BitTorrent Client. Type 'help' for commands, 'exit' to quit.")
 
 	s := session.NewSession()
+	s.ListenPort = 6881
+	s.StatePath = sessionFile
+	if err := s.Load(sessionFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("Could not restore the last session:", err)
+	}
+	if err := s.StartDHT(":6881"); err != nil {
+		fmt.Println("DHT disabled:", err)
+	}
+	if err := s.StartLSD(); err != nil {
+		fmt.Println("Local service discovery disabled:", err)
+	}
+	if err := s.StartListener(); err != nil {
+		fmt.Println("Not accepting incoming peers:", err)
+	}
 
 	for {
 		fmt.Print("> ")
@@ -37,6 +56,9 @@ func main() {
 
 		if cmd == handler.Exit {
 			fmt.Println("Exiting. Bye!")
+			if err := s.Close(); err != nil {
+				fmt.Println("Error stopping:", err)
+			}
 			break
 		}
 
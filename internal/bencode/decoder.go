@@ -0,0 +1,512 @@
+// Package bencode implements streaming encoding and decoding of bencoded data
+// as described in BEP 3.
+package bencode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// This is how the values are delimited on the wire
+const (
+	separator       = byte(':')
+	integerStart    = byte('i')
+	dictionaryStart = byte('d')
+	listStart       = byte('l')
+	objectEnd       = byte('e')
+)
+
+const (
+	DefaultMaxDepth        = 64
+	DefaultMaxStringLength = 64 << 20
+)
+
+// maxIntegerDigits bounds how much we buffer for a single integer
+const maxIntegerDigits = 256
+
+var (
+	ErrMaxDepth        = errors.New("bencode: maximum nesting depth exceeded")
+	ErrStringTooLong   = errors.New("bencode: string exceeds maximum length")
+	ErrUnexpectedEnd   = errors.New("bencode: unexpected end marker")
+	ErrInvalidKey      = errors.New("bencode: dictionary key is not a string")
+	ErrMissingValue    = errors.New("bencode: dictionary key without value")
+	ErrInvalidPrefix   = errors.New("bencode: unknown type prefix")
+	ErrLeadingZero     = errors.New("bencode: leading zeros are not allowed")
+	ErrNegativeZero    = errors.New("bencode: negative zero is not allowed")
+	ErrInvalidInteger  = errors.New("bencode: invalid integer")
+	ErrIntegerOverflow = errors.New("bencode: integer out of int64 range")
+	ErrUnsortedKeys    = errors.New("bencode: dictionary keys are not sorted")
+	ErrDuplicateKey    = errors.New("bencode: duplicate dictionary key")
+	ErrTrailingData    = errors.New("bencode: trailing data after top level value")
+	ErrInvalidStrLen   = errors.New("bencode: invalid string length")
+)
+
+// Delim is one of the structural tokens: 'l', 'd' or 'e'.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Token holds a value of one of these types:
+//
+//	Delim, for the start and end of lists and dictionaries
+//	int64, for integers
+//	*big.Int, for integers outside the int64 range when UseBigInt is set
+//	string, for byte strings
+type Token any
+
+// SyntaxError describes malformed or, in strict mode, non-canonical input.
+// Path locates the offending value, e.g. info.files[3].path.
+type SyntaxError struct {
+	Offset int64
+	Path   string
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	}
+	return fmt.Sprintf("%v at offset %d (%s)", e.Err, e.Offset, e.Path)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+type container struct {
+	kind   byte
+	isKey  bool   // next token is a dictionary key
+	key    string // last key read, for dictionaries
+	hasKey bool
+	index  int // elements read so far, for lists
+}
+
+// Decoder reads bencoded values from an input stream. It only buffers what a
+// single token needs, so memory use is bounded by the configured limits and
+// not by the size of the input.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+
+	maxDepth        int
+	maxStringLength int64
+	useBigInt       bool
+	strict          bool
+
+	// wantBig lets the next integer overflow int64 for a single value, used
+	// when unmarshaling into uint64 and big.Int
+	wantBig bool
+
+	stack      []container
+	tokenStart int64
+
+	// raw collects every consumed byte while a RawMessage is being decoded
+	raw []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:               bufio.NewReader(r),
+		maxDepth:        DefaultMaxDepth,
+		maxStringLength: DefaultMaxStringLength,
+	}
+}
+
+// SetMaxDepth limits how deeply lists and dictionaries may be nested.
+func (d *Decoder) SetMaxDepth(depth int) {
+	d.maxDepth = depth
+}
+
+// SetMaxStringLength limits the size of a single byte string.
+func (d *Decoder) SetMaxStringLength(length int64) {
+	d.maxStringLength = length
+}
+
+// UseBigInt makes integers that do not fit in an int64 decode as *big.Int
+// instead of failing with ErrIntegerOverflow.
+func (d *Decoder) UseBigInt() {
+	d.useBigInt = true
+}
+
+// Strict makes the decoder reject input that is valid but not canonical:
+// unsorted or duplicate dictionary keys, string lengths with leading zeros
+// and data after the top level value.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// InputOffset returns the number of bytes consumed so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Depth returns how many lists or dictionaries are currently open.
+func (d *Decoder) Depth() int {
+	return len(d.stack)
+}
+
+// Token returns the next token in the input stream. At the end of the input
+// Token returns nil, io.EOF.
+func (d *Decoder) Token() (Token, error) {
+	d.tokenStart = d.offset
+	c, err := d.peekByte()
+	if err != nil {
+		if err == io.EOF && len(d.stack) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var top *container
+	if len(d.stack) > 0 {
+		top = &d.stack[len(d.stack)-1]
+	}
+
+	if c == objectEnd {
+		if top == nil {
+			return nil, d.errorf(ErrUnexpectedEnd)
+		}
+		if top.kind == dictionaryStart && !top.isKey {
+			return nil, d.errorf(ErrMissingValue)
+		}
+		d.readByte()
+		d.stack = d.stack[:len(d.stack)-1]
+		d.valueDone()
+		return Delim(objectEnd), nil
+	}
+
+	if top != nil && top.kind == dictionaryStart && top.isKey && (c < '0' || c > '9') {
+		return nil, d.errorf(ErrInvalidKey)
+	}
+
+	switch {
+	case c == integerStart:
+		d.readByte()
+		n, err := d.readInteger()
+		if err != nil {
+			return nil, err
+		}
+		d.valueDone()
+		return n, nil
+	case c == listStart, c == dictionaryStart:
+		if len(d.stack) >= d.maxDepth {
+			return nil, d.errorf(ErrMaxDepth)
+		}
+		d.readByte()
+		d.stack = append(d.stack, container{kind: c, isKey: c == dictionaryStart})
+		return Delim(c), nil
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if top != nil && top.kind == dictionaryStart && top.isKey {
+			if err := d.checkKey(top, s); err != nil {
+				return nil, err
+			}
+		}
+		d.valueDone()
+		return s, nil
+	}
+
+	return nil, d.errorf(ErrInvalidPrefix)
+}
+
+// Decode reads the next complete value from the input. Integers are returned
+// as int64 (or *big.Int, see UseBigInt), byte strings as string, lists as
+// []any and dictionaries as map[string]any.
+func (d *Decoder) Decode() (any, error) {
+	top := len(d.stack) == 0
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decodeToken(tok)
+	if err != nil {
+		return nil, err
+	}
+	if top {
+		if err := d.checkEnd(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Validate reports whether r holds exactly one canonical bencoded value,
+// returning a *SyntaxError describing the first problem otherwise.
+func Validate(r io.Reader) error {
+	d := NewDecoder(r)
+	d.Strict()
+	if err := d.Skip(); err != nil {
+		return err
+	}
+	return d.checkEnd()
+}
+
+func (d *Decoder) decodeToken(tok Token) (any, error) {
+	delim, ok := tok.(Delim)
+	if !ok {
+		return tok, nil
+	}
+
+	switch byte(delim) {
+	case listStart:
+		list := []any{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			if tok == Delim(objectEnd) {
+				return list, nil
+			}
+			val, err := d.decodeToken(tok)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+	case dictionaryStart:
+		dict := make(map[string]any)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			if tok == Delim(objectEnd) {
+				return dict, nil
+			}
+			key := tok.(string)
+			val, err := d.decodeNext()
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = val
+		}
+	}
+
+	return nil, d.errorf(ErrUnexpectedEnd)
+}
+
+// Skip discards the next complete value.
+func (d *Decoder) Skip() error {
+	depth := len(d.stack)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if len(d.stack) == depth {
+			return nil
+		}
+		if tok == Delim(objectEnd) && len(d.stack) < depth {
+			return d.errorf(ErrUnexpectedEnd)
+		}
+	}
+}
+
+func (d *Decoder) decodeNext() (any, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeToken(tok)
+}
+
+func (d *Decoder) valueDone() {
+	if len(d.stack) == 0 {
+		return
+	}
+	top := &d.stack[len(d.stack)-1]
+	if top.kind == dictionaryStart {
+		top.isKey = !top.isKey
+	} else {
+		top.index++
+	}
+}
+
+// checkKey enforces canonical key order in strict mode.
+func (d *Decoder) checkKey(top *container, key string) error {
+	prev, hasPrev := top.key, top.hasKey
+	top.key, top.hasKey = key, true
+
+	if !d.strict || !hasPrev {
+		return nil
+	}
+	if key == prev {
+		return d.errorf(ErrDuplicateKey)
+	}
+	if key < prev {
+		return d.errorf(ErrUnsortedKeys)
+	}
+	return nil
+}
+
+// checkEnd makes sure nothing follows a top level value in strict mode.
+func (d *Decoder) checkEnd() error {
+	if !d.strict {
+		return nil
+	}
+	d.tokenStart = d.offset
+	if _, err := d.peekByte(); err != io.EOF {
+		return d.errorf(ErrTrailingData)
+	}
+	return nil
+}
+
+// path describes where in the document the decoder currently is.
+func (d *Decoder) path() string {
+	var b strings.Builder
+	for _, c := range d.stack {
+		if c.kind == listStart {
+			fmt.Fprintf(&b, "[%d]", c.index)
+			continue
+		}
+		if !c.hasKey {
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(c.key)
+	}
+	return b.String()
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	buf, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.offset++
+	if d.raw != nil {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+// readInteger reads the digits of an integer after the 'i' up to and
+// including the closing 'e'.
+func (d *Decoder) readInteger() (any, error) {
+	digits, err := d.readUntil(objectEnd, ErrInvalidInteger)
+	if err != nil {
+		return nil, err
+	}
+
+	s := string(digits)
+	unsigned := s
+	if len(s) > 0 && s[0] == '-' {
+		unsigned = s[1:]
+	}
+	if len(unsigned) == 0 || !isDigits(unsigned) {
+		return nil, d.errorf(ErrInvalidInteger)
+	}
+	if unsigned[0] == '0' && len(unsigned) > 1 {
+		return nil, d.errorf(ErrLeadingZero)
+	}
+	if s == "-0" {
+		return nil, d.errorf(ErrNegativeZero)
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return n, nil
+	}
+	if !errors.Is(err, strconv.ErrRange) {
+		return nil, d.errorf(fmt.Errorf("%w: %v", ErrInvalidInteger, err))
+	}
+
+	if !d.useBigInt && !d.wantBig {
+		return nil, d.errorf(fmt.Errorf("%w: %s", ErrIntegerOverflow, s))
+	}
+	b, _ := new(big.Int).SetString(s, 10)
+	return b, nil
+}
+
+func (d *Decoder) readString() (string, error) {
+	digits, err := d.readUntil(separator, ErrInvalidStrLen)
+	if err != nil {
+		return "", err
+	}
+	if len(digits) == 0 || !isDigits(string(digits)) {
+		return "", d.errorf(ErrInvalidStrLen)
+	}
+	if d.strict && digits[0] == '0' && len(digits) > 1 {
+		return "", d.errorf(ErrLeadingZero)
+	}
+
+	length, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return "", d.errorf(fmt.Errorf("%w: %v", ErrInvalidStrLen, err))
+	}
+	if length > d.maxStringLength {
+		return "", d.errorf(ErrStringTooLong)
+	}
+
+	buf := make([]byte, length)
+	n, err := io.ReadFull(d.r, buf)
+	d.offset += int64(n)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if d.raw != nil {
+		d.raw = append(d.raw, buf...)
+	}
+
+	return string(buf), nil
+}
+
+// readUntil consumes bytes up to delim, returning them without delim. Runs
+// longer than maxIntegerDigits fail with tooLong.
+func (d *Decoder) readUntil(delim byte, tooLong error) ([]byte, error) {
+	var buf []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == delim {
+			return buf, nil
+		}
+		if len(buf) >= maxIntegerDigits {
+			return nil, d.errorf(tooLong)
+		}
+		buf = append(buf, c)
+	}
+}
+
+func (d *Decoder) errorf(err error) error {
+	return &SyntaxError{Offset: d.tokenStart, Path: d.path(), Err: err}
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Decode_OK(t *testing.T) {
+	data := `d8:announce33:http://192.168.1.74:6969/announce4:infod6:lengthi59616e4:name9:lorem.txt5:filesl4:spami-3eeee`
+
+	v, err := NewDecoder(strings.NewReader(data)).Decode()
+	require.NoError(t, err)
+
+	expected := map[string]any{
+		"announce": "http://192.168.1.74:6969/announce",
+		"info": map[string]any{
+			"length": int64(59616),
+			"name":   "lorem.txt",
+			"files":  []any{"spam", int64(-3)},
+		},
+	}
+	require.Equal(t, expected, v)
+}
+
+func Test_DecodeStream_OK(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1e3:abcle"))
+
+	for _, expected := range []any{int64(1), "abc", []any{}} {
+		v, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+
+	_, err := dec.Decode()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(10), dec.InputOffset())
+}
+
+func Test_DecodeToken_OK(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d3:keyli7eee"))
+
+	var tokens []Token
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		tokens = append(tokens, tok)
+	}
+
+	expected := []Token{Delim('d'), "key", Delim('l'), int64(7), Delim('e'), Delim('e')}
+	require.Equal(t, expected, tokens)
+}
+
+func Test_Decode_Err(t *testing.T) {
+	cases := map[string]error{
+		"i03e":                  ErrLeadingZero,
+		"i-0e":                  ErrNegativeZero,
+		"i12":                   io.ErrUnexpectedEOF,
+		"ie":                    ErrInvalidInteger,
+		"5:abc":                 io.ErrUnexpectedEOF,
+		"e":                     ErrUnexpectedEnd,
+		"di1ei2ee":              ErrInvalidKey,
+		"d3:keye":               ErrMissingValue,
+		"x":                     ErrInvalidPrefix,
+		"l1:a":                  io.ErrUnexpectedEOF,
+		"i9223372036854775808e": ErrIntegerOverflow,
+	}
+
+	for in, expected := range cases {
+		_, err := NewDecoder(strings.NewReader(in)).Decode()
+		if !errors.Is(err, expected) {
+			t.Errorf("%q: expected %v, got %v", in, expected, err)
+		}
+	}
+}
+
+func Test_DecodeLimits_Err(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("lllleeee"))
+	dec.SetMaxDepth(3)
+	_, err := dec.Decode()
+	require.ErrorIs(t, err, ErrMaxDepth)
+
+	dec = NewDecoder(strings.NewReader("10:0123456789"))
+	dec.SetMaxStringLength(9)
+	_, err = dec.Decode()
+	require.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func Test_DecodeBigInt_OK(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("li9223372036854775807ei-9223372036854775809ee"))
+	dec.UseBigInt()
+
+	v, err := dec.Decode()
+	require.NoError(t, err)
+
+	expected, _ := new(big.Int).SetString("-9223372036854775809", 10)
+	require.Equal(t, []any{int64(math.MaxInt64), expected}, v)
+}
+
+func Test_DecodeSkip_OK(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("ld1:ali1ei2eee4:next"))
+
+	tok, err := dec.Token()
+	require.NoError(t, err)
+	require.Equal(t, Delim('l'), tok)
+
+	require.NoError(t, dec.Skip())
+
+	tok, err = dec.Token()
+	require.NoError(t, err)
+	require.Equal(t, "next", tok)
+}
+
+func Test_EncodeThenDecode_OK(t *testing.T) {
+	original := map[string]any{
+		"zeta":  "last",
+		"alpha": []any{int64(1), "two", map[string]any{"x": int64(-5)}},
+		"empty": []any{},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, NewEncoder(&buf).Encode(original))
+	require.Equal(t, "d5:alphali1e3:twod1:xi-5eee5:emptyle4:zeta4:laste", buf.String())
+
+	decoded, err := NewDecoder(&buf).Decode()
+	require.NoError(t, err)
+	require.Equal(t, original, decoded)
+}
+
+func Test_Encode_Err(t *testing.T) {
+	err := NewEncoder(io.Discard).Encode(1.5)
+	require.Error(t, err)
+}
+
+func Test_DecodeStrict_Err(t *testing.T) {
+	cases := []struct {
+		in     string
+		err    error
+		offset int64
+		path   string
+	}{
+		{"d1:bi1e1:ai2ee", ErrUnsortedKeys, 7, "a"},
+		{"d1:ai1e1:ai2ee", ErrDuplicateKey, 7, "a"},
+		{"d4:infod5:filesld4:pathl1:ae4:pathl1:beeeee", ErrDuplicateKey, 28, "info.files[0].path"},
+		{"l1:a01:be", ErrLeadingZero, 4, "[1]"},
+		{"i1ei2e", ErrTrailingData, 3, ""},
+		{"d4:infod5:filesli1ei2ei-0eeee", ErrNegativeZero, 22, "info.files[2]"},
+	}
+
+	for _, c := range cases {
+		dec := NewDecoder(strings.NewReader(c.in))
+		dec.Strict()
+		_, err := dec.Decode()
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected *SyntaxError, got %v", c.in, err)
+			continue
+		}
+		require.ErrorIs(t, err, c.err, c.in)
+		require.Equal(t, c.offset, syntaxErr.Offset, c.in)
+		require.Equal(t, c.path, syntaxErr.Path, c.in)
+	}
+}
+
+func Test_DecodeLenient_OK(t *testing.T) {
+	v, err := NewDecoder(strings.NewReader("d1:bi1e1:ai2e1:ai3ee")).Decode()
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"a": int64(3), "b": int64(1)}, v)
+
+	v, err = NewDecoder(strings.NewReader("03:abc")).Decode()
+	require.NoError(t, err)
+	require.Equal(t, "abc", v)
+}
+
+func Test_Validate(t *testing.T) {
+	require.NoError(t, Validate(strings.NewReader("d1:ai1e1:bli2eee")))
+	require.ErrorIs(t, Validate(strings.NewReader("d1:bi1e1:ai2ee")), ErrUnsortedKeys)
+	require.ErrorIs(t, Validate(strings.NewReader("i1eX")), ErrTrailingData)
+}
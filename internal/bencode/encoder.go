@@ -0,0 +1,274 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding
+// or to write precomputed bencode verbatim.
+type RawMessage []byte
+
+// Marshaler is implemented by types that can encode themselves. The returned
+// bytes must be a single valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// UnsupportedTypeError is returned when a value of a type that has no bencode
+// representation, such as a float or a map with non-string keys, is encoded.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// UnsupportedValueError is returned for values of a supported type that still
+// cannot be encoded, such as nil pointers outside of a struct field.
+type UnsupportedValueError struct {
+	Str string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+// MarshalerError wraps an error from a MarshalBencode method.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return fmt.Sprintf("bencode: error calling MarshalBencode for type %s: %v", e.Type, e.Err)
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	rawMessageType = reflect.TypeOf(RawMessage(nil))
+	bigIntType     = reflect.TypeOf(big.Int{})
+	marshalerType  = reflect.TypeOf((*Marshaler)(nil)).Elem()
+)
+
+// Marshal returns the bencoding of v.
+//
+// Integers of any size, big.Int and bools are encoded as integers, strings, byte slices and byte
+// arrays as byte strings, slices and arrays as lists, and maps with string
+// keys and structs as dictionaries. Struct fields are named by their
+// `bencode:"key,omitempty"` tag or, without one, by the field name. Values
+// implementing Marshaler encode themselves. Anything else, floats included,
+// fails with an *UnsupportedTypeError.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	out io.Writer
+	// each value is built here and written to out in one go
+	w bytes.Buffer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{out: w}
+}
+
+// Encode writes the bencoding of v to the stream. See Marshal for the
+// supported types.
+func (e *Encoder) Encode(v any) error {
+	defer e.w.Reset()
+
+	// a value that fails halfway is dropped whole, nothing invalid reaches
+	// the stream
+	if err := e.encodeValue(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := e.out.Write(e.w.Bytes())
+	return err
+}
+
+func (e *Encoder) encodeValue(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedValueError{Str: "nil"}
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return &UnsupportedValueError{Str: "empty RawMessage"}
+		}
+		_, err := e.w.Write(v.Bytes())
+		return err
+	}
+
+	if m, ok := asMarshaler(v); ok {
+		return e.encodeMarshaler(m, v.Type())
+	}
+
+	if v.Type() == bigIntType {
+		n := v.Interface().(big.Int)
+		e.w.WriteByte(integerStart)
+		e.w.WriteString(n.String())
+		return e.w.WriteByte(objectEnd)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return e.encodeInt(1)
+		}
+		return e.encodeInt(0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.w.WriteByte(integerStart)
+		e.w.WriteString(strconv.FormatUint(v.Uint(), 10))
+		return e.w.WriteByte(objectEnd)
+	case reflect.String:
+		return e.encodeString(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(v.Bytes())
+		}
+		return e.encodeList(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return e.encodeBytes(b)
+		}
+		return e.encodeList(v)
+	case reflect.Map:
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedValueError{Str: "nil " + v.Type().String()}
+		}
+		return e.encodeValue(v.Elem())
+	}
+
+	return &UnsupportedTypeError{Type: v.Type()}
+}
+
+func asMarshaler(v reflect.Value) (Marshaler, bool) {
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(marshalerType) {
+		return v.Interface().(Marshaler), true
+	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+func (e *Encoder) encodeMarshaler(m Marshaler, t reflect.Type) error {
+	b, err := m.MarshalBencode()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+
+	// the output is written verbatim so it has to be exactly one value
+	d := NewDecoder(bytes.NewReader(b))
+	if err := d.Skip(); err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+	if d.InputOffset() != int64(len(b)) {
+		return &MarshalerError{Type: t, Err: ErrTrailingData}
+	}
+
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) encodeInt(n int64) error {
+	e.w.WriteByte(integerStart)
+	e.w.WriteString(strconv.FormatInt(n, 10))
+	return e.w.WriteByte(objectEnd)
+}
+
+func (e *Encoder) encodeString(s string) error {
+	e.w.WriteString(strconv.Itoa(len(s)))
+	e.w.WriteByte(separator)
+	_, err := e.w.WriteString(s)
+	return err
+}
+
+func (e *Encoder) encodeBytes(b []byte) error {
+	e.w.WriteString(strconv.Itoa(len(b)))
+	e.w.WriteByte(separator)
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) encodeList(v reflect.Value) error {
+	e.w.WriteByte(listStart)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encodeValue(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte(objectEnd)
+}
+
+// Important reminder, dictionary keys are written in lexicographic order
+func (e *Encoder) encodeMap(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	e.w.WriteByte(dictionaryStart)
+	for _, k := range keys {
+		if err := e.encodeString(k.String()); err != nil {
+			return err
+		}
+		if err := e.encodeValue(v.MapIndex(k)); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte(objectEnd)
+}
+
+func (e *Encoder) encodeStruct(v reflect.Value) error {
+	e.w.WriteByte(dictionaryStart)
+	for _, f := range cachedFields(v.Type()) {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface) && fv.IsNil() {
+			continue
+		}
+		if fv.Type() == rawMessageType && fv.Len() == 0 {
+			continue
+		}
+		if err := e.encodeString(f.key); err != nil {
+			return err
+		}
+		if err := e.encodeValue(fv); err != nil {
+			return err
+		}
+	}
+	return e.w.WriteByte(objectEnd)
+}
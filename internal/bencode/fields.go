@@ -0,0 +1,148 @@
+package bencode
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes how a struct field maps to a dictionary key.
+type field struct {
+	key       string
+	index     []int
+	omitEmpty bool
+	tagged    bool // the key comes from a tag, not the field name
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encodable fields of t sorted by key, which is the
+// order they have to be written in.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t, nil))
+	return f.([]field)
+}
+
+func typeFields(t reflect.Type, parent []int) []field {
+	var fields []field
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		index := append(append([]int{}, parent...), i)
+
+		if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, typeFields(sf.Type, index)...)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		tagged := name != ""
+		if !tagged {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			key:       name,
+			index:     index,
+			omitEmpty: slices.Contains(strings.Split(opts, ","), "omitempty"),
+			tagged:    tagged,
+		})
+	}
+
+	if parent != nil {
+		return fields
+	}
+
+	// the same key can come from embedded structs, it goes to the dominant
+	// field or to none, like encoding/json does
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].key < fields[j].key
+	})
+	var out []field
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].key == fields[i].key {
+			j++
+		}
+		if f, ok := dominantField(fields[i:j]); ok {
+			out = append(out, f)
+		}
+		i = j
+	}
+
+	return out
+}
+
+// dominantField picks the field a key goes to among the fields with that key.
+// The shallowest one wins, a tagged one over untagged ones at the same depth,
+// and a tie leaves the key to no field.
+func dominantField(fields []field) (field, bool) {
+	depth := len(fields[0].index)
+	for _, f := range fields[1:] {
+		depth = min(depth, len(f.index))
+	}
+
+	var dominant []field
+	tagged := 0
+	for _, f := range fields {
+		if len(f.index) != depth {
+			continue
+		}
+		dominant = append(dominant, f)
+		if f.tagged {
+			tagged++
+		}
+	}
+
+	if len(dominant) == 1 {
+		return dominant[0], true
+	}
+	if tagged == 1 {
+		for _, f := range dominant {
+			if f.tagged {
+				return f, true
+			}
+		}
+	}
+	return field{}, false
+}
+
+// lookupField finds the field for a dictionary key. Keys are byte strings,
+// so only an exact match counts.
+func lookupField(fields []field, key string) *field {
+	for i := range fields {
+		if fields[i].key == key {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
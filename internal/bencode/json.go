@@ -0,0 +1,154 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// BinaryEncoding selects how byte strings that are not valid UTF-8, like
+// pieces or compact peer lists, are represented in JSON.
+type BinaryEncoding int
+
+const (
+	BinaryHex BinaryEncoding = iota
+	BinaryBase64
+)
+
+// Binary strings become a single key JSON object holding the encoded bytes,
+// so they can be told apart from text when converting back. Dictionary keys
+// starting with jsonEscape get another one in front, so a real "$hex" key is
+// not mistaken for one.
+const (
+	jsonHexKey    = "$hex"
+	jsonBase64Key = "$base64"
+	jsonEscape    = "$"
+)
+
+// ToJSON converts a decoded bencode value into indented JSON.
+func ToJSON(v any, binary BinaryEncoding) ([]byte, error) {
+	j, err := toJSONValue(v, binary)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(j, "", "  ")
+}
+
+func toJSONValue(v any, binary BinaryEncoding) (any, error) {
+	switch val := v.(type) {
+	case int64:
+		return json.Number(fmt.Sprint(val)), nil
+	case *big.Int:
+		return json.Number(val.String()), nil
+	case string:
+		if utf8.ValidString(val) {
+			return val, nil
+		}
+		if binary == BinaryBase64 {
+			return map[string]string{jsonBase64Key: base64.StdEncoding.EncodeToString([]byte(val))}, nil
+		}
+		return map[string]string{jsonHexKey: hex.EncodeToString([]byte(val))}, nil
+	case []any:
+		list := make([]any, len(val))
+		for i, item := range val {
+			j, err := toJSONValue(item, binary)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = j
+		}
+		return list, nil
+	case map[string]any:
+		dict := make(map[string]any, len(val))
+		for k, item := range val {
+			j, err := toJSONValue(item, binary)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(k, jsonEscape) {
+				k = jsonEscape + k
+			}
+			dict[k] = j
+		}
+		return dict, nil
+	}
+
+	return nil, &UnsupportedTypeError{Type: reflect.TypeOf(v)}
+}
+
+// FromJSON converts JSON produced by ToJSON, or written by hand, back into a
+// value that can be passed to Marshal. Numbers must be integers.
+func FromJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var j any
+	if err := dec.Decode(&j); err != nil {
+		return nil, err
+	}
+	return fromJSONValue(j)
+}
+
+func fromJSONValue(j any) (any, error) {
+	switch val := j.(type) {
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n, nil
+		}
+		if n, ok := new(big.Int).SetString(string(val), 10); ok {
+			return n, nil
+		}
+		return nil, fmt.Errorf("bencode: %s is not an integer", val)
+	case bool:
+		if val {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		return val, nil
+	case []any:
+		list := make([]any, len(val))
+		for i, item := range val {
+			v, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case map[string]any:
+		if len(val) == 1 {
+			if s, ok := val[jsonHexKey].(string); ok {
+				b, err := hex.DecodeString(s)
+				return string(b), err
+			}
+			if s, ok := val[jsonBase64Key].(string); ok {
+				b, err := base64.StdEncoding.DecodeString(s)
+				return string(b), err
+			}
+		}
+		dict := make(map[string]any, len(val))
+		for k, item := range val {
+			v, err := fromJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			// only escaped keys start with two, hand written ones keep theirs
+			if strings.HasPrefix(k, jsonEscape+jsonEscape) {
+				k = k[len(jsonEscape):]
+			}
+			dict[k] = v
+		}
+		return dict, nil
+	case nil:
+		return nil, &UnsupportedValueError{Str: "null"}
+	}
+
+	return nil, &UnsupportedTypeError{Type: reflect.TypeOf(j)}
+}
@@ -0,0 +1,89 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_JSONRoundTrip_OK(t *testing.T) {
+	data := []byte("d8:announce3:url4:infod6:lengthi5000000000e6:pieces4:\x00\xff\x10\x80e5:peersl6:\x7f\x00\x00\x01\x1a\xe1ee")
+
+	v, err := NewDecoder(bytes.NewReader(data)).Decode()
+	require.NoError(t, err)
+
+	for _, binary := range []BinaryEncoding{BinaryHex, BinaryBase64} {
+		j, err := ToJSON(v, binary)
+		require.NoError(t, err)
+
+		back, err := FromJSON(j)
+		require.NoError(t, err)
+
+		raw, err := Marshal(back)
+		require.NoError(t, err)
+		require.Equal(t, string(data), string(raw))
+	}
+
+	j, err := ToJSON(v, BinaryHex)
+	require.NoError(t, err)
+	require.Contains(t, string(j), `"$hex": "00ff1080"`)
+	require.Contains(t, string(j), `"length": 5000000000`)
+}
+
+func Test_JSONDollarKeys_OK(t *testing.T) {
+	data := []byte("d1:ad4:$hex4:00ffe1:bd7:$base648:AAEC/w==e1:cd3:$$x1:ye1:dd4:$hex3:\x00\xff\x10ee")
+
+	v, err := NewDecoder(bytes.NewReader(data)).Decode()
+	require.NoError(t, err)
+
+	j, err := ToJSON(v, BinaryHex)
+	require.NoError(t, err)
+	require.Contains(t, string(j), `"$$hex": "00ff"`)
+
+	back, err := FromJSON(j)
+	require.NoError(t, err)
+	raw, err := Marshal(back)
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(raw))
+
+	// keys written by hand with a single $ are taken as they are
+	back, err = FromJSON([]byte(`{"$x": 1}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"$x": int64(1)}, back)
+}
+
+func Test_FromJSON_Err(t *testing.T) {
+	_, err := FromJSON([]byte(`{"a": 1.5}`))
+	require.Error(t, err)
+
+	_, err = FromJSON([]byte(`[null]`))
+	require.Error(t, err)
+}
+
+func Test_Lookup_OK(t *testing.T) {
+	v := map[string]any{
+		"info": map[string]any{
+			"files": []any{
+				map[string]any{"path": []any{"a", "b"}},
+			},
+		},
+	}
+
+	got, err := Lookup(v, "info.files[0].path[1]")
+	require.NoError(t, err)
+	require.Equal(t, "b", got)
+
+	got, err = Lookup(v, "")
+	require.NoError(t, err)
+	require.Equal(t, v, got)
+}
+
+func Test_Lookup_Err(t *testing.T) {
+	v := map[string]any{"info": map[string]any{"files": []any{}}}
+
+	for _, path := range []string{"missing", "info.files[0]", "info[0]", "info.files.x", "info.files[x]", "info.files[0"} {
+		_, err := Lookup(v, path)
+		require.Error(t, err, path)
+	}
+}
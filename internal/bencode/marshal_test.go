@@ -0,0 +1,270 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength uint32     `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Length      *int64     `bencode:"length,omitempty"`
+}
+
+type testMetainfo struct {
+	Announce     string            `bencode:"announce"`
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"`
+	Comment      string            `bencode:"comment,omitempty"`
+	Info         testInfo          `bencode:"info"`
+	Extra        map[string]string `bencode:"extra,omitempty"`
+	Ignored      string            `bencode:"-"`
+}
+
+func Test_MarshalStruct_OK(t *testing.T) {
+	length := int64(59616)
+	in := testMetainfo{
+		Announce: "http://tracker/announce",
+		Info: testInfo{
+			Name:        "lorem.txt",
+			PieceLength: 32768,
+			Pieces:      []byte("ABCDEFGHIJKLMNOPQRST"),
+			Length:      &length,
+		},
+		Ignored: "not encoded",
+	}
+
+	raw, err := Marshal(in)
+	require.NoError(t, err)
+	require.Equal(t, "d8:announce23:http://tracker/announce4:infod6:lengthi59616e4:name9:lorem.txt12:piece lengthi32768e6:pieces20:ABCDEFGHIJKLMNOPQRSTee", string(raw))
+
+	var out testMetainfo
+	require.NoError(t, Unmarshal(raw, &out))
+	in.Ignored = ""
+	require.Equal(t, in, out)
+}
+
+func Test_UnmarshalMultiFile_OK(t *testing.T) {
+	data := []byte("d4:infod5:filesld6:lengthi3e4:pathl1:a1:beed6:lengthi4e4:pathl1:ceee4:name3:dir7:privatei1eee")
+
+	var out testMetainfo
+	require.NoError(t, Unmarshal(data, &out))
+
+	require.True(t, out.Info.Private)
+	require.Nil(t, out.Info.Length)
+	require.Equal(t, []testFile{
+		{Length: 3, Path: []string{"a", "b"}},
+		{Length: 4, Path: []string{"c"}},
+	}, out.Info.Files)
+}
+
+func Test_UnmarshalRawMessage_OK(t *testing.T) {
+	data := []byte("d4:infod4:name1:x6:custom3:yese5:otheri1ee")
+
+	var out struct {
+		Info  RawMessage `bencode:"info"`
+		Other any        `bencode:"other"`
+	}
+	require.NoError(t, Unmarshal(data, &out))
+	require.Equal(t, "d4:name1:x6:custom3:yese", string(out.Info))
+	require.Equal(t, int64(1), out.Other)
+
+	raw, err := Marshal(out)
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(raw))
+}
+
+func Test_UnmarshalArrayAndMap_OK(t *testing.T) {
+	var hash [4]byte
+	require.NoError(t, Unmarshal([]byte("4:abcd"), &hash))
+	require.Equal(t, [4]byte{'a', 'b', 'c', 'd'}, hash)
+
+	var m map[string]RawMessage
+	require.NoError(t, Unmarshal([]byte("d1:ai1e1:bl1:xee"), &m))
+	require.Equal(t, map[string]RawMessage{"a": RawMessage("i1e"), "b": RawMessage("l1:xe")}, m)
+}
+
+func Test_MarshalIntegers_OK(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	in := struct {
+		A int8     `bencode:"a"`
+		B uint64   `bencode:"b"`
+		C int64    `bencode:"c"`
+		D *big.Int `bencode:"d"`
+		E uint16   `bencode:"e"`
+	}{-8, math.MaxUint64, math.MinInt64, huge, 65535}
+
+	raw, err := Marshal(in)
+	require.NoError(t, err)
+	require.Equal(t, "d1:ai-8e1:bi18446744073709551615e1:ci-9223372036854775808e1:di123456789012345678901234567890e1:ei65535ee", string(raw))
+
+	out := in
+	out.A, out.B, out.C, out.D, out.E = 0, 0, 0, nil, 0
+	require.NoError(t, Unmarshal(raw, &out))
+	require.Equal(t, in, out)
+}
+
+func Test_Unmarshal_Err(t *testing.T) {
+	var typeErr *UnmarshalTypeError
+
+	var s string
+	err := Unmarshal([]byte("i5e"), &s)
+	require.True(t, errors.As(err, &typeErr))
+
+	var u uint8
+	err = Unmarshal([]byte("i300e"), &u)
+	require.True(t, errors.As(err, &typeErr))
+
+	err = Unmarshal([]byte("i-1e"), &u)
+	require.True(t, errors.As(err, &typeErr))
+
+	var n int64
+	err = Unmarshal([]byte("i9223372036854775808e"), &n)
+	require.ErrorIs(t, err, ErrIntegerOverflow)
+
+	var u64 uint64
+	err = Unmarshal([]byte("i18446744073709551616e"), &u64)
+	require.True(t, errors.As(err, &typeErr))
+
+	var hash [4]byte
+	err = Unmarshal([]byte("3:abc"), &hash)
+	require.True(t, errors.As(err, &typeErr))
+
+	require.Error(t, Unmarshal([]byte("i1e"), s))
+}
+
+type testID [4]byte
+
+func (id testID) MarshalBencode() ([]byte, error) {
+	return Marshal(fmt.Sprintf("%x", id[:]))
+}
+
+type testBroken struct{}
+
+func (testBroken) MarshalBencode() ([]byte, error) {
+	return []byte("i1ei2e"), nil
+}
+
+func Test_MarshalMarshaler_OK(t *testing.T) {
+	in := map[string]any{
+		"id":  testID{0xde, 0xad, 0xbe, 0xef},
+		"ids": []testID{{1, 2, 3, 4}},
+	}
+
+	raw, err := Marshal(in)
+	require.NoError(t, err)
+	require.Equal(t, "d2:id8:deadbeef3:idsl8:01020304ee", string(raw))
+}
+
+func Test_Marshal_Err(t *testing.T) {
+	var typeErr *UnsupportedTypeError
+	var valueErr *UnsupportedValueError
+	var marshalerErr *MarshalerError
+
+	_, err := Marshal(1.5)
+	require.True(t, errors.As(err, &typeErr))
+
+	_, err = Marshal([]any{"a", float32(2)})
+	require.True(t, errors.As(err, &typeErr))
+
+	_, err = Marshal(map[int]string{1: "a"})
+	require.True(t, errors.As(err, &typeErr))
+
+	_, err = Marshal(nil)
+	require.True(t, errors.As(err, &valueErr))
+
+	_, err = Marshal([]any{nil})
+	require.True(t, errors.As(err, &valueErr))
+
+	_, err = Marshal(testBroken{})
+	require.True(t, errors.As(err, &marshalerErr))
+	require.ErrorIs(t, err, ErrTrailingData)
+}
+
+func Test_EncoderDropsPartialValue(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	require.Error(t, enc.Encode([]any{"ok", 1.5}))
+	require.NoError(t, enc.Encode([]any{"ok"}))
+	require.Equal(t, "l2:oke", buf.String())
+
+	// even past any buffer size
+	require.Error(t, enc.Encode([]any{strings.Repeat("x", 10000), 1.5}))
+	require.Equal(t, "l2:oke", buf.String())
+}
+
+type testEmbeddedA struct {
+	Name  string `bencode:"name"`
+	Dup   string `bencode:"dup"`
+	Depth string `bencode:"depth"`
+}
+
+type testEmbeddedB struct {
+	Dup  string `bencode:"dup"`
+	Tied string
+}
+
+type testEmbeddedC struct {
+	Tied string
+}
+
+type testEmbedded struct {
+	testEmbeddedA
+	testEmbeddedB
+	testEmbeddedC
+	Depth string `bencode:"depth"`
+}
+
+func Test_MarshalEmbeddedConflicts_OK(t *testing.T) {
+	in := testEmbedded{
+		testEmbeddedA: testEmbeddedA{Name: "a", Dup: "a", Depth: "deep"},
+		testEmbeddedB: testEmbeddedB{Dup: "b", Tied: "b"},
+		testEmbeddedC: testEmbeddedC{Tied: "c"},
+		Depth:         "shallow",
+	}
+
+	// the shallow depth wins, dup and Tied tie and are left out
+	raw, err := Marshal(in)
+	require.NoError(t, err)
+	require.Equal(t, "d5:depth7:shallow4:name1:ae", string(raw))
+
+	var out testEmbedded
+	require.NoError(t, Unmarshal([]byte("d3:dup1:x5:depth1:y4:name1:z4:Tied1:we"), &out))
+	require.Equal(t, testEmbedded{testEmbeddedA: testEmbeddedA{Name: "z"}, Depth: "y"}, out)
+}
+
+func Test_UnmarshalExactKeys_OK(t *testing.T) {
+	var out struct {
+		Name    string `bencode:"name"`
+		Comment string
+	}
+	require.NoError(t, Unmarshal([]byte("d7:comment1:x4:Name1:ye"), &out))
+	require.Empty(t, out.Name)
+	require.Empty(t, out.Comment)
+}
+
+func Test_MarshalTagOptions_OK(t *testing.T) {
+	in := struct {
+		Comment string `bencode:"comment,other,omitempty"`
+		Name    string `bencode:"name,omitemptyish"`
+	}{}
+
+	raw, err := Marshal(in)
+	require.NoError(t, err)
+	require.Equal(t, "d4:name0:e", string(raw))
+}
@@ -0,0 +1,74 @@
+package bencode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Lookup walks a decoded value following path, which uses the same notation
+// as SyntaxError.Path: dictionary keys separated by dots and list indexes in
+// brackets, e.g. info.files[3].path. An empty path returns v itself.
+func Lookup(v any, path string) (any, error) {
+	cur := v
+	walked := ""
+
+	for path != "" {
+		if path[0] == '[' {
+			end := strings.IndexByte(path, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("bencode: unterminated index in path at %q", path)
+			}
+			index, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("bencode: invalid index %q in path", path[1:end])
+			}
+
+			list, ok := cur.([]any)
+			if !ok {
+				return nil, fmt.Errorf("bencode: %s is not a list", describePath(walked))
+			}
+			if index < 0 || index >= len(list) {
+				return nil, fmt.Errorf("bencode: index %d out of range for %s with %d elements", index, describePath(walked), len(list))
+			}
+
+			cur = list[index]
+			walked += path[:end+1]
+			path = path[end+1:]
+			path = strings.TrimPrefix(path, ".")
+			continue
+		}
+
+		end := strings.IndexAny(path, ".[")
+		if end == -1 {
+			end = len(path)
+		}
+		key := path[:end]
+
+		dict, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("bencode: %s is not a dictionary", describePath(walked))
+		}
+		val, ok := dict[key]
+		if !ok {
+			return nil, fmt.Errorf("bencode: key %q not found in %s", key, describePath(walked))
+		}
+
+		cur = val
+		if walked != "" {
+			walked += "."
+		}
+		walked += key
+		path = path[end:]
+		path = strings.TrimPrefix(path, ".")
+	}
+
+	return cur, nil
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "the top level value"
+	}
+	return path
+}
@@ -0,0 +1,312 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// UnmarshalTypeError describes a bencode value that could not be stored in a
+// Go value of the given type.
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s (offset %d)", e.Value, e.Type, e.Offset)
+}
+
+// Unmarshal decodes the first bencoded value in data and stores the result in
+// the value pointed to by v. It follows the rules of Marshal in reverse,
+// allocating maps, slices and pointers as needed. Dictionary keys without a
+// matching struct field are ignored.
+func Unmarshal(data []byte, v any) error {
+	return NewDecoder(bytes.NewReader(data)).DecodeInto(v)
+}
+
+// DecodeInto reads the next complete value from the input and stores it in
+// the value pointed to by v.
+func (d *Decoder) DecodeInto(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: DecodeInto(non-pointer %T)", v)
+	}
+
+	top := len(d.stack) == 0
+	if err := d.unmarshal(rv.Elem()); err != nil {
+		return err
+	}
+	if top {
+		return d.checkEnd()
+	}
+	return nil
+}
+
+func (d *Decoder) unmarshal(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		raw, err := d.readRaw()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.unmarshal(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError("value", v.Type())
+		}
+		val, err := d.decodeNext()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(val))
+		return nil
+	}
+
+	// values above the int64 range are only representable by these targets
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		d.wantBig = true
+	default:
+		d.wantBig = v.Type() == bigIntType
+	}
+	tok, err := d.Token()
+	d.wantBig = false
+	if err != nil {
+		return err
+	}
+
+	switch tok := tok.(type) {
+	case int64:
+		return d.storeInt(tok, v)
+	case *big.Int:
+		return d.storeBigInt(tok, v)
+	case string:
+		return d.storeString(tok, v)
+	}
+
+	switch tok.(Delim) {
+	case Delim(listStart):
+		return d.unmarshalList(v)
+	case Delim(dictionaryStart):
+		return d.unmarshalDictionary(v)
+	}
+
+	return d.errorf(ErrUnexpectedEnd)
+}
+
+func (d *Decoder) storeInt(n int64, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(n != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			return d.typeError(fmt.Sprintf("integer %d", n), v.Type())
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return d.typeError(fmt.Sprintf("integer %d", n), v.Type())
+		}
+		v.SetUint(uint64(n))
+		return nil
+	}
+
+	if v.Type() == bigIntType {
+		v.Set(reflect.ValueOf(*big.NewInt(n)))
+		return nil
+	}
+
+	return d.typeError("integer", v.Type())
+}
+
+func (d *Decoder) storeBigInt(n *big.Int, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n.Sign() < 0 || !n.IsUint64() || v.OverflowUint(n.Uint64()) {
+			return d.typeError(fmt.Sprintf("integer %s", n), v.Type())
+		}
+		v.SetUint(n.Uint64())
+		return nil
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(n))
+		return nil
+	}
+
+	if v.Type() == bigIntType {
+		v.Set(reflect.ValueOf(*n))
+		return nil
+	}
+
+	return d.typeError(fmt.Sprintf("integer %s", n), v.Type())
+}
+
+func (d *Decoder) storeString(s string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(s))
+			return nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(s) != v.Len() {
+				return d.typeError(fmt.Sprintf("string of length %d", len(s)), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf([]byte(s)))
+			return nil
+		}
+	}
+
+	return d.typeError("string", v.Type())
+}
+
+func (d *Decoder) unmarshalList(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+		v.SetLen(0)
+		for {
+			end, err := d.atEnd()
+			if err != nil || end {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.unmarshal(elem); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem))
+		}
+	case reflect.Array:
+		for i := 0; ; i++ {
+			end, err := d.atEnd()
+			if err != nil || end {
+				return err
+			}
+			if i >= v.Len() {
+				return d.typeError("list", v.Type())
+			}
+			if err := d.unmarshal(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.typeError("list", v.Type())
+}
+
+func (d *Decoder) unmarshalDictionary(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.typeError("dictionary", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for {
+			key, end, err := d.nextKey()
+			if err != nil || end {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.unmarshal(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		for {
+			key, end, err := d.nextKey()
+			if err != nil || end {
+				return err
+			}
+			f := lookupField(fields, key)
+			if f == nil {
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.unmarshal(fieldByIndexAlloc(v, f.index)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.typeError("dictionary", v.Type())
+}
+
+// nextKey reads the next dictionary key, reporting end when the dictionary
+// has been closed instead.
+func (d *Decoder) nextKey() (string, bool, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return "", false, err
+	}
+	if tok == Delim(objectEnd) {
+		return "", true, nil
+	}
+	return tok.(string), false, nil
+}
+
+// atEnd consumes the end of the current list if it is next.
+func (d *Decoder) atEnd() (bool, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	if c != objectEnd {
+		return false, nil
+	}
+	_, err = d.Token()
+	return true, err
+}
+
+// readRaw returns the exact bytes of the next complete value.
+func (d *Decoder) readRaw() ([]byte, error) {
+	outer := d.raw
+	d.raw = []byte{}
+	err := d.Skip()
+	raw := d.raw
+	if outer != nil {
+		outer = append(outer, raw...)
+	}
+	d.raw = outer
+	return raw, err
+}
+
+func (d *Decoder) typeError(value string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: d.offset}
+}
+
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
@@ -8,202 +8,70 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
-)
-
-// BEncoding handles encoding and decoding of bencoded data.
-// TODO Only the minimal subset required for .torrent files is implemented for now
-type BEncoding struct{}
 
-// This is how the structs are encoded and alligns with the protocol
-const (
-	separator       = byte(':')
-	integerStart    = byte('i')
-	dictionaryStart = byte('d')
-	listStart       = byte('l')
-	objectEnd       = byte('e')
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
 )
 
-func (BEncoding) decodeNumber(buf []byte, pos int) (int, int, error) {
-	if pos >= len(buf) {
-		return 0, pos, io.ErrUnexpectedEOF
-	}
-
-	negative := false
-	if buf[pos] == '-' {
-		negative = true
-		pos++
-		if pos >= len(buf) {
-			return 0, pos, errors.New("negative sign without number")
-		}
-	}
-
-	if buf[pos] < '0' || buf[pos] > '9' {
-		return 0, pos, errors.New("invalid digit in number")
-	}
-
-	if buf[pos] == '0' && pos+1 < len(buf) && buf[pos+1] != objectEnd {
-		return 0, pos, errors.New("leading zeros are not allowed")
-	}
-
-	start := pos
-	for pos < len(buf) && buf[pos] >= '0' && buf[pos] <= '9' {
-		pos++
-	}
-
-	if pos >= len(buf) || buf[pos] != objectEnd {
-		return 0, pos, errors.New("unterminated integer: missing 'e'")
-	}
-
-	numStr := string(buf[start:pos])
-	n, err := strconv.Atoi(numStr)
-	if err != nil {
-		return 0, pos, fmt.Errorf("invalid number: %v", err)
-	}
-
-	if negative {
-		if n == 0 {
-			return 0, pos, errors.New("negative zero is not allowed")
-		}
-		n = -n
-	}
-
-	return n, pos + 1, nil
-}
-
-// form "<len>:<data>".
-func (BEncoding) decodeString(buf []byte, pos int) (string, int, error) {
-	start := pos
-	for pos < len(buf) && buf[pos] != separator {
-		if buf[pos] < '0' || buf[pos] > '9' {
-			return "", pos, errors.New("invalid digit in string length")
-		}
-		pos++
-	}
-	if pos >= len(buf) {
-		return "", pos, io.ErrUnexpectedEOF
-	}
-
-	length, err := strconv.Atoi(string(buf[start:pos]))
-	if err != nil {
-		return "", pos, err
-	}
-
-	pos++
-	end := pos + length
-	if end > len(buf) {
-		return "", end, io.ErrUnexpectedEOF
-	}
-
-	return string(buf[pos:end]), end, nil
-}
-
-func (b BEncoding) decodeDictionary(buf []byte, pos int) (map[string]any, int, error) {
-	dict := make(map[string]any)
-	head := pos
-	for head < len(buf) && buf[head] != objectEnd {
-		key, next, err := b.decodeString(buf, head)
-		if err != nil {
-			return nil, next, err
-		}
-		val, next2, err := b.decodeAny(buf, next)
-		if err != nil {
-			return nil, next2, err
-		}
-		dict[key] = val
-		head = next2
-	}
-	if head >= len(buf) || buf[head] != objectEnd {
-		return nil, head, io.ErrUnexpectedEOF
-	}
-	return dict, head + 1, nil
-}
+// BEncoding handles encoding and decoding of bencoded data. The generic work
+// is done by the bencode package, this adds the torrent specific parts.
+type BEncoding struct{}
 
-func (b BEncoding) decodeList(buf []byte, pos int) ([]any, int, error) {
-	var list []any
-	head := pos
-	for head < len(buf) && buf[head] != objectEnd {
-		val, next, err := b.decodeAny(buf, head)
-		if err != nil {
-			return nil, next, err
-		}
-		list = append(list, val)
-		head = next
-	}
-	if head >= len(buf) || buf[head] != objectEnd {
-		return nil, head, io.ErrUnexpectedEOF
-	}
-	return list, head + 1, nil
+func (b BEncoding) Decode(buf []byte) (any, error) {
+	return b.DecodeReader(bytes.NewReader(buf))
 }
 
-func (b BEncoding) decodeAny(buf []byte, pos int) (any, int, error) {
-	if pos >= len(buf) {
-		return nil, pos, io.ErrUnexpectedEOF
-	}
-	switch buf[pos] {
-	case integerStart:
-		return b.decodeNumber(buf, pos+1)
-	case listStart:
-		return b.decodeList(buf, pos+1)
-	case dictionaryStart:
-		return b.decodeDictionary(buf, pos+1)
-	default:
-		if buf[pos] >= '0' && buf[pos] <= '9' {
-			return b.decodeString(buf, pos)
-		}
-	}
-	return nil, pos, errors.New("unknown type prefix")
+// DecodeReader decodes a single value from r without reading the whole
+// input into memory first.
+func (BEncoding) DecodeReader(r io.Reader) (any, error) {
+	return bencode.NewDecoder(r).Decode()
 }
 
-func (b BEncoding) Decode(buf []byte) (any, error) {
-	result, _, err := b.decodeAny(buf, 0)
-
-	if err != nil {
+// DecodeTorrent decodes a .torrent file. The info dictionary is kept as the
+// exact bytes it had on the wire, so the InfoHash matches the one every other
+// client computes, and top level keys we do not know about are kept in Extra.
+func (b BEncoding) DecodeTorrent(buf []byte) (*Torrent, error) {
+	var raw map[string]bencode.RawMessage
+	if err := bencode.Unmarshal(buf, &raw); err != nil {
 		return nil, err
 	}
 
-	return result, nil
-}
-
-func (b BEncoding) findRawInfo(buf []byte) ([]byte, error) {
-	key := []byte("4:info")
-	start := bytes.Index(buf, key)
-	if start == -1 {
+	infoRaw, ok := raw["info"]
+	if !ok {
 		return nil, fmt.Errorf("info dictionary not found")
 	}
 
-	start += len(key)
-
-	_, end, err := b.decodeAny(buf, start)
+	result, err := b.Decode(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	return buf[start:end], nil
-}
-
-
-// TODO i need to change this to have the raw info on a variable to create the torrent with it
-func (b BEncoding) DecodeTorrent(buf []byte) (*Torrent, error) {
-	result, _, err := b.decodeAny(buf, 0)
-
-	if err != nil {
-		return nil, err
+	dic, ok := result.(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent is not a dictionary")
 	}
 
-	infoRaw, err := b.findRawInfo(buf)
+	t, err := NewTorrent(dic, infoRaw)
 	if err != nil {
 		return nil, err
 	}
 
-	t, err := NewTorrent(result.(map[string]any), infoRaw)
-
-	if err != nil {
-		return nil, err
+	for key, val := range raw {
+		if !isKnownTorrentKey(key) {
+			if t.Extra == nil {
+				t.Extra = make(map[string]bencode.RawMessage)
+			}
+			t.Extra[key] = val
+		}
 	}
 
-	return t, err
+	return t, nil
+}
+
+// Lint checks that buf is canonical bencode. Other clients hash the info
+// dictionary as is, so a torrent with unsorted keys still works but is a sign
+// of a broken tool. The returned *bencode.SyntaxError has the offset and path.
+func (BEncoding) Lint(buf []byte) error {
+	return bencode.Validate(bytes.NewReader(buf))
 }
 
 func (b BEncoding) DecodeTorrentFromFile(path string) (*Torrent, error) {
@@ -215,87 +83,11 @@ func (b BEncoding) DecodeTorrentFromFile(path string) (*Torrent, error) {
 	return b.DecodeTorrent(data)
 }
 
-// TODO Encode can have errors to so we need to check them
-// POSITIVE NUMBERS ONLY AND ZEROS
-// TYPES MISMATCH: INTERFACE CONVERTS ETC ...
-
-func (BEncoding) encodeNumber(val int) []byte {
-
-	s := string(integerStart) + strconv.Itoa(val) + string(objectEnd)
-	buf := []byte(s)
-
-	return buf
-}
-
-func (BEncoding) encodeString(val string) []byte {
-
-	s := strconv.Itoa(len(val)) + string(separator) + val
-	buf := []byte(s)
-
-	return buf
-}
-
-func (b BEncoding) encodeList(l []any) []byte {
-
-	buf := []byte{listStart}
-
-	for _, item := range l {
-		val := b.encodeAny(item)
-		buf = append(buf, val...)
-		buf = append(buf, separator)
-	}
-
-	buf[len(buf)-1] = objectEnd
-
-	return buf
-}
-
-// Important reminder, the dic have lexicographic order
-func (b BEncoding) encodeDictionary(m map[string]any) []byte {
-	buf := []byte{dictionaryStart}
-
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
-	}
-
-	sort.Strings(keys)
-
-	for _, k := range keys {
-		key := b.encodeString(k)
-		val := b.encodeAny(m[k])
-		buf = append(buf, key...)
-		buf = append(buf, val...)
-	}
-
-	buf = append(buf, objectEnd)
-	return buf
-}
-
-func (b BEncoding) encodeAny(val any) []byte {
-
-	switch v := val.(type) {
-
-	case int:
-		return b.encodeNumber(v)
-
-	case string:
-		return b.encodeString(v)
-
-	case []any:
-		return b.encodeList(v)
-
-	case map[string]any:
-		return b.encodeDictionary(v)
-
-	default:
-		return nil
-
-	}
-}
-
-func (b BEncoding) Encode(t any) ([]byte, error) {
-	return b.encodeAny(t), nil
+// Encode returns the bencoding of t. Unsupported values, like floats or nil,
+// are reported as *bencode.UnsupportedTypeError or *bencode.UnsupportedValueError
+// instead of being dropped.
+func (BEncoding) Encode(t any) ([]byte, error) {
+	return bencode.Marshal(t)
 }
 
 func (b BEncoding) EncodeTorrent(t Torrent) ([]byte, error) {
@@ -305,9 +97,7 @@ func (b BEncoding) EncodeTorrent(t Torrent) ([]byte, error) {
 		return nil, err
 	}
 
-	encoded := b.encodeAny(raw)
-
-	return encoded, nil
+	return bencode.Marshal(raw)
 }
 
 func (b BEncoding) EncodeTorrentFromFile(name string, t Torrent) error {
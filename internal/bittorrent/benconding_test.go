@@ -2,6 +2,7 @@ package bittorrent
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"testing"
 )
 
@@ -137,3 +138,122 @@ func TestDecodeThenEncode(t *testing.T) {
         t.Errorf("Decode->Encode mismatch\nExpected: %s\nGot:      %s", string(originalData), string(encoded))
     }
 }
+
+func TestDecodeInfoKeyInComment(t *testing.T) {
+	info := `d6:lengthi59616e4:name9:lorem.txt12:piece lengthi32768e6:pieces20:ABCDEFGHIJKLMNOPQRSTe`
+	data := []byte(`d8:announce33:http://192.168.1.74:6969/announce7:comment17:see 4:infod3:fooe4:info` + info + `e`)
+
+	bencoding := BEncoding{}
+
+	torrent, err := bencoding.DecodeTorrent(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if string(torrent.InfoRaw) != info {
+		t.Errorf("InfoRaw mismatch\nExpected: %s\nGot:      %s", info, string(torrent.InfoRaw))
+	}
+
+	if torrent.InfoHash != sha1.Sum([]byte(info)) {
+		t.Errorf("InfoHash was not computed from the info dictionary")
+	}
+}
+
+func TestDecodeThenEncodeTrackerless(t *testing.T) {
+	originalData := []byte(`d10:created by13:mktorrent 1.18:encoding5:UTF-84:infod6:lengthi59616e4:name9:lorem.txt12:piece lengthi32768e6:pieces20:ABCDEFGHIJKLMNOPQRSTe5:nodesll9:127.0.0.1i6881eeee`)
+
+	bencoding := BEncoding{}
+
+	torrent, err := bencoding.DecodeTorrent(originalData)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if torrent.Announce != "" {
+		t.Errorf("announce: got %q, want none", torrent.Announce)
+	}
+
+	encoded, err := bencoding.EncodeTorrent(*torrent)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	if !bytes.Equal(encoded, originalData) {
+		t.Errorf("Decode->Encode mismatch\nExpected: %s\nGot:      %s", string(originalData), string(encoded))
+	}
+}
+
+func TestDecodeThenEncodeUnknownKeys(t *testing.T) {
+	originalData := []byte(`d8:announce33:http://192.168.1.74:6969/announce8:encoding5:UTF-84:infod6:lengthi59616e4:name9:lorem.txt12:piece lengthi32768e6:pieces20:ABCDEFGHIJKLMNOPQRST6:source3:abce8:url-listl17:http://mirror/dl/ee`)
+
+	bencoding := BEncoding{}
+
+	torrent, err := bencoding.DecodeTorrent(originalData)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if _, ok := torrent.Extra["url-list"]; !ok {
+		t.Errorf("unknown key url-list was not kept")
+	}
+
+	encoded, err := bencoding.EncodeTorrent(*torrent)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	if !bytes.Equal(encoded, originalData) {
+		t.Errorf("Decode->Encode mismatch\nExpected: %s\nGot:      %s", string(originalData), string(encoded))
+	}
+}
+
+func TestDecodeLargeTorrent(t *testing.T) {
+	data := []byte(`d8:announce33:http://192.168.1.74:6969/announce13:creation datei4102444800e4:infod6:lengthi5000000000e4:name9:large.iso12:piece lengthi4194304e6:pieces20:ABCDEFGHIJKLMNOPQRSTee`)
+
+	bencoding := BEncoding{}
+
+	torrent, err := bencoding.DecodeTorrent(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if torrent.TotalSize() != 5000000000 {
+		t.Errorf("totalSize: got %d, want %d", torrent.TotalSize(), int64(5000000000))
+	}
+	if torrent.CreationDate != 4102444800 {
+		t.Errorf("creationDate: got %d, want %d", torrent.CreationDate, int64(4102444800))
+	}
+}
+
+func TestDecodePieceLengthOverflow(t *testing.T) {
+	data := []byte(`d8:announce33:http://192.168.1.74:6969/announce4:infod6:lengthi1e4:name1:a12:piece lengthi99999999999e6:pieces20:ABCDEFGHIJKLMNOPQRSTee`)
+
+	bencoding := BEncoding{}
+
+	if _, err := bencoding.DecodeTorrent(data); err == nil {
+		t.Errorf("expected an error for an out of range piece length")
+	}
+}
+
+func TestEncodeValues(t *testing.T) {
+	bencoding := BEncoding{}
+
+	var hash InfoHash
+	copy(hash[:], "12345678901234567890")
+
+	raw, err := bencoding.Encode(map[string]any{
+		"list": []any{"a", int64(1), []any{}},
+		"hash": hash,
+	})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	expected := `d4:hash20:123456789012345678904:listl1:ai1eleee`
+	if string(raw) != expected {
+		t.Errorf("Encode mismatch\nExpected: %s\nGot:      %s", expected, string(raw))
+	}
+
+	if _, err := bencoding.Encode([]any{1.5}); err == nil {
+		t.Errorf("expected an error for a float")
+	}
+}
@@ -0,0 +1,333 @@
+package bittorrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+const (
+	minPieceSize     = 16 * 1024
+	maxPieceSize     = 16 * 1024 * 1024
+	targetPieceCount = 1500
+
+	defaultCreatedBy = "bittorrent-client"
+)
+
+// BuilderOptions controls how CreateTorrent builds the metainfo.
+type BuilderOptions struct {
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	IsPrivate    bool
+
+	// PieceSize must be a power of two, zero picks one from the total size
+	PieceSize int
+	// Workers is how many pieces are hashed at once, zero uses every CPU
+	Workers int
+	// Progress is called after every hashed piece, never concurrently
+	Progress func(hashed, total int)
+}
+
+// CreateTorrent builds a torrent for a single file or a directory. Pieces run
+// across file boundaries, like every client expects, and are hashed in
+// parallel. The result is ready to be written with EncodeTorrentFromFile and
+// to be seeded from the parent directory of path.
+func CreateTorrent(path string, opts BuilderOptions) (*Torrent, error) {
+	path = filepath.Clean(path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := collectFiles(path, info)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Torrent{
+		Announce:     opts.Announce,
+		AnnounceList: announceTiers(opts.AnnounceList),
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		Encoding:     "UTF-8",
+		Name:         filepath.Base(path),
+		IsPrivate:    opts.IsPrivate,
+		Files:        files,
+		DownloadDir:  filepath.Dir(path),
+		BlockSize:    16 * 1024,
+	}
+
+	if t.CreatedBy == "" {
+		t.CreatedBy = defaultCreatedBy
+	}
+
+	if t.TotalSize() == 0 {
+		return nil, errors.New("cannot create a torrent without any data")
+	}
+
+	t.PieceSize = opts.PieceSize
+	if t.PieceSize == 0 {
+		t.PieceSize = choosePieceSize(t.TotalSize())
+	}
+	if t.PieceSize < minPieceSize || t.PieceSize&(t.PieceSize-1) != 0 {
+		return nil, fmt.Errorf("piece size %d must be a power of two of at least %d", t.PieceSize, minPieceSize)
+	}
+
+	root := path
+	if !info.IsDir() {
+		root = t.DownloadDir
+	}
+
+	t.PieceHashes, err = hashPieces(root, files, t.PieceSize, opts.Workers, opts.Progress)
+	if err != nil {
+		return nil, err
+	}
+
+	top, err := t.ToBencodeMap()
+	if err != nil {
+		return nil, err
+	}
+	t.InfoRaw, err = bencode.Marshal(top["info"])
+	if err != nil {
+		return nil, err
+	}
+	t.InfoHash = sha1.Sum(t.InfoRaw)
+
+	t.initializeDownloadState()
+	t.Trackers = tracker.NewManager(t.TrackerTiers())
+	for i := range t.PieceHashes {
+		t.MarkPieceComplete(i)
+	}
+	t.Downloaded = t.TotalSize()
+	t.IsSeeding = true
+
+	return t, nil
+}
+
+// collectFiles lists the regular files under path in a stable order, with
+// slash separated paths relative to it.
+func collectFiles(path string, info fs.FileInfo) ([]FileItem, error) {
+	if !info.IsDir() {
+		return []FileItem{NewFileItem(filepath.Base(path), info.Size(), 0)}, nil
+	}
+
+	var files []FileItem
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileItem{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files found in %s", path)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	var offset int64
+	for i := range files {
+		files[i].Offset = offset
+		offset += files[i].Size
+	}
+
+	return files, nil
+}
+
+// choosePieceSize aims for about targetPieceCount pieces, which keeps the
+// metainfo small without making pieces too expensive to re-download.
+// announceTiers drops the empty urls and the tiers left without any.
+func announceTiers(tiers [][]string) [][]string {
+	var out [][]string
+	for _, tier := range tiers {
+		var urls []string
+		for _, url := range tier {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			out = append(out, urls)
+		}
+	}
+	return out
+}
+
+func choosePieceSize(totalSize int64) int {
+	size := minPieceSize
+	for size < maxPieceSize && totalSize/int64(size) > targetPieceCount {
+		size *= 2
+	}
+	return size
+}
+
+func hashPieces(root string, files []FileItem, pieceSize int, workers int, progress func(int, int)) ([][]byte, error) {
+	var totalSize int64
+	for i := range files {
+		totalSize += files[i].Size
+	}
+
+	numPieces := int((totalSize + int64(pieceSize) - 1) / int64(pieceSize))
+	hashes := make([][]byte, numPieces)
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	pieces := make(chan int)
+	errs := make(chan error, workers)
+	var hashed int
+	var progressMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reader := &piecesReader{root: root, files: files}
+			defer reader.Close()
+
+			buf := make([]byte, pieceSize)
+			for piece := range pieces {
+				start := int64(piece) * int64(pieceSize)
+				length := min(int64(pieceSize), totalSize-start)
+
+				if err := reader.ReadAt(buf[:length], start); err != nil {
+					errs <- err
+					return
+				}
+
+				sum := sha1.Sum(buf[:length])
+				hashes[piece] = sum[:]
+
+				progressMu.Lock()
+				hashed++
+				if progress != nil {
+					progress(hashed, numPieces)
+				}
+				progressMu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for piece := 0; piece < numPieces; piece++ {
+		select {
+		case pieces <- piece:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(pieces)
+	wg.Wait()
+
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// piecesReader reads ranges of the files as if they were one stream, keeping
+// the last file open since pieces are mostly read in order.
+type piecesReader struct {
+	root  string
+	files []FileItem
+
+	open  *os.File
+	index int
+}
+
+func (r *piecesReader) ReadAt(buf []byte, start int64) error {
+	end := start + int64(len(buf))
+
+	for i := range r.files {
+		f := &r.files[i]
+		fileEnd := f.Offset + f.Size
+
+		if end <= f.Offset || start >= fileEnd {
+			continue
+		}
+
+		file, err := r.file(i)
+		if err != nil {
+			return err
+		}
+
+		readStart := max(start, f.Offset)
+		readEnd := min(end, fileEnd)
+
+		_, err = file.ReadAt(buf[readStart-start:readEnd-start], readStart-f.Offset)
+		if err == io.EOF {
+			return fmt.Errorf("%s changed while hashing", f.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *piecesReader) file(index int) (*os.File, error) {
+	if r.open != nil && r.index == index {
+		return r.open, nil
+	}
+	r.Close()
+
+	file, err := os.Open(filepath.Join(r.root, filepath.FromSlash(r.files[index].Path)))
+	if err != nil {
+		return nil, err
+	}
+
+	r.open, r.index = file, index
+	return file, nil
+}
+
+func (r *piecesReader) Close() {
+	if r.open != nil {
+		r.open.Close()
+		r.open = nil
+	}
+}
@@ -0,0 +1,152 @@
+package bittorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateTorrentDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	contents := map[string][]byte{
+		"a.txt":     bytes.Repeat([]byte("a"), 20000),
+		"sub/b.bin": bytes.Repeat([]byte("b"), 30000),
+		"sub/c":     []byte("c"),
+	}
+	for name, data := range contents {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lastHashed, total int
+	torrent, err := CreateTorrent(dir, BuilderOptions{
+		Announce:  "http://tracker/announce",
+		Comment:   "built in a test",
+		IsPrivate: true,
+		PieceSize: 16 * 1024,
+		Workers:   3,
+		Progress: func(hashed, n int) {
+			lastHashed, total = max(lastHashed, hashed), n
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+
+	stream := append(append(append([]byte{}, contents["a.txt"]...), contents["sub/b.bin"]...), contents["sub/c"]...)
+	if torrent.TotalSize() != int64(len(stream)) {
+		t.Fatalf("totalSize: got %d, want %d", torrent.TotalSize(), len(stream))
+	}
+
+	expectedPieces := (len(stream) + 16*1024 - 1) / (16 * 1024)
+	if len(torrent.PieceHashes) != expectedPieces {
+		t.Fatalf("pieces: got %d, want %d", len(torrent.PieceHashes), expectedPieces)
+	}
+	if lastHashed != expectedPieces || total != expectedPieces {
+		t.Errorf("progress: got %d/%d, want %d/%d", lastHashed, total, expectedPieces, expectedPieces)
+	}
+
+	for i := range torrent.PieceHashes {
+		end := min((i+1)*16*1024, len(stream))
+		sum := sha1.Sum(stream[i*16*1024 : end])
+		if !bytes.Equal(sum[:], torrent.PieceHashes[i]) {
+			t.Errorf("pieceHash[%d] does not match the data", i)
+		}
+	}
+
+	paths := []string{"a.txt", "sub/b.bin", "sub/c"}
+	for i, p := range paths {
+		if torrent.Files[i].Path != p {
+			t.Errorf("files[%d]: got %q, want %q", i, torrent.Files[i].Path, p)
+		}
+	}
+
+	out := filepath.Join(t.TempDir(), "data.torrent")
+	bencoding := BEncoding{}
+	if err := bencoding.EncodeTorrentFromFile(out, *torrent); err != nil {
+		t.Fatalf("EncodeTorrentFromFile failed: %v", err)
+	}
+
+	decoded, err := bencoding.DecodeTorrentFromFile(out)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.InfoHash != torrent.InfoHash {
+		t.Errorf("infoHash changed after writing the torrent")
+	}
+	if !decoded.IsPrivate || decoded.Name != "data" || len(decoded.Files) != 3 {
+		t.Errorf("decoded torrent does not match: %+v", decoded)
+	}
+}
+
+func TestCreateTorrentSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single.bin")
+	data := bytes.Repeat([]byte("xyz"), 1000)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := CreateTorrent(path, BuilderOptions{Announce: "http://tracker/announce"})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+
+	if torrent.PieceSize != minPieceSize {
+		t.Errorf("pieceSize: got %d, want %d", torrent.PieceSize, minPieceSize)
+	}
+
+	sum := sha1.Sum(data)
+	if len(torrent.PieceHashes) != 1 || !bytes.Equal(torrent.PieceHashes[0], sum[:]) {
+		t.Errorf("single piece hash does not match the data")
+	}
+
+	top, err := torrent.ToBencodeMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := top["info"]; !ok {
+		t.Errorf("info missing from the encoded torrent")
+	}
+}
+
+func TestChoosePieceSize(t *testing.T) {
+	cases := map[int64]int{
+		1:                 16 * 1024,
+		100 * 1024 * 1024: 128 * 1024,
+		4 << 30:           4 * 1024 * 1024,
+		1 << 42:           16 * 1024 * 1024,
+	}
+	for size, expected := range cases {
+		if got := choosePieceSize(size); got != expected {
+			t.Errorf("choosePieceSize(%d): got %d, want %d", size, got, expected)
+		}
+	}
+}
+
+func TestCreateTorrentEmptyTrackers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "single.bin")
+	if err := os.WriteFile(path, []byte("xyz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := CreateTorrent(path, BuilderOptions{
+		Announce:     "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce", ""}, {" "}, {}, {"http://b/announce "}},
+	})
+	if err != nil {
+		t.Fatalf("CreateTorrent failed: %v", err)
+	}
+
+	want := [][]string{{"http://a/announce"}, {"http://b/announce"}}
+	if !reflect.DeepEqual(torrent.AnnounceList, want) {
+		t.Errorf("announce list: got %q, want %q", torrent.AnnounceList, want)
+	}
+}
@@ -4,11 +4,11 @@ import "sync"
 
 type FileItem struct{
 	Path string
-	Size int
-	Offset int
+	Size int64
+	Offset int64
 	mu sync.Mutex
 }
 
-func NewFileItem(path string, size int, offset int) FileItem {
+func NewFileItem(path string, size int64, offset int64) FileItem {
 	return FileItem{Path: path, Size: size, Offset: offset}
 }
@@ -0,0 +1,306 @@
+package bittorrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+const (
+	magnetScheme = "magnet:?"
+	btihPrefix   = "urn:btih:"
+	btmhPrefix   = "urn:btmh:"
+
+	// maxSelectOnly bounds the file indexes of so=, and how many a link can
+	// list counting repeats, so a range like 0-4294967295 is refused
+	maxSelectOnly = 1 << 16
+)
+
+// Magnet is a parsed magnet URI. At least one of the v1 info hash (btih) or
+// the v2 multihash (btmh) is always set.
+type Magnet struct {
+	InfoHash    InfoHash
+	HasInfoHash bool
+	// InfoHashV2 is the raw multihash from urn:btmh, 0x12 0x20 + sha-256
+	InfoHashV2 []byte
+
+	Name     string   // dn
+	Length   int64    // xl
+	Trackers []string // tr
+	WebSeeds []string // ws
+	Peers    []string // x.pe, as host:port
+
+	// SelectOnly holds the file indexes from so= (BEP 53), sorted
+	SelectOnly []int
+}
+
+var ErrNotMagnet = errors.New("not a magnet link")
+
+// ParseMagnet parses a magnet:? URI. Parameters may carry a numeric suffix
+// (tr.1, xt.2) as some clients emit them.
+func ParseMagnet(uri string) (*Magnet, error) {
+	if !strings.HasPrefix(strings.ToLower(uri), magnetScheme) {
+		return nil, ErrNotMagnet
+	}
+
+	m := &Magnet{}
+
+	// parameters are walked in order, url.ParseQuery would lose the tracker
+	// order between tr and tr.N keys
+	for _, param := range strings.Split(uri[len(magnetScheme):], "&") {
+		if param == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet parameter %q: %w", param, err)
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet parameter %q: %w", param, err)
+		}
+
+		if base, suffix, ok := strings.Cut(key, "."); ok && isDecimal(suffix) {
+			key = base
+		}
+
+		if err := m.setParam(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if !m.HasInfoHash && m.InfoHashV2 == nil {
+		return nil, errors.New("magnet link has no urn:btih or urn:btmh exact topic")
+	}
+
+	return m, nil
+}
+
+func (m *Magnet) setParam(name, v string) error {
+	switch name {
+	case "xt":
+		lower := strings.ToLower(v)
+		switch {
+		case strings.HasPrefix(lower, btihPrefix):
+			hash, err := parseBtih(v[len(btihPrefix):])
+			if err != nil {
+				return err
+			}
+			m.InfoHash, m.HasInfoHash = hash, true
+		case strings.HasPrefix(lower, btmhPrefix):
+			mh, err := hex.DecodeString(v[len(btmhPrefix):])
+			if err != nil {
+				return fmt.Errorf("invalid btmh multihash: %w", err)
+			}
+			if len(mh) != 34 || mh[0] != 0x12 || mh[1] != 0x20 {
+				return errors.New("btmh multihash is not a sha2-256 hash")
+			}
+			m.InfoHashV2 = mh
+		}
+	case "dn":
+		m.Name = v
+	case "xl":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid exact length %q", v)
+		}
+		m.Length = n
+	case "tr":
+		m.Trackers = append(m.Trackers, v)
+	case "ws":
+		m.WebSeeds = append(m.WebSeeds, v)
+	case "x.pe":
+		m.Peers = append(m.Peers, v)
+	case "so":
+		indexes, err := parseSelectOnly(v)
+		if err != nil {
+			return err
+		}
+		m.SelectOnly = indexes
+	}
+
+	return nil
+}
+
+// parseBtih accepts the 40 character hex and the 32 character base32 forms.
+func parseBtih(s string) (InfoHash, error) {
+	var hash InfoHash
+
+	switch len(s) {
+	case 40:
+		if _, err := hex.Decode(hash[:], []byte(s)); err != nil {
+			return hash, fmt.Errorf("invalid hex btih: %w", err)
+		}
+	case 32:
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return hash, fmt.Errorf("invalid base32 btih: %w", err)
+		}
+		copy(hash[:], b)
+	default:
+		return hash, fmt.Errorf("btih has invalid length %d", len(s))
+	}
+
+	return hash, nil
+}
+
+// parseSelectOnly expands "0,2,4-6" into [0 2 4 5 6].
+func parseSelectOnly(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	total := 0
+
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid select-only index %q", part)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid select-only range %q", part)
+			}
+		}
+		total += end - start + 1
+		if end >= maxSelectOnly || total > maxSelectOnly {
+			return nil, fmt.Errorf("select-only %q lists too many files", part)
+		}
+		for i := start; i <= end; i++ {
+			seen[i] = true
+		}
+	}
+
+	indexes := make([]int, 0, len(seen))
+	for i := range seen {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	return indexes, nil
+}
+
+// formatSelectOnly is the inverse of parseSelectOnly, collapsing runs into
+// ranges.
+func formatSelectOnly(indexes []int) string {
+	var parts []string
+
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// String emits the magnet URI with the v1 info hash in hex.
+func (m *Magnet) String() string {
+	var params []string
+
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	if m.HasInfoHash {
+		params = append(params, "xt="+btihPrefix+hex.EncodeToString(m.InfoHash[:]))
+	}
+	if m.InfoHashV2 != nil {
+		params = append(params, "xt="+btmhPrefix+hex.EncodeToString(m.InfoHashV2))
+	}
+	if m.Name != "" {
+		add("dn", m.Name)
+	}
+	if m.Length > 0 {
+		add("xl", strconv.FormatInt(m.Length, 10))
+	}
+	for _, tr := range m.Trackers {
+		add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+	for _, pe := range m.Peers {
+		add("x.pe", pe)
+	}
+	if len(m.SelectOnly) > 0 {
+		params = append(params, "so="+formatSelectOnly(m.SelectOnly))
+	}
+
+	return magnetScheme + strings.Join(params, "&")
+}
+
+// Magnet returns a magnet link for the torrent, with every tracker of every
+// tier.
+func (t *Torrent) Magnet() *Magnet {
+	m := &Magnet{
+		InfoHash:    t.InfoHash,
+		HasInfoHash: true,
+		Name:        t.Name,
+		Length:      t.TotalSize(),
+	}
+
+	m.Trackers = t.GetAllTrackers()
+
+	return m
+}
+
+// NewTorrentFromMagnet creates a torrent that only knows its InfoHash, name
+// and trackers. The info dictionary has to be fetched from peers before it
+// can be downloaded.
+func NewTorrentFromMagnet(m *Magnet) (*Torrent, error) {
+	if !m.HasInfoHash {
+		return nil, errors.New("magnet links without a v1 info hash are not supported")
+	}
+
+	t := &Torrent{
+		Name:      m.Name,
+		InfoHash:  m.InfoHash,
+		BlockSize: 16 * 1024,
+		Encoding:  "UTF-8",
+	}
+
+	if t.Name == "" {
+		t.Name = hex.EncodeToString(m.InfoHash[:])
+	}
+
+	// the link does not say which trackers are backups, so they share one
+	// tier, shuffled by the manager like any other
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+		t.AnnounceList = [][]string{slices.Clone(m.Trackers)}
+	}
+	t.Trackers = tracker.NewManager(t.TrackerTiers())
+	t.InitialPeers = slices.Clone(m.Peers)
+
+	return t, nil
+}
+
+func isDecimal(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
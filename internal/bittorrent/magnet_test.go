@@ -0,0 +1,154 @@
+package bittorrent
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHashHex = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+func TestParseMagnetHex(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:" + testHashHex +
+		"&dn=Some+File.iso&xl=1234" +
+		"&tr=udp%3A%2F%2Ftracker.one%3A6969&tr.1=http%3A%2F%2Ftracker.two%2Fannounce" +
+		"&ws=http%3A%2F%2Fmirror%2Ffile&x.pe=10.0.0.1%3A6881&so=0,2,4-6"
+
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+
+	if !m.HasInfoHash || hex.EncodeToString(m.InfoHash[:]) != testHashHex {
+		t.Errorf("unexpected info hash %x", m.InfoHash)
+	}
+	if m.Name != "Some File.iso" {
+		t.Errorf("expected name %q, got %q", "Some File.iso", m.Name)
+	}
+	if m.Length != 1234 {
+		t.Errorf("expected length 1234, got %d", m.Length)
+	}
+
+	expectedTrackers := []string{"udp://tracker.one:6969", "http://tracker.two/announce"}
+	if !reflect.DeepEqual(m.Trackers, expectedTrackers) {
+		t.Errorf("expected trackers %v, got %v", expectedTrackers, m.Trackers)
+	}
+	if !reflect.DeepEqual(m.WebSeeds, []string{"http://mirror/file"}) {
+		t.Errorf("unexpected web seeds %v", m.WebSeeds)
+	}
+	if !reflect.DeepEqual(m.Peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("unexpected peers %v", m.Peers)
+	}
+	if !reflect.DeepEqual(m.SelectOnly, []int{0, 2, 4, 5, 6}) {
+		t.Errorf("unexpected select-only %v", m.SelectOnly)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+
+	if hex.EncodeToString(m.InfoHash[:]) != testHashHex {
+		t.Errorf("expected %s, got %x", testHashHex, m.InfoHash)
+	}
+}
+
+func TestParseMagnetV2(t *testing.T) {
+	mh := "1220" + strings.Repeat("ab", 32)
+
+	m, err := ParseMagnet("magnet:?xt=urn:btmh:" + mh)
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+
+	if m.HasInfoHash {
+		t.Error("v2 only magnet should not have a v1 info hash")
+	}
+	if hex.EncodeToString(m.InfoHashV2) != mh {
+		t.Errorf("unexpected multihash %x", m.InfoHashV2)
+	}
+
+	if _, err := NewTorrentFromMagnet(m); err == nil {
+		t.Error("expected an error creating a torrent from a v2 only magnet")
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	cases := []string{
+		"http://example.com",
+		"magnet:?dn=no+hash",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:" + strings.Repeat("z", 40),
+		"magnet:?xt=urn:btmh:1114" + strings.Repeat("ab", 20),
+		"magnet:?xt=urn:btih:" + testHashHex + "&xl=-1",
+		"magnet:?xt=urn:btih:" + testHashHex + "&so=3-1",
+		"magnet:?xt=urn:btih:" + testHashHex + "&so=0-4294967295",
+		"magnet:?xt=urn:btih:" + testHashHex + "&so=" + strings.Repeat("0-65535,", 4) + "0",
+	}
+
+	for _, uri := range cases {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("expected an error for %q", uri)
+		}
+	}
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:" + testHashHex +
+		"&xt=urn:btmh:1220" + strings.Repeat("01", 32) +
+		"&dn=a+b%26c&xl=99&tr=http%3A%2F%2Ft%2Fa%3Fk%3D1&ws=http%3A%2F%2Fw&x.pe=%5B%3A%3A1%5D%3A6881&so=0-2,5"
+
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatalf("ParseMagnet failed: %v", err)
+	}
+
+	if m.String() != uri {
+		t.Errorf("round trip mismatch:\nexpected %s\n     got %s", uri, m.String())
+	}
+}
+
+func TestTorrentMagnet(t *testing.T) {
+	hash, _ := hex.DecodeString(testHashHex)
+
+	torrent := &Torrent{
+		Name:         "data",
+		Announce:     "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce"}, {"udp://b:80"}},
+		Files:        []FileItem{NewFileItem("data", 500, 0)},
+	}
+	copy(torrent.InfoHash[:], hash)
+
+	m := torrent.Magnet()
+	expected := "magnet:?xt=urn:btih:" + testHashHex +
+		"&dn=data&xl=500&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A80"
+	if m.String() != expected {
+		t.Errorf("expected %s, got %s", expected, m.String())
+	}
+
+	loaded, err := NewTorrentFromMagnet(m)
+	if err != nil {
+		t.Fatalf("NewTorrentFromMagnet failed: %v", err)
+	}
+	if loaded.InfoHash != torrent.InfoHash || loaded.Name != "data" || loaded.Announce != "http://a/announce" {
+		t.Errorf("unexpected torrent from magnet: %+v", loaded)
+	}
+	if len(loaded.AnnounceList) != 1 || len(loaded.AnnounceList[0]) != 2 {
+		t.Errorf("expected both trackers in one tier, got %v", loaded.AnnounceList)
+	}
+	if loaded.Trackers.Len() != 2 {
+		t.Errorf("expected 2 trackers, got %d", loaded.Trackers.Len())
+	}
+
+	m.Peers = []string{"10.0.0.1:6881"}
+	loaded, err = NewTorrentFromMagnet(m)
+	if err != nil {
+		t.Fatalf("NewTorrentFromMagnet failed: %v", err)
+	}
+	if len(loaded.InitialPeers) != 1 || loaded.InitialPeers[0] != "10.0.0.1:6881" {
+		t.Errorf("expected the peers of the magnet, got %v", loaded.InitialPeers)
+	}
+}
@@ -1,30 +1,51 @@
 package bittorrent
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/dmsRosa6/bittorrent-client/internal/peer"
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
 	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
 )
 
 type InfoHash [20]byte
 
+func (h InfoHash) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal(h[:])
+}
+
 type PeerID [20]byte
 
+// clientPrefix starts our peer ids, in the Azureus style
+const clientPrefix = "-BC0001-"
+
+// NewPeerID returns our prefix followed by random bytes.
+func NewPeerID() PeerID {
+	var id PeerID
+	copy(id[:], clientPrefix)
+	rand.Read(id[len(clientPrefix):])
+	return id
+}
+
+func (id PeerID) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal(id[:])
+}
+
 type Torrent struct {
 	// metadata
 	Announce     string
 	AnnounceList [][]string
 	Comment      string
 	CreatedBy    string
-	CreationDate int
+	CreationDate int64
 	Encoding     string
 
 	Name        string
@@ -35,10 +56,13 @@ type Torrent struct {
 	InfoHash    InfoHash
 	InfoRaw     []byte
 
+	// top level keys we do not use, kept so re-encoding is lossless
+	Extra map[string]bencode.RawMessage
+
 	// state
 	DownloadDir     string
 	BlockSize       int
-	IsPieceVerified []byte
+	IsPieceVerified []bool
 	IsBlockAcquired [][]bool
 	OwnedPieces     []byte
 
@@ -46,8 +70,10 @@ type Torrent struct {
 	Uploaded   int64
 
 	// Swarm
-	Peers    map[string]*peer.Peer
-	Trackers []*tracker.Tracker
+	Trackers *tracker.Manager
+	// InitialPeers are dialed when the torrent is added, as host:port. A
+	// magnet link can carry some (x.pe).
+	InitialPeers []string
 
 	IsPaused    bool
 	IsSeeding   bool
@@ -60,11 +86,14 @@ func NewTorrent(dic map[string]any, rawInfoDict []byte) (*Torrent, error) {
 		Encoding:  "UTF-8",
 	}
 
-	announce, ok := dic["announce"].(string)
-	if !ok {
-		return nil, errors.New("announce missing or not a string")
+	// trackerless torrents find their peers over the DHT alone
+	if v, found := dic["announce"]; found {
+		announce, ok := v.(string)
+		if !ok {
+			return nil, errors.New("announce is not a string")
+		}
+		t.Announce = announce
 	}
-	t.Announce = announce
 
 	if encoding, ok := dic["encoding"].(string); ok {
 		t.Encoding = encoding
@@ -75,11 +104,12 @@ func NewTorrent(dic map[string]any, rawInfoDict []byte) (*Torrent, error) {
 	if createdBy, ok := dic["created by"].(string); ok {
 		t.CreatedBy = createdBy
 	}
-	if creationDate, ok := dic["creation date"].(int); ok {
+	if creationDate, ok := dic["creation date"].(int64); ok {
 		t.CreationDate = creationDate
 	}
 
 	if rawInfoDict != nil {
+		t.InfoRaw = rawInfoDict
 		t.InfoHash = sha1.Sum(rawInfoDict)
 	} else {
 		return nil, errors.New("raw info dictionary required for InfoHash calculation")
@@ -96,11 +126,14 @@ func NewTorrent(dic map[string]any, rawInfoDict []byte) (*Torrent, error) {
 	}
 	t.Name = name
 
-	pieceLength, ok := infoDict["piece length"].(int)
+	pieceLength, ok := infoDict["piece length"].(int64)
 	if !ok {
 		return nil, errors.New("piece length missing or not an integer")
 	}
-	t.PieceSize = pieceLength
+	if pieceLength <= 0 || pieceLength > math.MaxInt32 {
+		return nil, fmt.Errorf("piece length %d out of range", pieceLength)
+	}
+	t.PieceSize = int(pieceLength)
 
 	pieces, ok := infoDict["pieces"].(string)
 	if !ok {
@@ -119,7 +152,7 @@ func NewTorrent(dic map[string]any, rawInfoDict []byte) (*Torrent, error) {
 		t.PieceHashes[i] = hash
 	}
 
-	if private, ok := infoDict["private"].(int); ok {
+	if private, ok := infoDict["private"].(int64); ok {
 		t.IsPrivate = private == 1
 	}
 
@@ -132,10 +165,21 @@ func NewTorrent(dic map[string]any, rawInfoDict []byte) (*Torrent, error) {
 	}
 
 	t.initializeDownloadState()
+	t.Trackers = tracker.NewManager(t.TrackerTiers())
 
 	return t, nil
 }
 
+// isKnownTorrentKey reports whether a top level metainfo key is parsed into a
+// Torrent field.
+func isKnownTorrentKey(key string) bool {
+	switch key {
+	case "announce", "announce-list", "comment", "created by", "creation date", "encoding", "info":
+		return true
+	}
+	return false
+}
+
 func (t *Torrent) parseFiles(infoDict map[string]any) error {
 	if files, ok := infoDict["files"].([]any); ok {
 		t.Files = make([]FileItem, 0, len(files))
@@ -145,8 +189,8 @@ func (t *Torrent) parseFiles(infoDict map[string]any) error {
 				return errors.New("file entry is not a dictionary")
 			}
 
-			length, ok := fileDict["length"].(int)
-			if !ok {
+			length, ok := fileDict["length"].(int64)
+			if !ok || length < 0 {
 				return errors.New("file length missing or invalid")
 			}
 
@@ -169,7 +213,7 @@ func (t *Torrent) parseFiles(infoDict map[string]any) error {
 				Path: strings.Join(pathComponents, "/"),
 			})
 		}
-	} else if length, ok := infoDict["length"].(int); ok {
+	} else if length, ok := infoDict["length"].(int64); ok && length >= 0 {
 		t.Files = []FileItem{{
 			Size: length,
 			Path: t.Name,
@@ -227,10 +271,10 @@ func (t *Torrent) UrlSafeStringInfohash() string {
 	return url.QueryEscape(string(t.InfoHash[:]))
 }
 
-func (t *Torrent) TotalSize() int {
-	var size int
-	for _, file := range t.Files {
-		size += file.Size
+func (t *Torrent) TotalSize() int64 {
+	var size int64
+	for i := range t.Files {
+		size += t.Files[i].Size
 	}
 	return size
 }
@@ -249,7 +293,7 @@ func (t *Torrent) GetPieceSize(pieceIndex int) int {
 	}
 
 	if pieceIndex == t.PiecesCount()-1 {
-		remainder := t.TotalSize() % t.PieceSize
+		remainder := int(t.TotalSize() % int64(t.PieceSize))
 		if remainder != 0 {
 			return remainder
 		}
@@ -308,7 +352,7 @@ func (t *Torrent) IsStarted() bool {
 	return t.Downloaded > 0
 }
 
-func (t *Torrent) Left() int {
+func (t *Torrent) Left() int64 {
 	remaining := t.TotalSize() - t.Downloaded
 	if remaining < 0 {
 		return 0
@@ -316,6 +360,19 @@ func (t *Torrent) Left() int {
 	return remaining
 }
 
+// AnnounceRequest describes the torrent to a tracker.
+func (t *Torrent) AnnounceRequest(peerID PeerID, port int, ev tracker.TrackerEvent) tracker.AnnounceRequest {
+	return tracker.AnnounceRequest{
+		InfoHash:   t.InfoHash,
+		PeerID:     peerID,
+		Port:       port,
+		Uploaded:   t.Uploaded,
+		Downloaded: t.Downloaded,
+		Left:       t.Left(),
+		Event:      ev,
+	}
+}
+
 func (t *Torrent) FileDir() string {
 	if len(t.Files) > 1 {
 		return t.Name + "/"
@@ -357,31 +414,48 @@ func (t *Torrent) IsMultiFile() bool {
 	return len(t.Files) > 1
 }
 
+// TrackerTiers returns the tiers of trackers to announce to. When there is an
+// announce-list the announce url is ignored (BEP 12).
+func (t *Torrent) TrackerTiers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
+	}
+	if t.Announce == "" {
+		return nil
+	}
+	return [][]string{{t.Announce}}
+}
+
+// GetAllTrackers returns every tracker url once, tier by tier.
 func (t *Torrent) GetAllTrackers() []string {
-	trackers := []string{t.Announce}
+	var trackers []string
 
-	for _, tier := range t.AnnounceList {
-		trackers = append(trackers, tier...)
+	for _, tier := range t.TrackerTiers() {
+		for _, tr := range tier {
+			if tr != "" && !slices.Contains(trackers, tr) {
+				trackers = append(trackers, tr)
+			}
+		}
 	}
 
 	return trackers
 }
 
 func (t *Torrent) FormattedPieceSize() string {
-	return formatBytes(t.PieceSize)
+	return formatBytes(int64(t.PieceSize))
 }
 
 func (t *Torrent) FormattedTotalSize() string {
 	return formatBytes(t.TotalSize())
 }
 
-func formatBytes(bytes int) string {
+func formatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
 		return fmt.Sprintf("%d B", bytes)
 	}
 
-	div, exp := int(unit), 0
+	div, exp := int64(unit), 0
 	for n := bytes / unit; n >= unit; n /= unit {
 		div *= unit
 		exp++
@@ -424,19 +498,21 @@ func (t *Torrent) IsPieceComplete(pieceIndex int) bool {
 	return true
 }
 
-func (t *Torrent) AddDownloaded(bytes int) {
+func (t *Torrent) AddDownloaded(bytes int64) {
 	t.Downloaded += bytes
 }
 
-func (t *Torrent) AddUploaded(bytes int) {
+func (t *Torrent) AddUploaded(bytes int64) {
 	t.Uploaded += bytes
 }
 
 func (t *Torrent) ToBencodeMap() (map[string]any, error) {
 	top := make(map[string]any)
 
-	top["announce"] = t.Announce
-
+	// trackerless torrents (DHT only) have no announce key
+	if t.Announce != "" {
+		top["announce"] = t.Announce
+	}
 	if len(t.AnnounceList) > 0 {
 		al := make([]any, len(t.AnnounceList))
 		for i, tier := range t.AnnounceList {
@@ -461,6 +537,17 @@ func (t *Torrent) ToBencodeMap() (map[string]any, error) {
 		top["encoding"] = t.Encoding
 	}
 
+	for key, val := range t.Extra {
+		top[key] = val
+	}
+
+	// the raw info dictionary is what the InfoHash was computed from, so it
+	// wins over the parsed fields
+	if t.InfoRaw != nil {
+		top["info"] = bencode.RawMessage(t.InfoRaw)
+		return top, nil
+	}
+
 	info := make(map[string]any, 6)
 
 	info["name"] = t.Name
@@ -0,0 +1,38 @@
+package bittorrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrackerTiers(t *testing.T) {
+	torrent := &Torrent{Announce: "http://a/announce"}
+	if tiers := torrent.TrackerTiers(); !reflect.DeepEqual(tiers, [][]string{{"http://a/announce"}}) {
+		t.Errorf("expected the announce url alone, got %v", tiers)
+	}
+
+	// the announce url is ignored when there is an announce-list
+	torrent.AnnounceList = [][]string{{"http://b/announce", "http://a/announce"}, {"udp://c:80", "http://b/announce", ""}}
+	if tiers := torrent.TrackerTiers(); !reflect.DeepEqual(tiers, torrent.AnnounceList) {
+		t.Errorf("expected the announce-list, got %v", tiers)
+	}
+
+	expected := []string{"http://b/announce", "http://a/announce", "udp://c:80"}
+	if trackers := torrent.GetAllTrackers(); !reflect.DeepEqual(trackers, expected) {
+		t.Errorf("expected %v, got %v", expected, trackers)
+	}
+
+	if trackers := (&Torrent{}).GetAllTrackers(); len(trackers) != 0 {
+		t.Errorf("expected no trackers, got %v", trackers)
+	}
+}
+
+func TestNewPeerID(t *testing.T) {
+	a, b := NewPeerID(), NewPeerID()
+	if string(a[:8]) != clientPrefix {
+		t.Errorf("expected prefix %s, got %q", clientPrefix, a[:8])
+	}
+	if a == b {
+		t.Errorf("peer ids are not random")
+	}
+}
@@ -0,0 +1,170 @@
+package commandhandler
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+// binary strings longer than this are cut short when printed
+const maxPrintedBinary = 32
+
+// bencode runs one of the bencode inspection subcommands:
+//
+//	bencode show <file> [path]
+//	bencode get <file> <path>
+//	bencode json <file> [out.json] [--base64]
+//	bencode fromjson <file.json> <out>
+//	bencode lint <file>
+func (r *Handler) bencode(args []string) error {
+	binary := bencode.BinaryHex
+	if i := slices.Index(args, "--base64"); i != -1 {
+		binary = bencode.BinaryBase64
+		args = slices.Delete(args, i, i+1)
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: %s", commandHelp[Bencode].Usage)
+	}
+
+	sub, path := args[0], args[1]
+
+	switch sub {
+	case "show", "get":
+		v, err := decodeFile(path)
+		if err != nil {
+			return err
+		}
+		if len(args) > 2 {
+			v, err = bencode.Lookup(v, args[2])
+			if err != nil {
+				return err
+			}
+		} else if sub == "get" {
+			return errors.New("usage: bencode get <file> <path>")
+		}
+		printBencode(os.Stdout, v, 0)
+		return nil
+
+	case "json":
+		v, err := decodeFile(path)
+		if err != nil {
+			return err
+		}
+		j, err := bencode.ToJSON(v, binary)
+		if err != nil {
+			return err
+		}
+		if len(args) > 2 {
+			return os.WriteFile(args[2], append(j, '\n'), 0644)
+		}
+		fmt.Println(string(j))
+		return nil
+
+	case "fromjson":
+		if len(args) < 3 {
+			return errors.New("usage: bencode fromjson <file.json> <out>")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		v, err := bencode.FromJSON(data)
+		if err != nil {
+			return err
+		}
+		raw, err := bencoder.Encode(v)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(args[2], raw, 0644)
+
+	case "lint":
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := bencode.Validate(file); err != nil {
+			return err
+		}
+		fmt.Printf("%s is canonical bencode\n", path)
+		return nil
+	}
+
+	return fmt.Errorf("unknown bencode subcommand %q, expected show, get, json, fromjson or lint", sub)
+}
+
+func decodeFile(path string) (any, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return bencoder.DecodeReader(file)
+}
+
+// printBencode writes v as an indented tree, one value per line.
+func printBencode(w io.Writer, v any, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	switch val := v.(type) {
+	case map[string]any:
+		if len(val) == 0 {
+			fmt.Fprintln(w, "{}")
+			return
+		}
+		if depth > 0 {
+			fmt.Fprintln(w)
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s: ", indent, formatString(k))
+			printBencode(w, val[k], depth+1)
+		}
+	case []any:
+		if len(val) == 0 {
+			fmt.Fprintln(w, "[]")
+			return
+		}
+		if depth > 0 {
+			fmt.Fprintln(w)
+		}
+		for i, item := range val {
+			fmt.Fprintf(w, "%s[%d]: ", indent, i)
+			printBencode(w, item, depth+1)
+		}
+	case string:
+		fmt.Fprintln(w, formatString(val))
+	case int64, *big.Int:
+		fmt.Fprintln(w, val)
+	default:
+		fmt.Fprintf(w, "%v\n", val)
+	}
+}
+
+// formatString quotes text and shows binary data as a hex preview.
+func formatString(s string) string {
+	if utf8.ValidString(s) {
+		return fmt.Sprintf("%q", s)
+	}
+	if len(s) > maxPrintedBinary {
+		return fmt.Sprintf("<%d bytes> %s...", len(s), hex.EncodeToString([]byte(s[:maxPrintedBinary])))
+	}
+	return fmt.Sprintf("<%d bytes> %s", len(s), hex.EncodeToString([]byte(s)))
+}
@@ -7,11 +7,13 @@ import (
 	"io"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 
-	bt "github.com/dmsosa6/bittorrent-client/internal/bittorrent"
+	"github.com/dmsRosa6/bittorrent-client/internal/trackerserver"
+	bt "github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
 
-	session "github.com/dmsosa6/bittorrent-client/internal/session"
+	session "github.com/dmsRosa6/bittorrent-client/internal/session"
 )
 
 type Command int
@@ -23,13 +25,17 @@ type CommandHelp struct {
 
 var commandHelp = map[Command]CommandHelp{
 	Info: {
-		"Display information about a torrent",
-		"info <infohash|name>",
+		"Display information about a torrent and the swarm counts of its trackers",
+		"info [infohash|name]",
 	},
 	Announce: {
 		"Add a torrent from a .torrent file",
 		"announce /path/to/file.torrent",
 	},
+	Load: {
+		"Load a torrent from a .torrent file or a magnet link",
+		"load </path/to/file.torrent|magnet:?xt=urn:btih:...>",
+	},
 	List: {
 		"List all torrents",
 		"list",
@@ -42,6 +48,30 @@ var commandHelp = map[Command]CommandHelp{
 		"Show this help message",
 		"help",
 	},
+	Create: {
+		"Create a .torrent file from a file or directory",
+		"create <path> <out.torrent> [announce,...] [--private] [--comment=text] [--piece-size=KiB]",
+	},
+	Bencode: {
+		"Inspect and convert bencoded files",
+		"bencode show|json|fromjson|get|lint <file> [path|out] [--base64]",
+	},
+	Trackers: {
+		"Show the announce state of the trackers of a torrent",
+		"trackers [infohash|name]",
+	},
+	Reannounce: {
+		"Ask the trackers of a torrent for peers now",
+		"reannounce [infohash|name]",
+	},
+	Tracker: {
+		"Run a tracker in the background",
+		"tracker serve [--http=addr] [--udp=addr] [--whitelist=file] | tracker stop",
+	},
+	DHT: {
+		"Store and fetch small items in the DHT",
+		"dht put <value> [--key=file] [--salt=text] | dht get <target|public key> [--salt=text]",
+	},
 }
 
 const (
@@ -50,55 +80,45 @@ const (
 	Info
 	List
 	Load
+	Create
+	Bencode
+	DHT
+	Trackers
+	Reannounce
+	Tracker
 	Help
 	Exit
 )
 
 var commandArgs = map[Command][]int{
-	Unknown:  {0},
-	Announce: {1},
-	Info:     {1},
-	List:     {0},
-	Help:     {0, 1},
-	Exit:     {0},
-	Load:     {1},
+	Unknown:    {0},
+	Announce:   {1},
+	Info:       {0, 1},
+	List:       {0},
+	Help:       {0, 1},
+	Exit:       {0},
+	Load:       {1},
+	Create:     {2, 3, 4, 5, 6},
+	Bencode:    {2, 3, 4},
+	DHT:        {2, 3, 4},
+	Trackers:   {0, 1},
+	Reannounce: {0, 1},
+	Tracker:    {1, 2, 3, 4},
 }
 
 var commandLookup = map[string]Command{
-	"info":     Info,
-	"exit":     Exit,
-	"announce": Announce,
-	"help":     Help,
-	"list":     List,
-	"load":     Load,
-}
-
-type CommandHelp struct {
-	Description string
-	Usage       string
-}
-
-var commandHelp = map[Command]CommandHelp{
-	Info: {
-		"Display information about a torrent",
-		"info <infohash|name>",
-	},
-	Announce: {
-		"Add a torrent from a .torrent file",
-		"announce /path/to/file.torrent",
-	},
-	List: {
-		"List all torrents",
-		"list",
-	},
-	Exit: {
-		"Exit the client",
-		"exit",
-	},
-	Help: {
-		"Show this help message",
-		"help",
-	},
+	"info":       Info,
+	"exit":       Exit,
+	"announce":   Announce,
+	"help":       Help,
+	"list":       List,
+	"load":       Load,
+	"create":     Create,
+	"bencode":    Bencode,
+	"dht":        DHT,
+	"trackers":   Trackers,
+	"reannounce": Reannounce,
+	"tracker":    Tracker,
 }
 
 var bencoder = bt.BEncoding{}
@@ -115,6 +135,18 @@ func (c Command) String() string {
 		return "announce"
 	case Load:
 		return "load"
+	case Create:
+		return "create"
+	case Bencode:
+		return "bencode"
+	case DHT:
+		return "dht"
+	case Trackers:
+		return "trackers"
+	case Reannounce:
+		return "reannounce"
+	case Tracker:
+		return "tracker"
 	case Help:
 		return "help"
 	default:
@@ -124,6 +156,8 @@ func (c Command) String() string {
 
 type Handler struct {
 	CurrentTorrent *bt.Torrent
+
+	trackerServer *trackerserver.Server
 }
 
 func (r *Handler) ParseCommand(s string) Command {
@@ -135,7 +169,7 @@ func (r *Handler) ParseCommand(s string) Command {
 	return Unknown
 }
 
-func (r *Handler) ExecuteCommand(command Command, args []string, s session.Session) {
+func (r *Handler) ExecuteCommand(command Command, args []string, s *session.Session) {
 	var err error
 
 	switch command {
@@ -154,6 +188,24 @@ func (r *Handler) ExecuteCommand(command Command, args []string, s session.Sessi
 	case Load:
 		err = r.load(args, s)
 		break
+	case Create:
+		err = r.create(args, s)
+		break
+	case Bencode:
+		err = r.bencode(args)
+		break
+	case DHT:
+		err = r.dht(args, s.DHT)
+		break
+	case Trackers:
+		err = r.trackers(args, s)
+		break
+	case Reannounce:
+		err = r.reannounce(args, s)
+		break
+	case Tracker:
+		err = r.serveTracker(args)
+		break
 	default:
 		fmt.Println("Unkown command. type \"help\"")
 	}
@@ -183,39 +235,42 @@ func (r *Handler) help(args []string) error {
 	return nil
 }
 
-func (r *Handler) list(s session.Session) error {
-	if len(s.Torrents) == 0 {
+func (r *Handler) list(s *session.Session) error {
+	torrents := s.List()
+	if len(torrents) == 0 {
 		return errors.New("no torrents to show")
 	}
 
 	fmt.Println("List of torrents:")
 
-	for _, v := range s.Torrents {
+	for _, v := range torrents {
 		fmt.Printf(v.HexStringInfohash())
 	}
 
 	return nil
 }
 
-func (r *Handler) info(args []string, s session.Session) error {
-	key := args[0]
-
-	torrent, ok := s.Torrents[key]
-
-	if !ok {
-		return fmt.Errorf("no torrents with infohash: %s\n", key)
+func (r *Handler) info(args []string, s *session.Session) error {
+	torrent, err := selectTorrent(args, s)
+	if err != nil {
+		return err
 	}
 
 	fmt.Println(torrent.Details())
+	printScrape(torrent.GetAllTrackers(), torrent.InfoHash)
 
 	return nil
 }
 
-// for now this expects a .torrent file, in the future enforce this better or make it so u can create torrents
-func (r *Handler) load(args []string, s session.Session) error {
+// for now this expects a .torrent file or a magnet link, in the future enforce this better
+func (r *Handler) load(args []string, s *session.Session) error {
 
 	path := args[0]
 
+	if strings.HasPrefix(strings.ToLower(path), "magnet:") {
+		return r.loadMagnet(path, s)
+	}
+
 	buf, err := filePathToBytes(path)
 
 	if err != nil {
@@ -228,12 +283,98 @@ func (r *Handler) load(args []string, s session.Session) error {
 		return err
 	}
 
+	s.AddTorrentToSession(torrent)
+	s.SetCurrTorrent(torrent)
+
+	return nil
+}
+
+// a magnet only gives us the infohash and trackers, the info dictionary
+// still has to come from peers
+func (r *Handler) loadMagnet(uri string, s *session.Session) error {
+	magnet, err := bt.ParseMagnet(uri)
+	if err != nil {
+		return err
+	}
+
+	torrent, err := bt.NewTorrentFromMagnet(magnet)
+	if err != nil {
+		return err
+	}
+
+	s.AddTorrentToSession(torrent)
+	s.SetCurrTorrent(torrent)
+
+	return nil
+}
+
+func (r *Handler) create(args []string, s *session.Session) error {
+	opts := bt.BuilderOptions{}
+	var positional []string
+
+	for _, arg := range args {
+		switch {
+		case arg == "--private":
+			opts.IsPrivate = true
+		case strings.HasPrefix(arg, "--comment="):
+			opts.Comment = strings.TrimPrefix(arg, "--comment=")
+		case strings.HasPrefix(arg, "--piece-size="):
+			kib, err := strconv.Atoi(strings.TrimPrefix(arg, "--piece-size="))
+			if err != nil {
+				return fmt.Errorf("invalid piece size %q", arg)
+			}
+			opts.PieceSize = kib * 1024
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) < 2 || len(positional) > 3 {
+		return fmt.Errorf("usage: %s", commandHelp[Create].Usage)
+	}
+
+	path, out := positional[0], positional[1]
+
+	if len(positional) == 3 {
+		// every tracker gets its own tier, the first one is also the announce url
+		for _, url := range strings.Split(positional[2], ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				opts.AnnounceList = append(opts.AnnounceList, []string{url})
+			}
+		}
+		if len(opts.AnnounceList) > 0 {
+			opts.Announce = opts.AnnounceList[0][0]
+		}
+		if len(opts.AnnounceList) == 1 {
+			opts.AnnounceList = nil
+		}
+	}
+
+	opts.Progress = func(hashed, total int) {
+		fmt.Printf("\rhashing pieces: %d/%d", hashed, total)
+		if hashed == total {
+			fmt.Println()
+		}
+	}
+
+	torrent, err := bt.CreateTorrent(path, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := bencoder.EncodeTorrentFromFile(out, *torrent); err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s: %d pieces of %s, infohash %s\n", out, torrent.PiecesCount(), torrent.FormattedPieceSize(), torrent.HexStringInfohash())
+
+	s.AddTorrentToSession(torrent)
 	s.SetCurrTorrent(torrent)
 
 	return nil
 }
 
-func (r *Handler) announce(args []string, s session.Session) error {
+func (r *Handler) announce(args []string, s *session.Session) error {
 
 	return nil
 }
@@ -0,0 +1,146 @@
+package commandhandler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/dht"
+)
+
+const dhtCommandTimeout = 30 * time.Second
+
+// dht stores and fetches items in the DHT (BEP 44):
+//
+//	dht put <value>                                stores an immutable item
+//	dht put <value> --key=<file> [--salt=text]     stores a mutable item
+//	dht get <target>                               fetches an immutable item
+//	dht get <public key> [--salt=text]             fetches a mutable item
+//
+// The key file holds a hex ed25519 seed and is created when missing.
+func (r *Handler) dht(args []string, node *dht.Node) error {
+	if node == nil {
+		return errors.New("dht is not running")
+	}
+
+	var keyFile, salt string
+	var positional []string
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--key="):
+			keyFile = strings.TrimPrefix(arg, "--key=")
+		case strings.HasPrefix(arg, "--salt="):
+			salt = strings.TrimPrefix(arg, "--salt=")
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: %s", commandHelp[DHT].Usage)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtCommandTimeout)
+	defer cancel()
+
+	sub, arg := positional[0], positional[1]
+	switch sub {
+	case "put":
+		if keyFile == "" {
+			target, err := node.PutImmutable(ctx, arg)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("stored %s\n", target)
+			return nil
+		}
+
+		priv, err := loadOrCreateKey(keyFile)
+		if err != nil {
+			return err
+		}
+
+		// the next version follows whatever is stored now, and only
+		// replaces that one
+		seq, cas := int64(1), int64(dht.NoCAS)
+		current, err := node.GetMutable(ctx, priv.Public().(ed25519.PublicKey), []byte(salt))
+		if err == nil {
+			seq, cas = current.Seq+1, current.Seq
+		} else if !errors.Is(err, dht.ErrItemNotFound) {
+			return err
+		}
+
+		item, err := dht.NewMutableItem(priv, []byte(salt), seq, arg)
+		if err != nil {
+			return err
+		}
+		if err := node.PutMutable(ctx, item, cas); err != nil {
+			return err
+		}
+		fmt.Printf("stored %s seq %d\n", hex.EncodeToString(item.Key), item.Seq)
+		return nil
+
+	case "get":
+		key, err := hex.DecodeString(arg)
+		if err != nil {
+			return fmt.Errorf("invalid target %q", arg)
+		}
+
+		var raw bencode.RawMessage
+		switch len(key) {
+		case len(dht.NodeID{}):
+			raw, err = node.GetImmutable(ctx, dht.NodeID(key))
+		case ed25519.PublicKeySize:
+			var item *dht.MutableItem
+			item, err = node.GetMutable(ctx, key, []byte(salt))
+			if err == nil {
+				fmt.Printf("seq %d\n", item.Seq)
+				raw = item.V
+			}
+		default:
+			return fmt.Errorf("invalid target %q: want a 40 character hash or a 64 character public key", arg)
+		}
+		if err != nil {
+			return err
+		}
+
+		var v any
+		if err := bencode.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		printBencode(os.Stdout, v, 0)
+		return nil
+	}
+
+	return fmt.Errorf("usage: %s", commandHelp[DHT].Usage)
+}
+
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
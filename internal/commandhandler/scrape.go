@@ -0,0 +1,55 @@
+package commandhandler
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+const scrapeTimeout = 10 * time.Second
+
+// printScrape asks every tracker of a torrent for its swarm counts, all at
+// once so a dead tracker only costs the timeout.
+func printScrape(trackers []string, infoHash [20]byte) {
+	var addrs []string
+	for _, addr := range trackers {
+		if addr != "" && !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	lines := make([]string, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			results, err := tracker.NewTracker(addr).Scrape(ctx, [][20]byte{infoHash})
+			switch r, ok := results[infoHash]; {
+			case err != nil:
+				lines[i] = fmt.Sprintf("  %s: %v", addr, err)
+			case !ok:
+				lines[i] = fmt.Sprintf("  %s: torrent not known", addr)
+			default:
+				lines[i] = fmt.Sprintf("  %s: %d seeders, %d leechers, %d completed", addr, r.Seeders, r.Leechers, r.Completed)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Println("Trackers:")
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
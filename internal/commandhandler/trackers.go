@@ -0,0 +1,83 @@
+package commandhandler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bt "github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+
+	session "github.com/dmsRosa6/bittorrent-client/internal/session"
+)
+
+// trackers shows the announce state of every tracker of a torrent, tier by
+// tier in the order they are tried. Without arguments it is the current one.
+func (r *Handler) trackers(args []string, s *session.Session) error {
+	torrent, err := selectTorrent(args, s)
+	if err != nil {
+		return err
+	}
+	if torrent.Trackers == nil || torrent.Trackers.Len() == 0 {
+		return errors.New("torrent has no trackers")
+	}
+
+	now := time.Now()
+	if next, err := s.NextAnnounce(torrent); err == nil {
+		fmt.Printf("next announce in %s\n", next.Sub(now).Round(time.Second))
+	}
+	for _, state := range torrent.Trackers.Trackers() {
+		var status string
+		switch {
+		case state.LastAnnounce.IsZero():
+			status = "not contacted"
+		case state.Err != nil:
+			status = fmt.Sprintf("error %s ago: %v", now.Sub(state.LastAnnounce).Round(time.Second), state.Err)
+		default:
+			status = fmt.Sprintf("working, %d peers, %d seeders, %d leechers, next announce in %s",
+				state.Peers, state.Seeders, state.Leechers, state.NextAnnounce.Sub(now).Round(time.Second))
+			if state.Warning != "" {
+				status += ", warning: " + state.Warning
+			}
+		}
+		fmt.Printf("tier %d  %s  %s\n", state.Tier, state.Address, status)
+	}
+
+	return nil
+}
+
+// reannounce asks the trackers for peers without waiting for the interval,
+// though never before their min interval.
+func (r *Handler) reannounce(args []string, s *session.Session) error {
+	torrent, err := selectTorrent(args, s)
+	if err != nil {
+		return err
+	}
+	return s.Reannounce(torrent)
+}
+
+// selectTorrent returns the torrent named by the only argument, or the
+// current one without arguments.
+func selectTorrent(args []string, s *session.Session) (*bt.Torrent, error) {
+	if len(args) == 1 {
+		torrent := findTorrent(args[0], s)
+		if torrent == nil {
+			return nil, fmt.Errorf("no torrents with infohash or name: %s", args[0])
+		}
+		return torrent, nil
+	}
+	torrent := s.Current()
+	if torrent == nil {
+		return nil, errors.New("no torrent loaded")
+	}
+	return torrent, nil
+}
+
+func findTorrent(key string, s *session.Session) *bt.Torrent {
+	for _, t := range s.List() {
+		if strings.EqualFold(t.HexStringInfohash(), key) || t.Name == key {
+			return t
+		}
+	}
+	return nil
+}
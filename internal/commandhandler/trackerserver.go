@@ -0,0 +1,109 @@
+package commandhandler
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/trackerserver"
+)
+
+const defaultTrackerAddr = ":6969"
+
+// serveTracker runs a tracker next to the client:
+//
+//	tracker serve [--http=addr] [--udp=addr] [--whitelist=file]
+//	tracker stop
+//
+// Without addresses it serves both protocols on port 6969. The whitelist file
+// holds one hex infohash per line, blank lines and # comments are skipped.
+func (r *Handler) serveTracker(args []string) error {
+	switch args[0] {
+	case "serve":
+	case "stop":
+		if r.trackerServer == nil {
+			return errors.New("tracker is not running")
+		}
+		err := r.trackerServer.Close()
+		r.trackerServer = nil
+		return err
+	default:
+		return fmt.Errorf("usage: %s", commandHelp[Tracker].Usage)
+	}
+
+	if r.trackerServer != nil {
+		return errors.New("tracker is already running")
+	}
+
+	var cfg trackerserver.Config
+	for _, arg := range args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "--http="):
+			cfg.HTTPAddr = strings.TrimPrefix(arg, "--http=")
+		case strings.HasPrefix(arg, "--udp="):
+			cfg.UDPAddr = strings.TrimPrefix(arg, "--udp=")
+		case strings.HasPrefix(arg, "--whitelist="):
+			whitelist, err := loadWhitelist(strings.TrimPrefix(arg, "--whitelist="))
+			if err != nil {
+				return err
+			}
+			cfg.Whitelist = whitelist
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if cfg.HTTPAddr == "" && cfg.UDPAddr == "" {
+		cfg.HTTPAddr, cfg.UDPAddr = defaultTrackerAddr, defaultTrackerAddr
+	}
+
+	server := trackerserver.New(cfg)
+	if err := server.Start(); err != nil {
+		return err
+	}
+	r.trackerServer = server
+
+	if addr := server.HTTPAddr(); addr != nil {
+		fmt.Printf("tracker serving http://%s/announce\n", addr)
+	}
+	if addr := server.UDPAddr(); addr != nil {
+		fmt.Printf("tracker serving udp://%s\n", addr)
+	}
+	if len(cfg.Whitelist) > 0 {
+		fmt.Printf("only %d whitelisted torrents are tracked\n", len(cfg.Whitelist))
+	}
+
+	return nil
+}
+
+func loadWhitelist(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var whitelist [][20]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(text)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("%s:%d: not a hex infohash", path, line)
+		}
+		whitelist = append(whitelist, [20]byte(b))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(whitelist) == 0 {
+		return nil, fmt.Errorf("%s: no infohashes", path)
+	}
+
+	return whitelist, nil
+}
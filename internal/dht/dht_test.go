@@ -0,0 +1,328 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestNode(t *testing.T, bootstrap ...string) *Node {
+	return newTestNodeOn(t, "127.0.0.1:0", bootstrap...)
+}
+
+func newTestNodeOn(t *testing.T, addr string, bootstrap ...string) *Node {
+	if bootstrap == nil {
+		bootstrap = []string{}
+	}
+	n, err := New(Config{Addr: addr, BootstrapNodes: bootstrap, Timeout: time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// newNetwork starts count nodes on loopback that all bootstrapped from the
+// first one.
+func newNetwork(t *testing.T, count int) []*Node {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := newTestNode(t)
+	nodes := []*Node{first}
+	for i := 1; i < count; i++ {
+		n := newTestNode(t, first.Addr().String())
+		require.NoError(t, n.Bootstrap(ctx))
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// rawQuery sends a query from a plain UDP socket and returns the answer.
+func rawQuery(t *testing.T, to *Node, m *message) *message {
+	conn, err := net.DialUDP("udp", nil, to.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf, err := bencode.Marshal(m)
+	require.NoError(t, err)
+	_, err = conn.Write(buf)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, 2048)
+	size, err := conn.Read(reply)
+	require.NoError(t, err)
+
+	var resp message
+	require.NoError(t, bencode.Unmarshal(reply[:size], &resp))
+	return &resp
+}
+
+func Test_Table_OK(t *testing.T) {
+	self := NodeID{}
+	tb := newTable(self)
+
+	// ids with the top bit set all land in bucket 0
+	for i := 0; i < K+2; i++ {
+		id := NodeID{0x80, byte(i)}
+		tb.add(NodeInfo{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i}})
+	}
+	require.Equal(t, K, tb.len())
+
+	// a known id cannot move to another address
+	tb.add(NodeInfo{ID: NodeID{0x80, 0}, Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}})
+	require.Equal(t, "127.0.0.1:1000", tb.closest(NodeID{0x80, 0}, 1)[0].Addr.String())
+
+	// a bad node makes room for a new one
+	for i := 0; i < maxFailures; i++ {
+		tb.failed("127.0.0.1:1003")
+	}
+	require.Equal(t, K-1, tb.len())
+	tb.add(NodeInfo{ID: NodeID{0x80, 0x20}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}})
+	require.Equal(t, K, tb.len())
+
+	closest := tb.closest(NodeID{0x80, 5}, 3)
+	require.Len(t, closest, 3)
+	require.Equal(t, NodeID{0x80, 5}, closest[0].ID)
+	require.Equal(t, NodeID{0x80, 4}, closest[1].ID)
+	require.Equal(t, NodeID{0x80, 7}, closest[2].ID)
+}
+
+func Test_Token_OK(t *testing.T) {
+	m := newTokenManager()
+	ip := net.IPv4(10, 0, 0, 1)
+
+	token := m.token(ip)
+	require.True(t, m.valid(token, ip))
+	require.False(t, m.valid(token, net.IPv4(10, 0, 0, 2)))
+	require.False(t, m.valid("", ip))
+
+	// still good after one rotation, not after two
+	m.rotated = m.rotated.Add(-tokenRotation)
+	require.True(t, m.valid(token, ip))
+	m.rotated = m.rotated.Add(-tokenRotation)
+	require.False(t, m.valid(token, ip))
+
+	// however long nobody asked, both periods went by
+	token = m.token(ip)
+	m.rotated = m.rotated.Add(-2 * tokenRotation)
+	require.False(t, m.valid(token, ip))
+}
+
+func Test_CompactNodes_OK(t *testing.T) {
+	nodes := []NodeInfo{
+		{ID: NodeID{1}, Addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}},
+		{ID: NodeID{2}, Addr: &net.UDPAddr{IP: net.ParseIP("::1"), Port: 6881}},
+		{ID: NodeID{3}, Addr: &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 51413}},
+	}
+
+	buf := encodeNodes(nodes)
+	require.Len(t, buf, 2*compactNodeLen)
+
+	decoded := decodeNodes(buf)
+	require.Len(t, decoded, 2)
+	require.Equal(t, NodeID{1}, decoded[0].ID)
+	require.Equal(t, "1.2.3.4:6881", decoded[0].Addr.String())
+	require.Equal(t, "5.6.7.8:51413", decoded[1].Addr.String())
+
+	buf = encodeNodes6(nodes)
+	require.Len(t, buf, compactNode6Len)
+
+	decoded = decodeNodes6(buf)
+	require.Len(t, decoded, 1)
+	require.Equal(t, NodeID{2}, decoded[0].ID)
+	require.Equal(t, "[::1]:6881", decoded[0].Addr.String())
+
+	peer, ok := decodePeer(encodePeer(&net.TCPAddr{IP: net.IPv4(9, 9, 9, 9), Port: 80}))
+	require.True(t, ok)
+	require.Equal(t, "9.9.9.9:80", peer.String())
+
+	v6 := encodePeer(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80})
+	require.Len(t, v6, compactPeer6Len)
+	peer, ok = decodePeer(v6)
+	require.True(t, ok)
+	require.Equal(t, "[2001:db8::1]:80", peer.String())
+}
+
+func Test_Want_OK(t *testing.T) {
+	v4, v6 := net.IPv4(1, 2, 3, 4), net.ParseIP("2001:db8::1")
+
+	require.Equal(t, want{n4: true}, parseWant(nil, v4))
+	require.Equal(t, want{n6: true}, parseWant(nil, v6))
+	require.Equal(t, want{n4: true, n6: true}, parseWant([]string{"n4", "n6"}, v4))
+	require.Equal(t, want{n6: true}, parseWant([]string{"n6", "n8"}, v4))
+
+	require.Equal(t, want{n4: true, n6: true}, localFamily(net.IPv6unspecified))
+	require.Equal(t, want{n4: true}, localFamily(net.IPv4zero))
+	require.Equal(t, want{n6: true}, localFamily(net.IPv6loopback))
+}
+
+func Test_Bootstrap_Err(t *testing.T) {
+	n := newTestNode(t)
+	require.ErrorIs(t, n.Bootstrap(context.Background()), ErrNoNodes)
+}
+
+func Test_FindNode_OK(t *testing.T) {
+	nodes := newNetwork(t, 10)
+
+	for _, n := range nodes {
+		require.Greater(t, n.Len(), 0)
+	}
+
+	target := nodes[7].ID()
+	found, err := nodes[3].FindNode(context.Background(), target)
+	require.NoError(t, err)
+	require.NotEmpty(t, found)
+	require.Equal(t, target, found[0].ID)
+}
+
+func Test_AnnounceGetPeers_OK(t *testing.T) {
+	nodes := newNetwork(t, 10)
+	ctx := context.Background()
+	infoHash := NodeID{0xab, 0xcd}
+
+	count, err := nodes[2].Announce(ctx, infoHash, 6881)
+	require.NoError(t, err)
+	require.Greater(t, count, 0)
+
+	count, err = nodes[5].Announce(ctx, infoHash, 0)
+	require.NoError(t, err)
+	require.Greater(t, count, 0)
+
+	peers, err := nodes[8].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+
+	var addrs []string
+	for _, p := range peers {
+		addrs = append(addrs, p.String())
+	}
+	require.Contains(t, addrs, "127.0.0.1:6881")
+	require.Contains(t, addrs, nodes[5].Addr().String())
+}
+
+func Test_LookupPeers_OK(t *testing.T) {
+	nodes := newNetwork(t, 6)
+	ctx := context.Background()
+	infoHash := NodeID{0x12}
+
+	_, err := nodes[1].Announce(ctx, infoHash, 7000)
+	require.NoError(t, err)
+
+	updates := make(chan []net.Addr, 10)
+	require.NoError(t, nodes[4].LookupPeers(ctx, infoHash, 7001, updates))
+	close(updates)
+
+	var addrs []string
+	for batch := range updates {
+		for _, addr := range batch {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	require.Contains(t, addrs, "127.0.0.1:7000")
+
+	// the lookup announced us too
+	peers, err := nodes[0].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+
+	found := false
+	for _, p := range peers {
+		found = found || p.Port == 7001
+	}
+	require.True(t, found)
+}
+
+func Test_Query_Err(t *testing.T) {
+	n := newTestNode(t)
+	id := RandomNodeID()
+
+	resp := rawQuery(t, n, &message{T: "aa", Y: "q", Q: "vote", A: &queryArgs{ID: id}})
+	require.Equal(t, "e", resp.Y)
+	require.Equal(t, "aa", resp.T)
+	require.Equal(t, ErrCodeMethodUnknown, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ab", Y: "q", Q: "announce_peer", A: &queryArgs{
+		ID: id, InfoHash: make([]byte, 20), Port: 6881, Token: "nope",
+	}})
+	require.Equal(t, "e", resp.Y)
+	require.Equal(t, ErrCodeProtocol, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ac", Y: "q", Q: "find_node", A: &queryArgs{ID: id, Target: []byte("short")}})
+	require.Equal(t, "e", resp.Y)
+	require.Equal(t, ErrCodeProtocol, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ad", Y: "q", Q: "ping", A: &queryArgs{ID: id}})
+	require.Equal(t, "r", resp.Y)
+	require.Equal(t, n.ID(), resp.R.ID)
+}
+
+func Test_State_OK(t *testing.T) {
+	nodes := newNetwork(t, 5)
+	state := nodes[2].State()
+	require.Equal(t, nodes[2].ID().String(), state.ID)
+	require.NotEmpty(t, state.Nodes)
+
+	nodes[2].Close()
+
+	// no bootstrap nodes, the saved table is enough to join again
+	n, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}, State: state, Timeout: time.Second})
+	require.NoError(t, err)
+	defer n.Close()
+
+	require.Equal(t, nodes[2].ID(), n.ID())
+	require.Equal(t, len(state.Nodes), n.Len())
+	require.NoError(t, n.Bootstrap(context.Background()))
+
+	_, err = n.Ping(context.Background(), nodes[0].Addr())
+	require.NoError(t, err)
+}
+
+func Test_DualStack_OK(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	router := newTestNodeOn(t, "[::]:0")
+	port := strconv.Itoa(router.Addr().Port)
+
+	var nodes []*Node
+	for i := 0; i < 3; i++ {
+		v4 := newTestNodeOn(t, "127.0.0.1:0", "127.0.0.1:"+port)
+		v6 := newTestNodeOn(t, "[::1]:0", "[::1]:"+port)
+		dual := newTestNodeOn(t, "[::]:0", "127.0.0.1:"+port, "[::1]:"+port)
+		nodes = append(nodes, v4, v6, dual)
+	}
+	for _, n := range nodes {
+		require.NoError(t, n.Bootstrap(ctx))
+	}
+
+	v4, v6, dual := nodes[0], nodes[1], nodes[2]
+	require.Zero(t, v4.table6.len())
+	require.Zero(t, v6.table4.len())
+	require.NotZero(t, dual.table4.len())
+	require.NotZero(t, dual.table6.len())
+
+	// a dual-stack node gets nodes6 when it asks for them over IPv4
+	resp := rawQuery(t, router, &message{T: "aa", Y: "q", Q: "find_node", A: &queryArgs{
+		ID: RandomNodeID(), Target: make([]byte, 20), Want: []string{"n4", "n6"},
+	}})
+	require.NotEmpty(t, resp.R.Nodes)
+	require.NotEmpty(t, resp.R.Nodes6)
+
+	infoHash := NodeID{0x66}
+	count, err := v6.Announce(ctx, infoHash, 7000)
+	require.NoError(t, err)
+	require.Greater(t, count, 0)
+
+	peers, err := nodes[5].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, "[::1]:7000", peers[0].String())
+
+	// IPv4 only nodes do not get IPv6 values they could not use
+	peers, err = v4.GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
@@ -0,0 +1,201 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// NodeID identifies a node. It lives in the same 160 bit space as info
+// hashes, so the nodes closest to an info hash are the ones that track it.
+type NodeID [20]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// commonPrefixLen is the number of leading bits a and b share.
+func commonPrefixLen(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// closer reports whether a is closer to target than b by the XOR metric.
+func closer(target, a, b NodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func sortByDistance(nodes []NodeInfo, target NodeID) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+}
+
+func toNodeID(b []byte) (NodeID, bool) {
+	var id NodeID
+	if len(b) != len(id) {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// NodeInfo is a node we can send queries to.
+type NodeInfo struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+const (
+	compactNodeLen  = 26 // id, ipv4, port
+	compactNode6Len = 38 // id, ipv6, port
+	compactPeerLen  = 6  // ipv4, port
+	compactPeer6Len = 18 // ipv6, port
+)
+
+// want is the address families a query asks nodes and values for (BEP 32).
+type want struct {
+	n4, n6 bool
+}
+
+// parseWant reads the want argument of a query. Without one, the requester
+// gets the family it asked from.
+func parseWant(values []string, from net.IP) want {
+	if len(values) == 0 {
+		return want{n4: from.To4() != nil, n6: from.To4() == nil}
+	}
+
+	var w want
+	for _, v := range values {
+		switch v {
+		case "n4":
+			w.n4 = true
+		case "n6":
+			w.n6 = true
+		}
+	}
+	return w
+}
+
+func (w want) has(ip net.IP) bool {
+	if ip.To4() != nil {
+		return w.n4
+	}
+	return w.n6
+}
+
+func (w want) values() []string {
+	var values []string
+	if w.n4 {
+		values = append(values, "n4")
+	}
+	if w.n6 {
+		values = append(values, "n6")
+	}
+	return values
+}
+
+// encodeNodes writes the compact node info of the IPv4 nodes.
+func encodeNodes(nodes []NodeInfo) []byte {
+	return appendNodes(nil, nodes, net.IPv4len)
+}
+
+// encodeNodes6 writes the compact node info of the IPv6 nodes.
+func encodeNodes6(nodes []NodeInfo) []byte {
+	return appendNodes(nil, nodes, net.IPv6len)
+}
+
+func appendNodes(buf []byte, nodes []NodeInfo, ipLen int) []byte {
+	for _, n := range nodes {
+		ip := compactIP(n.Addr.IP, ipLen)
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return buf
+}
+
+// compactIP returns ip in ipLen bytes, or nil if it is of the other family.
+func compactIP(ip net.IP, ipLen int) net.IP {
+	ip4 := ip.To4()
+	if ipLen == net.IPv4len {
+		return ip4
+	}
+	if ip4 != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+// decodeNodes reads IPv4 compact node info, skipping entries with port 0.
+func decodeNodes(buf []byte) []NodeInfo {
+	return decodeCompactNodes(buf, net.IPv4len)
+}
+
+// decodeNodes6 reads IPv6 compact node info, skipping entries with port 0.
+func decodeNodes6(buf []byte) []NodeInfo {
+	return decodeCompactNodes(buf, net.IPv6len)
+}
+
+func decodeCompactNodes(buf []byte, ipLen int) []NodeInfo {
+	size := len(NodeID{}) + ipLen + 2
+	nodes := make([]NodeInfo, 0, len(buf)/size)
+	for i := 0; i+size <= len(buf); i += size {
+		var id NodeID
+		copy(id[:], buf[i:i+20])
+		ip := net.IP(bytes.Clone(buf[i+20 : i+20+ipLen]))
+		port := int(binary.BigEndian.Uint16(buf[i+20+ipLen : i+size]))
+		if port == 0 {
+			continue
+		}
+		nodes = append(nodes, NodeInfo{ID: id, Addr: &net.UDPAddr{IP: ip, Port: port}})
+	}
+	return nodes
+}
+
+// encodePeer writes a peer in 6 bytes for IPv4 and 18 for IPv6.
+func encodePeer(addr *net.TCPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return nil
+	}
+	return binary.BigEndian.AppendUint16(bytes.Clone(ip), uint16(addr.Port))
+}
+
+func decodePeer(buf []byte) (*net.TCPAddr, bool) {
+	if len(buf) != compactPeerLen && len(buf) != compactPeer6Len {
+		return nil, false
+	}
+	ipLen := len(buf) - 2
+	port := int(binary.BigEndian.Uint16(buf[ipLen:]))
+	if port == 0 {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: net.IP(bytes.Clone(buf[:ipLen])), Port: port}, true
+}
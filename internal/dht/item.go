@@ -0,0 +1,383 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+// BEP 44 error codes
+const (
+	ErrCodeMessageTooBig = 205
+	ErrCodeInvalidSig    = 206
+	ErrCodeSaltTooBig    = 207
+	ErrCodeCASMismatch   = 301
+	ErrCodeSeqTooLow     = 302
+)
+
+const (
+	// MaxItemSize is the largest bencoded value an item can hold
+	MaxItemSize = 1000
+	// MaxSaltSize is the longest salt of a mutable item
+	MaxSaltSize = 64
+
+	// items are dropped after this long unless they are put again
+	itemTTL  = 2 * time.Hour
+	maxItems = 1000
+)
+
+// NoCAS is passed to PutMutable to store an item whatever the current
+// sequence number is.
+const NoCAS = -1
+
+var (
+	ErrItemTooBig    = errors.New("dht: item value too big")
+	ErrSaltTooBig    = errors.New("dht: item salt too big")
+	ErrInvalidSig    = errors.New("dht: invalid item signature")
+	ErrItemNotFound  = errors.New("dht: item not found")
+	ErrItemNotStored = errors.New("dht: no node stored the item")
+)
+
+// MutableItem is a value signed by the owner of an ed25519 key (BEP 44).
+// Each new version has a higher Seq. Items of the same key with different
+// salts are stored apart.
+type MutableItem struct {
+	Key  ed25519.PublicKey
+	Salt []byte
+	Seq  int64
+	V    bencode.RawMessage
+	Sig  []byte
+}
+
+// NewMutableItem encodes v and signs it with priv.
+func NewMutableItem(priv ed25519.PrivateKey, salt []byte, seq int64, v any) (*MutableItem, error) {
+	raw, err := encodeItemValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) > MaxSaltSize {
+		return nil, ErrSaltTooBig
+	}
+
+	item := &MutableItem{
+		Key:  priv.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+		V:    raw,
+	}
+	item.Sig = ed25519.Sign(priv, signedBuffer(salt, seq, raw))
+	return item, nil
+}
+
+// Target is where the item is stored, the SHA-1 of the key and salt.
+func (it *MutableItem) Target() NodeID {
+	return MutableTarget(it.Key, it.Salt)
+}
+
+func (it *MutableItem) Verify() error {
+	if len(it.Key) != ed25519.PublicKeySize || len(it.Sig) != ed25519.SignatureSize {
+		return ErrInvalidSig
+	}
+	if !ed25519.Verify(it.Key, signedBuffer(it.Salt, it.Seq, it.V), it.Sig) {
+		return ErrInvalidSig
+	}
+	return nil
+}
+
+func MutableTarget(key ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(bytes.Clone(key), salt...))
+}
+
+// ImmutableTarget is where an immutable value is stored, the SHA-1 of its
+// encoding.
+func ImmutableTarget(raw bencode.RawMessage) NodeID {
+	return sha1.Sum(raw)
+}
+
+// signedBuffer is what the signature of a mutable item covers, the salt, seq
+// and v entries of a bencoded dictionary without the enclosing d and e.
+func signedBuffer(salt []byte, seq int64, v []byte) []byte {
+	var buf []byte
+	if len(salt) > 0 {
+		buf = append(buf, "4:salt"...)
+		buf = strconv.AppendInt(buf, int64(len(salt)), 10)
+		buf = append(buf, ':')
+		buf = append(buf, salt...)
+	}
+	buf = append(buf, "3:seqi"...)
+	buf = strconv.AppendInt(buf, seq, 10)
+	buf = append(buf, "e1:v"...)
+	return append(buf, v...)
+}
+
+func encodeItemValue(v any) (bencode.RawMessage, error) {
+	raw, ok := v.(bencode.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = bencode.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	if len(raw) > MaxItemSize {
+		return nil, ErrItemTooBig
+	}
+	return raw, nil
+}
+
+// storedItem is an item put to us. Immutable items have no key.
+type storedItem struct {
+	key     []byte
+	salt    []byte
+	seq     int64
+	v       bencode.RawMessage
+	sig     []byte
+	expires time.Time
+}
+
+type itemStore struct {
+	mu    sync.Mutex
+	items map[NodeID]*storedItem
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[NodeID]*storedItem)}
+}
+
+func (s *itemStore) get(target NodeID) *storedItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[target]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(item.expires) {
+		delete(s.items, target)
+		return nil
+	}
+	return item
+}
+
+// put stores item under target. A mutable item replaces the stored one only
+// if its seq is higher, and cas, when not nil, must be the stored seq.
+func (s *itemStore) put(target NodeID, item *storedItem, cas *int64) *Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	item.expires = now.Add(itemTTL)
+
+	old, ok := s.items[target]
+	if ok && now.After(old.expires) {
+		ok = false
+	}
+	if ok && item.key != nil {
+		if cas != nil && *cas != old.seq {
+			return &Error{Code: ErrCodeCASMismatch, Message: "cas mismatch"}
+		}
+		if item.seq < old.seq || item.seq == old.seq && !bytes.Equal(item.v, old.v) {
+			return &Error{Code: ErrCodeSeqTooLow, Message: "sequence number less than current"}
+		}
+	}
+
+	if !ok && len(s.items) >= maxItems {
+		for t, stored := range s.items {
+			if now.After(stored.expires) {
+				delete(s.items, t)
+			}
+		}
+		if len(s.items) >= maxItems {
+			return &Error{Code: ErrCodeServer, Message: "storage full"}
+		}
+	}
+
+	s.items[target] = item
+	return nil
+}
+
+// handleGet fills r with the item stored under target. A mutable item is
+// left out when the requester already has seq or a later one.
+func (n *Node) handleGet(r *responseValues, target NodeID, seq *int64) {
+	item := n.items.get(target)
+	if item == nil {
+		return
+	}
+	if item.key != nil {
+		if seq != nil && *seq >= item.seq {
+			r.Seq = &item.seq
+			return
+		}
+		r.K = item.key
+		r.Sig = item.sig
+		r.Seq = &item.seq
+	}
+	r.V = item.v
+}
+
+// handlePut checks and stores an item put by another node.
+func (n *Node) handlePut(a *queryArgs) *Error {
+	if len(a.V) == 0 {
+		return &Error{Code: ErrCodeProtocol, Message: "missing v"}
+	}
+	if len(a.V) > MaxItemSize {
+		return &Error{Code: ErrCodeMessageTooBig, Message: "message too big"}
+	}
+
+	if a.K == nil {
+		return n.items.put(ImmutableTarget(a.V), &storedItem{v: a.V}, nil)
+	}
+
+	if len(a.Salt) > MaxSaltSize {
+		return &Error{Code: ErrCodeSaltTooBig, Message: "salt too big"}
+	}
+	if a.Seq == nil {
+		return &Error{Code: ErrCodeProtocol, Message: "missing seq"}
+	}
+
+	item := &MutableItem{Key: a.K, Salt: a.Salt, Seq: *a.Seq, V: a.V, Sig: a.Sig}
+	if item.Verify() != nil {
+		return &Error{Code: ErrCodeInvalidSig, Message: "invalid signature"}
+	}
+
+	return n.items.put(item.Target(), &storedItem{
+		key:  item.Key,
+		salt: item.Salt,
+		seq:  item.Seq,
+		v:    item.V,
+		sig:  item.Sig,
+	}, a.CAS)
+}
+
+// GetImmutable looks up the value stored under target.
+func (n *Node) GetImmutable(ctx context.Context, target NodeID) (bencode.RawMessage, error) {
+	var value bencode.RawMessage
+	_, err := n.lookup(ctx, target, "get", queryArgs{Target: target[:]}, func(_ NodeInfo, r *responseValues) {
+		if value == nil && len(r.V) > 0 && ImmutableTarget(r.V) == target {
+			value = r.V
+		}
+	})
+	if value != nil {
+		return value, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrItemNotFound
+}
+
+// GetMutable looks up the latest version of the item of key and salt.
+func (n *Node) GetMutable(ctx context.Context, key ed25519.PublicKey, salt []byte) (*MutableItem, error) {
+	item, _, err := n.getMutable(ctx, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrItemNotFound
+	}
+	return item, nil
+}
+
+func (n *Node) getMutable(ctx context.Context, key ed25519.PublicKey, salt []byte) (*MutableItem, []lookupResult, error) {
+	target := MutableTarget(key, salt)
+
+	var latest *MutableItem
+	results, err := n.lookup(ctx, target, "get", queryArgs{Target: target[:]}, func(_ NodeInfo, r *responseValues) {
+		if r.Seq == nil || len(r.V) == 0 || !bytes.Equal(r.K, key) {
+			return
+		}
+		item := &MutableItem{Key: key, Salt: salt, Seq: *r.Seq, V: r.V, Sig: r.Sig}
+		if item.Verify() != nil {
+			return
+		}
+		if latest == nil || item.Seq > latest.Seq {
+			latest = item
+		}
+	})
+	return latest, results, err
+}
+
+// PutImmutable stores v on the nodes closest to its target and returns the
+// target.
+func (n *Node) PutImmutable(ctx context.Context, v any) (NodeID, error) {
+	raw, err := encodeItemValue(v)
+	if err != nil {
+		return NodeID{}, err
+	}
+	target := ImmutableTarget(raw)
+
+	results, err := n.lookup(ctx, target, "get", queryArgs{Target: target[:]}, nil)
+	if err != nil {
+		return NodeID{}, err
+	}
+	return target, n.put(ctx, results, queryArgs{V: raw})
+}
+
+// PutMutable stores item on the nodes closest to its target. Unless cas is
+// NoCAS, nodes only take it if the seq they have is cas.
+func (n *Node) PutMutable(ctx context.Context, item *MutableItem, cas int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	if len(item.V) > MaxItemSize {
+		return ErrItemTooBig
+	}
+	if len(item.Salt) > MaxSaltSize {
+		return ErrSaltTooBig
+	}
+
+	target := item.Target()
+	results, err := n.lookup(ctx, target, "get", queryArgs{Target: target[:]}, nil)
+	if err != nil {
+		return err
+	}
+
+	seq := item.Seq
+	a := queryArgs{K: item.Key, Salt: item.Salt, Seq: &seq, V: item.V, Sig: item.Sig}
+	if cas != NoCAS {
+		a.CAS = &cas
+	}
+	return n.put(ctx, results, a)
+}
+
+// put sends a put to every node in results that gave us a token. It fails
+// only if none of them took it, with the last error one returned.
+func (n *Node) put(ctx context.Context, results []lookupResult, a queryArgs) error {
+	var wg sync.WaitGroup
+	var stored atomic.Int32
+	var mu sync.Mutex
+	var lastErr error = ErrItemNotStored
+
+	for _, r := range results {
+		if r.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(r lookupResult) {
+			defer wg.Done()
+
+			a := a
+			a.Token = r.token
+			if _, err := n.query(ctx, r.Addr, "put", a); err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			stored.Add(1)
+		}(r)
+	}
+	wg.Wait()
+
+	if stored.Load() == 0 {
+		return lastErr
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// test vectors from BEP 44
+func Test_MutableItem_Vectors_OK(t *testing.T) {
+	key := ed25519.PublicKey(mustHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+
+	item := &MutableItem{
+		Key: key,
+		Seq: 1,
+		V:   bencode.RawMessage("12:Hello World!"),
+		Sig: mustHex(t, "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01"),
+	}
+	require.Equal(t, "3:seqi1e1:v12:Hello World!", string(signedBuffer(item.Salt, item.Seq, item.V)))
+	require.NoError(t, item.Verify())
+	require.Equal(t, "4a533d47ec9c7d95b1ad75f576cffc641853b750", item.Target().String())
+
+	item.Salt = []byte("foobar")
+	item.Sig = mustHex(t, "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08")
+	require.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(signedBuffer(item.Salt, item.Seq, item.V)))
+	require.NoError(t, item.Verify())
+	require.Equal(t, "411eba73b6f087ca51a3795d9c8c938d365e32c1", item.Target().String())
+
+	item.Seq = 2
+	require.ErrorIs(t, item.Verify(), ErrInvalidSig)
+
+	require.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", ImmutableTarget(bencode.RawMessage("12:Hello World!")).String())
+}
+
+func Test_ItemStore_Err(t *testing.T) {
+	s := newItemStore()
+	key := []byte("key")
+	target := NodeID{1}
+
+	require.Nil(t, s.put(target, &storedItem{key: key, seq: 5, v: []byte("1:a")}, nil))
+
+	err := s.put(target, &storedItem{key: key, seq: 4, v: []byte("1:b")}, nil)
+	require.Equal(t, ErrCodeSeqTooLow, err.Code)
+
+	err = s.put(target, &storedItem{key: key, seq: 5, v: []byte("1:b")}, nil)
+	require.Equal(t, ErrCodeSeqTooLow, err.Code)
+
+	cas := int64(4)
+	err = s.put(target, &storedItem{key: key, seq: 6, v: []byte("1:b")}, &cas)
+	require.Equal(t, ErrCodeCASMismatch, err.Code)
+
+	cas = 5
+	require.Nil(t, s.put(target, &storedItem{key: key, seq: 6, v: []byte("1:b")}, &cas))
+	require.Equal(t, int64(6), s.get(target).seq)
+}
+
+func Test_Immutable_OK(t *testing.T) {
+	nodes := newNetwork(t, 8)
+	ctx := context.Background()
+
+	target, err := nodes[1].PutImmutable(ctx, "latest: v1.2.0")
+	require.NoError(t, err)
+	require.Equal(t, ImmutableTarget(bencode.RawMessage("14:latest: v1.2.0")), target)
+
+	v, err := nodes[6].GetImmutable(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, bencode.RawMessage("14:latest: v1.2.0"), v)
+
+	_, err = nodes[6].GetImmutable(ctx, NodeID{0xee})
+	require.ErrorIs(t, err, ErrItemNotFound)
+
+	_, err = nodes[1].PutImmutable(ctx, string(make([]byte, MaxItemSize)))
+	require.ErrorIs(t, err, ErrItemTooBig)
+}
+
+func Test_Mutable_OK(t *testing.T) {
+	nodes := newNetwork(t, 8)
+	ctx := context.Background()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	salt := []byte("release")
+
+	item, err := NewMutableItem(priv, salt, 1, "v1.0.0")
+	require.NoError(t, err)
+	require.NoError(t, nodes[2].PutMutable(ctx, item, NoCAS))
+
+	got, err := nodes[5].GetMutable(ctx, pub, salt)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), got.Seq)
+	require.Equal(t, bencode.RawMessage("6:v1.0.0"), got.V)
+
+	// other salts are other items
+	_, err = nodes[5].GetMutable(ctx, pub, nil)
+	require.ErrorIs(t, err, ErrItemNotFound)
+
+	item, err = NewMutableItem(priv, salt, 2, "v1.1.0")
+	require.NoError(t, err)
+	require.NoError(t, nodes[3].PutMutable(ctx, item, 1))
+
+	got, err = nodes[7].GetMutable(ctx, pub, salt)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), got.Seq)
+	require.Equal(t, bencode.RawMessage("6:v1.1.0"), got.V)
+
+	// nodes that have never seen the item take an older one, but the
+	// latest version still wins
+	old, err := NewMutableItem(priv, salt, 1, "v0.9.0")
+	require.NoError(t, err)
+	nodes[4].PutMutable(ctx, old, NoCAS)
+
+	got, err = nodes[0].GetMutable(ctx, pub, salt)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), got.Seq)
+
+	// a node holding the item refuses an older one and a stale cas
+	var holder *Node
+	for _, n := range nodes {
+		if stored := n.items.get(item.Target()); stored != nil && stored.seq == 2 {
+			holder = n
+		}
+	}
+	require.NotNil(t, holder)
+
+	target := item.Target()
+	r, err := nodes[4].query(ctx, holder.Addr(), "get", queryArgs{Target: target[:]})
+	require.NoError(t, err)
+
+	seq, cas := old.Seq, int64(1)
+	_, err = nodes[4].query(ctx, holder.Addr(), "put", queryArgs{
+		Token: r.Token, K: old.Key, Salt: salt, Seq: &seq, V: old.V, Sig: old.Sig,
+	})
+	var remote *Error
+	require.ErrorAs(t, err, &remote)
+	require.Equal(t, ErrCodeSeqTooLow, remote.Code)
+
+	item, err = NewMutableItem(priv, salt, 3, "v1.2.0")
+	require.NoError(t, err)
+	seq = item.Seq
+	_, err = nodes[4].query(ctx, holder.Addr(), "put", queryArgs{
+		Token: r.Token, K: item.Key, Salt: salt, Seq: &seq, CAS: &cas, V: item.V, Sig: item.Sig,
+	})
+	require.ErrorAs(t, err, &remote)
+	require.Equal(t, ErrCodeCASMismatch, remote.Code)
+}
+
+func Test_Put_Err(t *testing.T) {
+	n := newTestNode(t)
+	id := RandomNodeID()
+
+	// the token comes from a get
+	resp := rawQuery(t, n, &message{T: "aa", Y: "q", Q: "get", A: &queryArgs{ID: id, Target: make([]byte, 20)}})
+	require.Equal(t, "r", resp.Y)
+	token := resp.R.Token
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	item, err := NewMutableItem(priv, nil, 1, "value")
+	require.NoError(t, err)
+	seq := int64(2)
+
+	resp = rawQuery(t, n, &message{T: "ab", Y: "q", Q: "put", A: &queryArgs{
+		ID: id, Token: token, K: pub, Seq: &seq, V: item.V, Sig: item.Sig,
+	}})
+	require.Equal(t, "e", resp.Y)
+	require.Equal(t, ErrCodeInvalidSig, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ac", Y: "q", Q: "put", A: &queryArgs{
+		ID: id, Token: token, K: pub, Salt: make([]byte, MaxSaltSize+1), Seq: &seq, V: item.V, Sig: item.Sig,
+	}})
+	require.Equal(t, ErrCodeSaltTooBig, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ad", Y: "q", Q: "put", A: &queryArgs{
+		ID: id, Token: token, V: bencode.RawMessage("1001:" + string(make([]byte, 1001))),
+	}})
+	require.Equal(t, ErrCodeMessageTooBig, parseError(resp.E).Code)
+
+	resp = rawQuery(t, n, &message{T: "ae", Y: "q", Q: "put", A: &queryArgs{
+		ID: id, Token: "nope", V: item.V,
+	}})
+	require.Equal(t, ErrCodeProtocol, parseError(resp.E).Code)
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+// KRPC error codes (BEP 5)
+const (
+	ErrCodeGeneric       = 201
+	ErrCodeServer        = 202
+	ErrCodeProtocol      = 203
+	ErrCodeMethodUnknown = 204
+)
+
+// version sent as v in every message
+const clientVersion = "BC\x00\x01"
+
+// message is a KRPC message. y is q for queries, r for responses and e for
+// errors.
+type message struct {
+	T string          `bencode:"t"`
+	Y string          `bencode:"y"`
+	Q string          `bencode:"q,omitempty"`
+	A *queryArgs      `bencode:"a,omitempty"`
+	R *responseValues `bencode:"r,omitempty"`
+	E []any           `bencode:"e,omitempty"`
+	V string          `bencode:"v,omitempty"`
+}
+
+type queryArgs struct {
+	ID          NodeID   `bencode:"id"`
+	Target      []byte   `bencode:"target,omitempty"`
+	InfoHash    []byte   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"`
+
+	// get and put of items (BEP 44)
+	V    bencode.RawMessage `bencode:"v,omitempty"`
+	K    []byte             `bencode:"k,omitempty"`
+	Salt []byte             `bencode:"salt,omitempty"`
+	Seq  *int64             `bencode:"seq,omitempty"`
+	CAS  *int64             `bencode:"cas,omitempty"`
+	Sig  []byte             `bencode:"sig,omitempty"`
+}
+
+type responseValues struct {
+	ID     NodeID   `bencode:"id"`
+	Nodes  []byte   `bencode:"nodes,omitempty"`
+	Nodes6 []byte   `bencode:"nodes6,omitempty"`
+	Values [][]byte `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+
+	V   bencode.RawMessage `bencode:"v,omitempty"`
+	K   []byte             `bencode:"k,omitempty"`
+	Seq *int64             `bencode:"seq,omitempty"`
+	Sig []byte             `bencode:"sig,omitempty"`
+}
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht: remote error %d: %s", e.Code, e.Message)
+}
+
+func parseError(e []any) *Error {
+	err := &Error{Code: ErrCodeGeneric}
+	if len(e) > 0 {
+		if code, ok := e[0].(int64); ok {
+			err.Code = int(code)
+		}
+	}
+	if len(e) > 1 {
+		if msg, ok := e[1].(string); ok {
+			err.Message = msg
+		}
+	}
+	return err
+}
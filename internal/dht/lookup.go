@@ -0,0 +1,267 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// lookupResult is a node that answered during a lookup.
+type lookupResult struct {
+	NodeInfo
+	token string
+}
+
+// lookup runs a lookup over each family we are on and returns the K closest
+// nodes that answered in each. onResponse is called for every answer, from
+// one goroutine at a time.
+func (n *Node) lookup(ctx context.Context, target NodeID, method string, a queryArgs, onResponse func(NodeInfo, *responseValues)) ([]lookupResult, error) {
+	// dual-stack nodes ask for both families so either lookup can find
+	// values of the other
+	if n.family.n4 && n.family.n6 {
+		a.Want = n.family.values()
+	}
+
+	var mu sync.Mutex
+	if onResponse != nil {
+		f := onResponse
+		onResponse = func(info NodeInfo, r *responseValues) {
+			mu.Lock()
+			defer mu.Unlock()
+			f(info, r)
+		}
+	}
+
+	var tables []*table
+	if n.family.n4 {
+		tables = append(tables, n.table4)
+	}
+	if n.family.n6 {
+		tables = append(tables, n.table6)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]lookupResult, len(tables))
+	errs := make([]error, len(tables))
+	for i, t := range tables {
+		wg.Add(1)
+		go func(i int, t *table) {
+			defer wg.Done()
+			results[i], errs[i] = n.lookupTable(ctx, t, target, method, a, onResponse)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var all []lookupResult
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	if len(all) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return all, nil
+}
+
+// lookupTable walks towards target over the nodes of one table, asking alpha
+// nodes at a time until none of the K closest nodes seen are left to ask. It
+// returns the K closest nodes that answered.
+func (n *Node) lookupTable(ctx context.Context, t *table, target NodeID, method string, a queryArgs, onResponse func(NodeInfo, *responseValues)) ([]lookupResult, error) {
+	candidates := t.closest(target, K)
+	if len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
+	decode := decodeNodes
+	if t == n.table6 {
+		decode = decodeNodes6
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		seen[c.Addr.String()] = true
+	}
+	queried := make(map[string]bool)
+	var answered []lookupResult
+
+	for {
+		var batch []NodeInfo
+		for _, c := range candidates[:min(K, len(candidates))] {
+			if len(batch) == alpha {
+				break
+			}
+			if !queried[c.Addr.String()] {
+				queried[c.Addr.String()] = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c NodeInfo) {
+				defer wg.Done()
+
+				r, err := n.query(ctx, c.Addr, method, a)
+				if err != nil {
+					return
+				}
+				// the node may not be who we were told it is
+				c.ID = r.ID
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				answered = append(answered, lookupResult{NodeInfo: c, token: r.Token})
+				nodes := r.Nodes
+				if t == n.table6 {
+					nodes = r.Nodes6
+				}
+				for _, found := range decode(nodes) {
+					key := found.Addr.String()
+					if found.ID == n.id || seen[key] {
+						continue
+					}
+					seen[key] = true
+					candidates = append(candidates, found)
+				}
+				if onResponse != nil {
+					onResponse(c, r)
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sortByDistance(candidates, target)
+	}
+
+	results := make([]NodeInfo, len(answered))
+	byID := make(map[NodeID]lookupResult, len(answered))
+	for i, r := range answered {
+		results[i] = r.NodeInfo
+		byID[r.ID] = r
+	}
+	sortByDistance(results, target)
+
+	closest := make([]lookupResult, 0, K)
+	for _, r := range results[:min(K, len(results))] {
+		closest = append(closest, byID[r.ID])
+	}
+	return closest, nil
+}
+
+// FindNode returns the K closest nodes to target that answered.
+func (n *Node) FindNode(ctx context.Context, target NodeID) ([]NodeInfo, error) {
+	results, err := n.lookup(ctx, target, "find_node", queryArgs{Target: target[:]}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]NodeInfo, len(results))
+	for i, r := range results {
+		nodes[i] = r.NodeInfo
+	}
+	return nodes, nil
+}
+
+// GetPeers looks up the peers announced for infoHash.
+func (n *Node) GetPeers(ctx context.Context, infoHash NodeID) ([]*net.TCPAddr, error) {
+	peers, _, err := n.getPeers(ctx, infoHash, nil)
+	return peers, err
+}
+
+// getPeers runs a get_peers lookup, passing each batch of new peers to found
+// as they come in.
+func (n *Node) getPeers(ctx context.Context, infoHash NodeID, found func([]*net.TCPAddr)) ([]*net.TCPAddr, []lookupResult, error) {
+	seen := make(map[string]bool)
+	var peers []*net.TCPAddr
+
+	results, err := n.lookup(ctx, infoHash, "get_peers", queryArgs{InfoHash: infoHash[:]}, func(_ NodeInfo, r *responseValues) {
+		var batch []*net.TCPAddr
+		for _, v := range r.Values {
+			addr, ok := decodePeer(v)
+			if !ok || seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			batch = append(batch, addr)
+		}
+		peers = append(peers, batch...)
+		if found != nil && len(batch) > 0 {
+			found(batch)
+		}
+	})
+	return peers, results, err
+}
+
+// Announce tells the nodes closest to infoHash that we have it on port.
+// Port 0 asks them to use the port our queries come from. It returns how
+// many nodes took the announce.
+func (n *Node) Announce(ctx context.Context, infoHash NodeID, port int) (int, error) {
+	_, results, err := n.getPeers(ctx, infoHash, nil)
+	if err != nil {
+		return 0, err
+	}
+	return n.announce(ctx, infoHash, port, results), nil
+}
+
+func (n *Node) announce(ctx context.Context, infoHash NodeID, port int, results []lookupResult) int {
+	a := queryArgs{InfoHash: infoHash[:], Port: port}
+	if port == 0 {
+		a.ImpliedPort = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	count := 0
+	for _, r := range results {
+		if r.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(r lookupResult) {
+			defer wg.Done()
+
+			a := a
+			a.Token = r.token
+			if _, err := n.query(ctx, r.Addr, "announce_peer", a); err == nil {
+				mu.Lock()
+				count++
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return count
+}
+
+// LookupPeers finds peers for infoHash and sends them to updates as they are
+// found, the same way a Tracker does. When port is not negative it also
+// announces us on it afterwards.
+func (n *Node) LookupPeers(ctx context.Context, infoHash NodeID, port int, updates chan<- []net.Addr) error {
+	_, results, err := n.getPeers(ctx, infoHash, func(batch []*net.TCPAddr) {
+		addrs := make([]net.Addr, len(batch))
+		for i, addr := range batch {
+			addrs[i] = addr
+		}
+		select {
+		case updates <- addrs:
+		case <-ctx.Done():
+		case <-n.done:
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if port >= 0 {
+		n.announce(ctx, infoHash, port, results)
+	}
+	return nil
+}
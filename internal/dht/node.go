@@ -0,0 +1,456 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+const (
+	// queries in flight per lookup
+	alpha = 3
+
+	defaultTimeout      = 5 * time.Second
+	maintenanceInterval = 5 * time.Minute
+)
+
+// DefaultBootstrapNodes are the well known routers used when Config has none.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	ErrNoNodes = errors.New("dht: routing table is empty")
+	ErrClosed  = errors.New("dht: node closed")
+	ErrTimeout = errors.New("dht: query timed out")
+)
+
+type Config struct {
+	// Addr is the UDP address to listen on, like ":6881"
+	Addr string
+	// ID is random when zero, or taken from State
+	ID NodeID
+	// BootstrapNodes are host:port pairs, DefaultBootstrapNodes when nil
+	BootstrapNodes []string
+	// State is a routing table saved by a previous run
+	State *State
+	// Timeout for a single query, defaultTimeout when zero
+	Timeout time.Duration
+}
+
+// Node is a mainline DHT node (BEP 5). It answers queries from other nodes
+// and runs lookups for peers. Bound to an unspecified address it runs on
+// IPv4 and IPv6 at once, with a routing table for each (BEP 32).
+type Node struct {
+	id        NodeID
+	conn      *net.UDPConn
+	family    want
+	table4    *table
+	table6    *table
+	tokens    *tokenManager
+	peers     *peerStore
+	items     *itemStore
+	timeout   time.Duration
+	bootstrap []string
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextT   uint16
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type pendingQuery struct {
+	addr  *net.UDPAddr
+	reply chan *message
+}
+
+// New starts a node listening on cfg.Addr. Call Bootstrap to join the
+// network.
+func New(cfg Config) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	id := cfg.ID
+	if id == (NodeID{}) && cfg.State != nil {
+		id, _ = cfg.State.nodeID()
+	}
+	if id == (NodeID{}) {
+		id = RandomNodeID()
+	}
+
+	n := &Node{
+		id:        id,
+		conn:      conn,
+		family:    localFamily(conn.LocalAddr().(*net.UDPAddr).IP),
+		table4:    newTable(id),
+		table6:    newTable(id),
+		tokens:    newTokenManager(),
+		peers:     newPeerStore(),
+		items:     newItemStore(),
+		timeout:   cfg.Timeout,
+		bootstrap: cfg.BootstrapNodes,
+		pending:   make(map[string]*pendingQuery),
+		done:      make(chan struct{}),
+	}
+
+	if n.timeout == 0 {
+		n.timeout = defaultTimeout
+	}
+	if n.bootstrap == nil {
+		n.bootstrap = DefaultBootstrapNodes
+	}
+
+	if cfg.State != nil {
+		for _, info := range cfg.State.nodes() {
+			n.tableFor(info.Addr.IP).restore(info)
+		}
+	}
+
+	n.wg.Add(2)
+	go n.readLoop()
+	go n.maintain()
+
+	return n, nil
+}
+
+func (n *Node) ID() NodeID {
+	return n.id
+}
+
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Len returns how many nodes are in the routing tables.
+func (n *Node) Len() int {
+	return n.table4.len() + n.table6.len()
+}
+
+// localFamily is the families a socket bound to ip can talk to. Only the
+// IPv6 unspecified address gets a dual-stack socket.
+func localFamily(ip net.IP) want {
+	if ip.IsUnspecified() && ip.To4() == nil {
+		return want{n4: true, n6: true}
+	}
+	return want{n4: ip.To4() != nil, n6: ip.To4() == nil}
+}
+
+func (n *Node) tableFor(ip net.IP) *table {
+	if ip.To4() != nil {
+		return n.table4
+	}
+	return n.table6
+}
+
+func (n *Node) questionable() []NodeInfo {
+	return append(n.table4.questionable(), n.table6.questionable()...)
+}
+
+func (n *Node) Close() error {
+	select {
+	case <-n.done:
+		return nil
+	default:
+	}
+
+	close(n.done)
+	err := n.conn.Close()
+	n.wg.Wait()
+	return err
+}
+
+func (n *Node) send(addr *net.UDPAddr, m *message) error {
+	m.V = clientVersion
+
+	buf, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.conn.WriteToUDP(buf, addr)
+	return err
+}
+
+func (n *Node) sendError(t string, addr *net.UDPAddr, code int, msg string) {
+	n.send(addr, &message{T: t, Y: "e", E: []any{code, msg}})
+}
+
+// query sends a query and waits for the answer. Nodes that answer are added
+// to the routing table, ones that time out count a failure.
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, a queryArgs) (*responseValues, error) {
+	a.ID = n.id
+
+	n.mu.Lock()
+	n.nextT++
+	t := string(binary.BigEndian.AppendUint16(nil, n.nextT))
+	pq := &pendingQuery{addr: addr, reply: make(chan *message, 1)}
+	n.pending[t] = pq
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, t)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(addr, &message{T: t, Y: "q", Q: method, A: &a}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.timeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-pq.reply:
+		if m.Y == "e" {
+			return nil, parseError(m.E)
+		}
+		if m.R == nil {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "response without r"}
+		}
+		n.tableFor(addr.IP).add(NodeInfo{ID: m.R.ID, Addr: addr})
+		return m.R, nil
+	case <-timer.C:
+		n.tableFor(addr.IP).failed(addr.String())
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.done:
+		return nil, ErrClosed
+	}
+}
+
+func (n *Node) readLoop() {
+	defer n.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		// anything that does not decode is noise, there is nobody to answer
+		var m message
+		if err := bencode.Unmarshal(buf[:size], &m); err != nil {
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			n.handleQuery(&m, addr)
+		case "r", "e":
+			n.mu.Lock()
+			pq := n.pending[m.T]
+			n.mu.Unlock()
+
+			// answers only count from the address we asked
+			if pq != nil && pq.addr.IP.Equal(addr.IP) && pq.addr.Port == addr.Port {
+				select {
+				case pq.reply <- &m:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (n *Node) handleQuery(m *message, addr *net.UDPAddr) {
+	if m.A == nil {
+		n.sendError(m.T, addr, ErrCodeProtocol, "missing arguments")
+		return
+	}
+
+	r := &responseValues{ID: n.id}
+	w := parseWant(m.A.Want, addr.IP)
+
+	switch m.Q {
+	case "ping":
+
+	case "find_node":
+		target, ok := toNodeID(m.A.Target)
+		if !ok {
+			n.sendError(m.T, addr, ErrCodeProtocol, "invalid target")
+			return
+		}
+		n.closestNodes(r, target, w)
+
+	case "get_peers":
+		infoHash, ok := toNodeID(m.A.InfoHash)
+		if !ok {
+			n.sendError(m.T, addr, ErrCodeProtocol, "invalid info_hash")
+			return
+		}
+		r.Token = n.tokens.token(addr.IP)
+		for _, peer := range n.peers.get(infoHash, maxValues, w) {
+			if v := encodePeer(peer); v != nil {
+				r.Values = append(r.Values, v)
+			}
+		}
+		if len(r.Values) == 0 {
+			n.closestNodes(r, infoHash, w)
+		}
+
+	case "announce_peer":
+		infoHash, ok := toNodeID(m.A.InfoHash)
+		if !ok {
+			n.sendError(m.T, addr, ErrCodeProtocol, "invalid info_hash")
+			return
+		}
+		if !n.tokens.valid(m.A.Token, addr.IP) {
+			n.sendError(m.T, addr, ErrCodeProtocol, "bad token")
+			return
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.sendError(m.T, addr, ErrCodeProtocol, "invalid port")
+			return
+		}
+		n.peers.add(infoHash, &net.TCPAddr{IP: addr.IP, Port: port})
+
+	case "get":
+		target, ok := toNodeID(m.A.Target)
+		if !ok {
+			n.sendError(m.T, addr, ErrCodeProtocol, "invalid target")
+			return
+		}
+		r.Token = n.tokens.token(addr.IP)
+		n.closestNodes(r, target, w)
+		n.handleGet(r, target, m.A.Seq)
+
+	case "put":
+		if !n.tokens.valid(m.A.Token, addr.IP) {
+			n.sendError(m.T, addr, ErrCodeProtocol, "bad token")
+			return
+		}
+		if err := n.handlePut(m.A); err != nil {
+			n.sendError(m.T, addr, err.Code, err.Message)
+			return
+		}
+
+	default:
+		n.sendError(m.T, addr, ErrCodeMethodUnknown, "method unknown")
+		return
+	}
+
+	// whoever queries us is alive, it can be used for our own lookups
+	n.tableFor(addr.IP).add(NodeInfo{ID: m.A.ID, Addr: addr})
+
+	n.send(addr, &message{T: m.T, Y: "r", R: r})
+}
+
+// closestNodes fills nodes and nodes6 of r with the families in w.
+func (n *Node) closestNodes(r *responseValues, target NodeID, w want) {
+	if w.n4 {
+		r.Nodes = encodeNodes(n.table4.closest(target, K))
+	}
+	if w.n6 {
+		r.Nodes6 = encodeNodes6(n.table6.closest(target, K))
+	}
+}
+
+// Ping checks that a node is up and returns its ID.
+func (n *Node) Ping(ctx context.Context, addr *net.UDPAddr) (NodeID, error) {
+	r, err := n.query(ctx, addr, "ping", queryArgs{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return r.ID, nil
+}
+
+// Bootstrap pings the bootstrap nodes and the questionable nodes from a saved
+// table, then looks up our own ID to fill the routing table.
+func (n *Node) Bootstrap(ctx context.Context) error {
+	var addrs []*net.UDPAddr
+	for _, hostport := range n.bootstrap {
+		for _, network := range n.networks() {
+			addr, err := net.ResolveUDPAddr(network, hostport)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, info := range n.questionable() {
+		addrs = append(addrs, info.Addr)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			n.Ping(ctx, addr)
+		}(addr)
+	}
+	wg.Wait()
+
+	if n.Len() == 0 {
+		return ErrNoNodes
+	}
+
+	_, err := n.FindNode(ctx, n.id)
+	return err
+}
+
+// maintain pings questionable nodes and bootstraps again when the table
+// runs low.
+func (n *Node) maintain() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), maintenanceInterval/2)
+			if n.Len() < K {
+				n.Bootstrap(ctx)
+			} else {
+				for _, info := range n.questionable() {
+					n.Ping(ctx, info.Addr)
+				}
+			}
+			cancel()
+		}
+	}
+}
+
+// networks are the ones to resolve host names in, one per family we run on.
+func (n *Node) networks() []string {
+	var networks []string
+	if n.family.n4 {
+		networks = append(networks, "udp4")
+	}
+	if n.family.n6 {
+		networks = append(networks, "udp6")
+	}
+	return networks
+}
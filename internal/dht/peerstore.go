@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// announced peers are forgotten after this long, clients reannounce
+	// every 15 to 30 minutes
+	peerTTL = 30 * time.Minute
+
+	// values in one get_peers response, more would not fit a UDP packet
+	maxValues = 50
+
+	// bounds on what announces can make us store
+	maxPeersPerHash = 500
+	maxInfoHashes   = 5000
+)
+
+// peerStore keeps the peers announced to us.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[NodeID]map[string]storedPeer
+}
+
+type storedPeer struct {
+	addr    *net.TCPAddr
+	expires time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[NodeID]map[string]storedPeer)}
+}
+
+func (s *peerStore) add(infoHash NodeID, addr *net.TCPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxInfoHashes {
+			s.expire()
+			if len(s.peers) >= maxInfoHashes {
+				return
+			}
+		}
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+
+	key := addr.String()
+	if _, ok := peers[key]; !ok && len(peers) >= maxPeersPerHash {
+		return
+	}
+	peers[key] = storedPeer{addr: addr, expires: time.Now().Add(peerTTL)}
+}
+
+// get returns up to n live peers for infoHash of the families in w.
+func (s *peerStore) get(infoHash NodeID, n int, w want) []*net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var addrs []*net.TCPAddr
+	for key, p := range s.peers[infoHash] {
+		if now.After(p.expires) {
+			delete(s.peers[infoHash], key)
+			continue
+		}
+		if len(addrs) < n && w.has(p.addr.IP) {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+// expire drops every expired peer, must be called with mu held.
+func (s *peerStore) expire() {
+	now := time.Now()
+	for infoHash, peers := range s.peers {
+		for key, p := range peers {
+			if now.After(p.expires) {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+)
+
+// State is what a node keeps between runs: its ID, so it gets back the same
+// place in the network, and the routing table, so it does not depend on the
+// bootstrap nodes.
+type State struct {
+	ID    string       `json:"id"`
+	Nodes []StateEntry `json:"nodes,omitempty"`
+}
+
+type StateEntry struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// State returns the node ID and routing table to be saved.
+func (n *Node) State() *State {
+	s := &State{ID: n.id.String()}
+	for _, info := range append(n.table4.nodes(), n.table6.nodes()...) {
+		s.Nodes = append(s.Nodes, StateEntry{ID: info.ID.String(), Addr: info.Addr.String()})
+	}
+	return s
+}
+
+func parseNodeID(s string) (NodeID, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return NodeID{}, false
+	}
+	return toNodeID(b)
+}
+
+func (s *State) nodeID() (NodeID, bool) {
+	return parseNodeID(s.ID)
+}
+
+// nodes returns the saved nodes, skipping the ones that do not parse.
+func (s *State) nodes() []NodeInfo {
+	var nodes []NodeInfo
+	for _, e := range s.Nodes {
+		id, ok := parseNodeID(e.ID)
+		if !ok {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", e.Addr)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, NodeInfo{ID: id, Addr: addr})
+	}
+	return nodes
+}
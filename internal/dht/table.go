@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// K is the bucket size and how many nodes lookups return
+	K = 8
+
+	// nodes that have not been heard from in this long are questionable
+	// and pinged, or replaced when their bucket is full
+	questionableAfter = 15 * time.Minute
+	// nodes are removed after this many queries in a row time out
+	maxFailures = 3
+)
+
+type tableNode struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+func (n *tableNode) bad() bool {
+	return n.failures > 0 || time.Since(n.lastSeen) > questionableAfter
+}
+
+// table is the Kademlia routing table. Bucket i holds the nodes that share
+// exactly i leading bits with our own ID, least recently seen first.
+type table struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [160][]*tableNode
+}
+
+func newTable(self NodeID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucket(id NodeID) int {
+	return min(commonPrefixLen(t.self, id), len(t.buckets)-1)
+}
+
+// add records that we heard from a node. Known nodes move to the back of
+// their bucket; new ones are added when there is room or when they can take
+// the place of a bad node, otherwise they are dropped, since nodes that have
+// been around for long tend to stay.
+func (t *table) add(info NodeInfo) {
+	t.insert(info, time.Now())
+}
+
+// restore adds a node from a saved table. It is questionable until it answers
+// a ping.
+func (t *table) restore(info NodeInfo) {
+	t.insert(info, time.Time{})
+}
+
+func (t *table) insert(info NodeInfo, seen time.Time) {
+	if info.ID == t.self || info.Addr == nil || info.Addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.bucket(info.ID)
+	b := t.buckets[i]
+
+	for j, n := range b {
+		if n.ID != info.ID {
+			continue
+		}
+		// a node does not get to move to another address, that would let
+		// anyone hijack its place in our table
+		if !n.Addr.IP.Equal(info.Addr.IP) || n.Addr.Port != info.Addr.Port {
+			return
+		}
+		if !seen.IsZero() {
+			n.lastSeen = seen
+			n.failures = 0
+		}
+		t.buckets[i] = append(append(b[:j:j], b[j+1:]...), n)
+		return
+	}
+
+	node := &tableNode{NodeInfo: info, lastSeen: seen}
+
+	if len(b) < K {
+		t.buckets[i] = append(b, node)
+		return
+	}
+
+	for j, n := range b {
+		if n.bad() {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), node)
+			return
+		}
+	}
+}
+
+// failed records a query to addr that timed out.
+func (t *table) failed(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, b := range t.buckets {
+		for j, n := range b {
+			if n.Addr.String() != addr {
+				continue
+			}
+			n.failures++
+			if n.failures >= maxFailures {
+				t.buckets[i] = append(b[:j:j], b[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to k nodes ordered by distance to target.
+func (t *table) closest(target NodeID, k int) []NodeInfo {
+	nodes := t.nodes()
+	sortByDistance(nodes, target)
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+func (t *table) nodes() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for _, b := range t.buckets {
+		for _, n := range b {
+			nodes = append(nodes, n.NodeInfo)
+		}
+	}
+	return nodes
+}
+
+// questionable returns the nodes that should be pinged to check they are
+// still around.
+func (t *table) questionable() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for _, b := range t.buckets {
+		for _, n := range b {
+			if n.bad() {
+				nodes = append(nodes, n.NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, b := range t.buckets {
+		count += len(b)
+	}
+	return count
+}
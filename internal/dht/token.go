@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokens handed out in get_peers stay valid until the end of the next
+// rotation period, one to two of them
+const tokenRotation = 5 * time.Minute
+
+// tokenManager hands out the get_peers tokens that an announce_peer from the
+// same IP must return. A token is a hash of the IP and a secret that changes
+// every tokenRotation; the previous secret is still accepted. Rotations are
+// done when a token is handed out or checked, as many as periods went by.
+type tokenManager struct {
+	mu      sync.Mutex
+	secret  [16]byte
+	prev    [16]byte
+	rotated time.Time
+}
+
+func newTokenManager() *tokenManager {
+	m := &tokenManager{rotated: time.Now()}
+	rand.Read(m.secret[:])
+	m.prev = m.secret
+	return m
+}
+
+func (m *tokenManager) rotate() {
+	periods := time.Since(m.rotated) / tokenRotation
+	switch {
+	case periods < 1:
+		return
+	case periods == 1:
+		m.prev = m.secret
+		m.rotated = m.rotated.Add(tokenRotation)
+	default:
+		// nothing handed out before the last period may still be valid
+		rand.Read(m.prev[:])
+		m.rotated = time.Now()
+	}
+	rand.Read(m.secret[:])
+}
+
+func tokenFor(secret [16]byte, ip net.IP) []byte {
+	h := sha1.New()
+	h.Write(secret[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	return h.Sum(nil)[:8]
+}
+
+func (m *tokenManager) token(ip net.IP) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+	return string(tokenFor(m.secret, ip))
+}
+
+func (m *tokenManager) valid(token string, ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+	return subtle.ConstantTimeCompare([]byte(token), tokenFor(m.secret, ip)) == 1 ||
+		subtle.ConstantTimeCompare([]byte(token), tokenFor(m.prev, ip)) == 1
+}
@@ -0,0 +1,383 @@
+// Package lsd finds peers on the local network with Local Service Discovery
+// (BEP 14): torrents are announced to a multicast group, and announcements
+// from other clients in the group are handed out as peers.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGroup4 = "239.192.152.143:6771"
+	DefaultGroup6 = "[ff15::efc0:988f]:6771"
+
+	// every torrent is announced this often
+	AnnounceInterval = 5 * time.Minute
+	// and never more often than this, whatever asks for it
+	minAnnounceInterval = time.Minute
+
+	// infohashes in one announcement, keeping it under 1400 bytes
+	maxInfoHashes = 20
+	maxPacketSize = 1400
+)
+
+var (
+	ErrPrivate        = errors.New("lsd: private torrents are not announced")
+	ErrNoGroup        = errors.New("lsd: could not join any multicast group")
+	ErrNotSearch      = errors.New("lsd: not a BT-SEARCH message")
+	ErrMissingPort    = errors.New("lsd: announcement without a port")
+	ErrMissingHashes  = errors.New("lsd: announcement without infohashes")
+	ErrInvalidPort    = errors.New("lsd: invalid port")
+	ErrInvalidHash    = errors.New("lsd: invalid infohash")
+	ErrPacketTooLarge = errors.New("lsd: announcement too large")
+)
+
+type Config struct {
+	// Port is the TCP port we take peer connections on
+	Port int
+	// Group4 and Group6 are the multicast groups, DefaultGroup4 and
+	// DefaultGroup6 when empty. Set one to "-" to stay off that family.
+	Group4 string
+	Group6 string
+	// Interface to join the groups on, the system default when nil
+	Interface *net.Interface
+}
+
+// Announcement is a BT-SEARCH message.
+type Announcement struct {
+	Port       int
+	Cookie     string
+	InfoHashes [][20]byte
+}
+
+// Service announces our torrents and listens for the announcements of others.
+type Service struct {
+	port   int
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type group struct {
+	addr   *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+type torrent struct {
+	updates      chan<- []net.Addr
+	lastAnnounce time.Time
+}
+
+// New joins the multicast groups. It works with only one of them, when the
+// host lacks IPv4 or IPv6.
+func New(cfg Config) (*Service, error) {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, ErrInvalidPort
+	}
+
+	cookie := make([]byte, 4)
+	rand.Read(cookie)
+
+	s := &Service{
+		port:     cfg.Port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrent),
+		done:     make(chan struct{}),
+	}
+
+	var errs []error
+	for _, g := range []struct{ network, addr, fallback string }{
+		{"udp4", cfg.Group4, DefaultGroup4},
+		{"udp6", cfg.Group6, DefaultGroup6},
+	} {
+		if g.addr == "-" {
+			continue
+		}
+		if g.addr == "" {
+			g.addr = g.fallback
+		}
+		joined, err := joinGroup(g.network, g.addr, cfg.Interface)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.groups = append(s.groups, joined)
+	}
+
+	if len(s.groups) == 0 {
+		return nil, errors.Join(append([]error{ErrNoGroup}, errs...)...)
+	}
+
+	for _, g := range s.groups {
+		s.wg.Add(1)
+		go s.readLoop(g)
+	}
+	s.wg.Add(1)
+	go s.announceLoop()
+
+	return s, nil
+}
+
+func joinGroup(network, addr string, ifi *net.Interface) (*group, error) {
+	gaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listen, err := net.ListenMulticastUDP(network, ifi, gaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+
+	return &group{addr: gaddr, listen: listen, send: send}, nil
+}
+
+func (s *Service) Cookie() string {
+	return s.cookie
+}
+
+// Add starts announcing infoHash. Peers announcing it are sent to updates,
+// the same way they come from a tracker.
+func (s *Service) Add(infoHash [20]byte, private bool, updates chan<- []net.Addr) error {
+	if private {
+		return ErrPrivate
+	}
+
+	s.mu.Lock()
+	if _, ok := s.torrents[infoHash]; !ok {
+		s.torrents[infoHash] = &torrent{updates: updates}
+	}
+	s.mu.Unlock()
+
+	s.Announce(infoHash)
+	return nil
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, infoHash)
+}
+
+// Announce announces infoHash now, unless it was announced less than a
+// minute ago. It reports whether an announcement went out.
+func (s *Service) Announce(infoHash [20]byte) bool {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok || time.Since(t.lastAnnounce) < minAnnounceInterval {
+		s.mu.Unlock()
+		return false
+	}
+	t.lastAnnounce = time.Now()
+	s.mu.Unlock()
+
+	return s.send([][20]byte{infoHash}) == nil
+}
+
+// announceAll announces every torrent that is due, as few messages as fit.
+func (s *Service) announceAll() {
+	now := time.Now()
+
+	s.mu.Lock()
+	var due [][20]byte
+	for infoHash, t := range s.torrents {
+		if now.Sub(t.lastAnnounce) >= minAnnounceInterval {
+			t.lastAnnounce = now
+			due = append(due, infoHash)
+		}
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		n := min(len(due), maxInfoHashes)
+		s.send(due[:n])
+		due = due[n:]
+	}
+}
+
+func (s *Service) send(infoHashes [][20]byte) error {
+	var errs []error
+	for _, g := range s.groups {
+		msg := EncodeAnnouncement(g.addr.String(), Announcement{
+			Port:       s.port,
+			Cookie:     s.cookie,
+			InfoHashes: infoHashes,
+		})
+		if _, err := g.send.WriteToUDP(msg, g.addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// one group working is enough
+	if len(errs) == len(s.groups) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.announceAll()
+		}
+	}
+}
+
+func (s *Service) readLoop(g *group) {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxPacketSize+1)
+	for {
+		n, from, err := g.listen.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		a, err := ParseAnnouncement(buf[:n])
+		if err != nil || a.Cookie == s.cookie {
+			continue
+		}
+		s.handle(a, from.IP)
+	}
+}
+
+// handle passes the peer behind an announcement to every torrent of ours it
+// announced.
+func (s *Service) handle(a *Announcement, ip net.IP) {
+	peer := []net.Addr{&net.TCPAddr{IP: ip, Port: a.Port}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, infoHash := range a.InfoHashes {
+		t, ok := s.torrents[infoHash]
+		if !ok || t.updates == nil {
+			continue
+		}
+		// a slow reader loses local peers, it gets them again at the next
+		// announcement
+		select {
+		case t.updates <- peer:
+		default:
+		}
+	}
+}
+
+func (s *Service) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+
+	close(s.done)
+	var errs []error
+	for _, g := range s.groups {
+		errs = append(errs, g.listen.Close(), g.send.Close())
+	}
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// EncodeAnnouncement writes a BT-SEARCH message for the group at host.
+func EncodeAnnouncement(host string, a Announcement) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", a.Port)
+	for _, infoHash := range a.InfoHashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", a.Cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// ParseAnnouncement reads a BT-SEARCH message. Header names are not case
+// sensitive and unknown headers are ignored.
+func ParseAnnouncement(b []byte) (*Announcement, error) {
+	if len(b) > maxPacketSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "BT-SEARCH * HTTP/1.") {
+		return nil, ErrNotSearch
+	}
+
+	a := &Announcement{}
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, ErrInvalidPort
+			}
+			a.Port = port
+		case "infohash":
+			raw, err := hex.DecodeString(value)
+			if err != nil || len(raw) != 20 {
+				return nil, ErrInvalidHash
+			}
+			a.InfoHashes = append(a.InfoHashes, [20]byte(raw))
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+
+	if a.Port == 0 {
+		return nil, ErrMissingPort
+	}
+	if len(a.InfoHashes) == 0 {
+		return nil, ErrMissingHashes
+	}
+	return a, nil
+}
@@ -0,0 +1,148 @@
+package lsd
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testGroups returns the LSD groups on a random port, so tests do not see
+// real announcements.
+func testGroups() (string, string) {
+	port := 20000 + rand.Intn(20000)
+	return fmt.Sprintf("239.192.152.143:%d", port), fmt.Sprintf("[ff15::efc0:988f]:%d", port)
+}
+
+func newTestService(t *testing.T, port int, group4, group6 string) *Service {
+	s, err := New(Config{Port: port, Group4: group4, Group6: group6})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func receive(t *testing.T, updates <-chan []net.Addr) net.Addr {
+	select {
+	case addrs := <-updates:
+		require.Len(t, addrs, 1)
+		return addrs[0]
+	case <-time.After(2 * time.Second):
+		t.Fatal("no peer received")
+		return nil
+	}
+}
+
+func Test_Announcement_OK(t *testing.T) {
+	a := Announcement{Port: 6881, Cookie: "abcd", InfoHashes: [][20]byte{{1}, {2}}}
+
+	msg := EncodeAnnouncement(DefaultGroup4, a)
+	require.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: 0100000000000000000000000000000000000000\r\n"+
+		"Infohash: 0200000000000000000000000000000000000000\r\n"+
+		"cookie: abcd\r\n"+
+		"\r\n\r\n", string(msg))
+
+	parsed, err := ParseAnnouncement(msg)
+	require.NoError(t, err)
+	require.Equal(t, &a, parsed)
+
+	// header names are not case sensitive, unknown ones are skipped
+	parsed, err = ParseAnnouncement([]byte("BT-SEARCH * HTTP/1.1\r\nhost: x\r\nPORT: 51413\r\nX-Other: 1\r\n" +
+		"infohash: 0300000000000000000000000000000000000000\r\n\r\n\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, 51413, parsed.Port)
+	require.Equal(t, [][20]byte{{3}}, parsed.InfoHashes)
+	require.Empty(t, parsed.Cookie)
+}
+
+func Test_Announcement_Err(t *testing.T) {
+	hash := "Infohash: 0100000000000000000000000000000000000000\r\n"
+
+	for msg, want := range map[string]error{
+		"M-SEARCH * HTTP/1.1\r\nPort: 1\r\n" + hash + "\r\n":            ErrNotSearch,
+		"BT-SEARCH * HTTP/1.1\r\n" + hash + "\r\n":                      ErrMissingPort,
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\n" + hash + "\r\n":           ErrInvalidPort,
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\n" + hash + "\r\n":       ErrInvalidPort,
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n":                       ErrMissingHashes,
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 0102\r\n\r\n":     ErrInvalidHash,
+		"BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: " + hash + "\r\n": ErrInvalidHash,
+	} {
+		_, err := ParseAnnouncement([]byte(msg))
+		require.ErrorIs(t, err, want, msg)
+	}
+
+	_, err := ParseAnnouncement(make([]byte, maxPacketSize+1))
+	require.ErrorIs(t, err, ErrPacketTooLarge)
+}
+
+func Test_Service_OK(t *testing.T) {
+	group4, group6 := testGroups()
+
+	for _, family := range []struct {
+		name           string
+		group4, group6 string
+	}{
+		{"ipv4", group4, "-"},
+		{"ipv6", "-", group6},
+	} {
+		t.Run(family.name, func(t *testing.T) {
+			a := newTestService(t, 6881, family.group4, family.group6)
+			b := newTestService(t, 6882, family.group4, family.group6)
+
+			infoHash := [20]byte{0xaa}
+			updatesA := make(chan []net.Addr, 10)
+			updatesB := make(chan []net.Addr, 10)
+
+			require.NoError(t, b.Add(infoHash, false, updatesB))
+			require.NoError(t, a.Add(infoHash, false, updatesA))
+
+			// b hears a, and a does not hear itself
+			peer := receive(t, updatesB)
+			require.Equal(t, 6881, peer.(*net.TCPAddr).Port)
+
+			// a was added after b announced, it hears b on b's next announcement
+			b.mu.Lock()
+			b.torrents[infoHash].lastAnnounce = time.Time{}
+			b.mu.Unlock()
+			require.True(t, b.Announce(infoHash))
+
+			peer = receive(t, updatesA)
+			require.Equal(t, 6882, peer.(*net.TCPAddr).Port)
+
+			// b's first announcement can still reach a after a was added,
+			// whatever else a hears must be b too
+			b.Close()
+			for drained := false; !drained; {
+				select {
+				case addrs := <-updatesA:
+					require.Equal(t, 6882, addrs[0].(*net.TCPAddr).Port)
+				case <-time.After(100 * time.Millisecond):
+					drained = true
+				}
+			}
+		})
+	}
+}
+
+func Test_Service_Err(t *testing.T) {
+	group4, _ := testGroups()
+	s := newTestService(t, 6881, group4, "-")
+
+	require.ErrorIs(t, s.Add([20]byte{1}, true, nil), ErrPrivate)
+	require.False(t, s.Announce([20]byte{1}))
+
+	// announcements are throttled per torrent
+	require.NoError(t, s.Add([20]byte{2}, false, nil))
+	require.False(t, s.Announce([20]byte{2}))
+
+	_, err := New(Config{Port: 0})
+	require.ErrorIs(t, err, ErrInvalidPort)
+
+	_, err = New(Config{Port: 6881, Group4: "-", Group6: "-"})
+	require.ErrorIs(t, err, ErrNoGroup)
+}
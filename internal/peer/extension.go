@@ -0,0 +1,291 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+// the extended handshake always has id 0, registered extensions get 1 and up
+const extHandshakeID = 0
+
+const (
+	// how many outstanding requests we accept, sent as reqq
+	defaultMaxRequests = 250
+	// assumed when the peer does not send reqq, it is what libtorrent uses
+	peerDefaultMaxRequests = 250
+
+	defaultClientVersion = "bittorrent-client"
+)
+
+var (
+	ErrExtensionNotSupported = errors.New("peer does not support the extension")
+	ErrExtensionRegistered   = errors.New("extension already registered")
+)
+
+// ExtendedHandshake is the BEP 10 handshake dictionary.
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	Version      string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       []byte         `bencode:"yourip,omitempty"`
+	IPv6         []byte         `bencode:"ipv6,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// Extension handles one BEP 10 extension for every peer. Both methods are
+// only called for peers that listed the extension in their handshake.
+type Extension interface {
+	// Handshake is called after each extended handshake from the peer
+	Handshake(p *Peer, hs *ExtendedHandshake) error
+	// HandleMessage is called with every message sent to our id for it
+	HandleMessage(p *Peer, payload []byte) error
+}
+
+// ExtensionEnabler can be implemented by an Extension that is not wanted for
+// every peer, like ut_pex on private torrents. A disabled extension is left
+// out of our handshake and its messages are ignored.
+type ExtensionEnabler interface {
+	Enabled(p *Peer) bool
+}
+
+func extensionEnabled(ext Extension, p *Peer) bool {
+	if e, ok := ext.(ExtensionEnabler); ok {
+		return e.Enabled(p)
+	}
+	return true
+}
+
+// ExtensionRegistry maps extension names to the ids we hand out in our
+// handshake. Ids are given in registration order and never change, so
+// extensions should be registered before any peer connects.
+type ExtensionRegistry struct {
+	mu         sync.RWMutex
+	names      []string // the id of names[i] is i+1
+	extensions map[string]Extension
+
+	// Version is sent as v, ListenPort as p when set
+	Version    string
+	ListenPort int
+	// IPv6 is our global IPv6 address, sent as ipv6 to peers connected over
+	// IPv4 so they can tell others about it
+	IPv6 net.IP
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		extensions: make(map[string]Extension),
+		Version:    defaultClientVersion,
+	}
+}
+
+// NewDefaultExtensions returns a registry with the extensions we support,
+// ut_metadata and ut_pex.
+func NewDefaultExtensions() *ExtensionRegistry {
+	r := NewExtensionRegistry()
+	r.Register(extMetadataName, metadataExtension{})
+	r.Register(extPexName, pexExtension{})
+	return r
+}
+
+// DefaultExtensions is used by every peer created with NewPeer.
+var DefaultExtensions = NewDefaultExtensions()
+
+// Register adds an extension and returns the id peers will use for it.
+func (r *ExtensionRegistry) Register(name string, ext Extension) (byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.extensions[name]; ok {
+		return 0, fmt.Errorf("%w: %s", ErrExtensionRegistered, name)
+	}
+	if len(r.names) == 255 {
+		return 0, errors.New("too many extensions")
+	}
+
+	r.names = append(r.names, name)
+	r.extensions[name] = ext
+
+	return byte(len(r.names)), nil
+}
+
+// ID returns the id we gave name, or 0 when it is not registered.
+func (r *ExtensionRegistry) ID(name string) byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i, n := range r.names {
+		if n == name {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+func (r *ExtensionRegistry) get(name string) Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.extensions[name]
+}
+
+func (r *ExtensionRegistry) lookup(id byte) (string, Extension, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id == 0 || int(id) > len(r.names) {
+		return "", nil, false
+	}
+	name := r.names[id-1]
+	return name, r.extensions[name], true
+}
+
+// m builds the m dictionary of our handshake with p.
+func (r *ExtensionRegistry) m(p *Peer) map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(map[string]int, len(r.names))
+	for i, name := range r.names {
+		if extensionEnabled(r.extensions[name], p) {
+			m[name] = i + 1
+		}
+	}
+	return m
+}
+
+// SupportsExtensionProtocol reports whether both sides set the BEP 10 bit in
+// the handshake.
+func (p *Peer) SupportsExtensionProtocol() bool {
+	return p.reserved.Has(BitExtension)
+}
+
+func (p *Peer) SendExtendedHandshake() error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	hs := ExtendedHandshake{
+		M:            p.Extensions.m(p),
+		Version:      p.Extensions.Version,
+		Reqq:         defaultMaxRequests,
+		Port:         p.Extensions.ListenPort,
+		MetadataSize: len(p.torrent.InfoRaw),
+	}
+
+	// tell the peer how we see it, it helps it learn its external address
+	if addr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			hs.YourIP = ip4
+			if ip6 := p.Extensions.IPv6; ip6 != nil && ip6.To4() == nil {
+				hs.IPv6 = ip6.To16()
+			}
+		} else {
+			hs.YourIP = addr.IP.To16()
+		}
+	}
+
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+
+	message := p.createMessage(MsgExtended, append([]byte{extHandshakeID}, payload...))
+	_, err = p.conn.Write(message)
+	return err
+}
+
+// SendExtended sends payload using the id the peer gave the extension in its
+// handshake.
+func (p *Peer) SendExtended(name string, payload []byte) error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	id, ok := p.peerExtensions[name]
+	if !ok || id == 0 {
+		return fmt.Errorf("%w: %s", ErrExtensionNotSupported, name)
+	}
+
+	message := p.createMessage(MsgExtended, append([]byte{byte(id)}, payload...))
+	_, err := p.conn.Write(message)
+	return err
+}
+
+func (p *Peer) processExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty extended message")
+	}
+
+	id, body := payload[0], payload[1:]
+
+	if id == extHandshakeID {
+		return p.processExtendedHandshake(body)
+	}
+
+	// ids we never handed out are ignored
+	name, ext, ok := p.Extensions.lookup(id)
+	if !ok || !p.SupportsExtension(name) || !extensionEnabled(ext, p) {
+		return nil
+	}
+
+	return ext.HandleMessage(p, body)
+}
+
+func (p *Peer) processExtendedHandshake(body []byte) error {
+	var hs ExtendedHandshake
+	if err := bencode.Unmarshal(body, &hs); err != nil {
+		return fmt.Errorf("invalid extended handshake: %w", err)
+	}
+
+	// a later handshake only updates what it mentions, id 0 disables
+	if p.peerExtensions == nil {
+		p.peerExtensions = make(map[string]int)
+	}
+	for name, id := range hs.M {
+		if id <= 0 || id > 255 {
+			delete(p.peerExtensions, name)
+		} else {
+			p.peerExtensions[name] = id
+		}
+	}
+
+	if hs.Version != "" {
+		p.ClientVersion = hs.Version
+	}
+	if hs.Reqq > 0 {
+		p.MaxRequests = hs.Reqq
+	}
+	if hs.Port > 0 && hs.Port <= 65535 && hs.Port != p.ListenPort {
+		p.setListenPort(hs.Port)
+	}
+	if len(hs.YourIP) == net.IPv4len || len(hs.YourIP) == net.IPv6len {
+		p.ExternalIP = net.IP(hs.YourIP)
+	}
+	if len(hs.IPv6) == net.IPv6len {
+		p.IPv6 = net.IP(hs.IPv6)
+	}
+	if hs.MetadataSize > 0 {
+		p.metadataSize = hs.MetadataSize
+	}
+
+	for name := range p.peerExtensions {
+		ext := p.Extensions.get(name)
+		if ext == nil || !extensionEnabled(ext, p) {
+			continue
+		}
+		if err := ext.Handshake(p, &hs); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Peer) SupportsExtension(name string) bool {
+	return p.peerExtensions[name] != 0
+}
@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingExtension struct {
+	handshakes int
+	messages   chan []byte
+}
+
+func (e *recordingExtension) Handshake(p *Peer, hs *ExtendedHandshake) error {
+	e.handshakes++
+	return nil
+}
+
+func (e *recordingExtension) HandleMessage(p *Peer, payload []byte) error {
+	e.messages <- payload
+	return nil
+}
+
+func Test_ExtensionRegistry_OK(t *testing.T) {
+	r := NewExtensionRegistry()
+
+	id, err := r.Register("ut_pex", &recordingExtension{})
+	require.NoError(t, err)
+	require.Equal(t, byte(1), id)
+
+	id, err = r.Register("custom", &recordingExtension{})
+	require.NoError(t, err)
+	require.Equal(t, byte(2), id)
+
+	require.Equal(t, byte(2), r.ID("custom"))
+	require.Equal(t, byte(0), r.ID("missing"))
+	require.Equal(t, map[string]int{"ut_pex": 1, "custom": 2}, r.m(&Peer{}))
+}
+
+func Test_ExtensionRegistryDuplicate_Err(t *testing.T) {
+	r := NewExtensionRegistry()
+
+	_, err := r.Register("custom", &recordingExtension{})
+	require.NoError(t, err)
+
+	_, err = r.Register("custom", &recordingExtension{})
+	require.ErrorIs(t, err, ErrExtensionRegistered)
+}
+
+// Connect sets the extension bit and sends the extended handshake when the
+// remote side sets it too.
+func Test_ConnectExtendedHandshake_OK(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	torrent := &bittorrent.Torrent{InfoHash: [20]byte{9}, InfoRaw: []byte("d4:name1:xe")}
+
+	received := make(chan *Handshake, 1)
+	extended := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 68)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		hs, _ := ReadHandshake(buf)
+		received <- hs
+
+		reply := Handshake{Pstr: "BitTorrent protocol", InfoHash: torrent.InfoHash}
+		reply.Reserved.Set(BitExtension)
+		conn.Write(reply.Serialize())
+
+		msg := make([]byte, 4096)
+		n, _ := io.ReadAtLeast(conn, msg, 6)
+		extended <- msg[:n]
+	}()
+
+	p := NewPeer(ln.Addr().(*net.TCPAddr), torrent, [20]byte{1})
+	p.Extensions = NewExtensionRegistry()
+	p.Extensions.Register(extMetadataName, metadataExtension{})
+	p.Extensions.IPv6 = net.ParseIP("2001:db8::1")
+	require.NoError(t, p.Connect())
+	defer p.conn.Close()
+
+	require.True(t, (<-received).Reserved.Has(BitExtension))
+	require.True(t, p.SupportsExtensionProtocol())
+
+	raw := <-extended
+	msg, err := ReadMessage(raw)
+	require.NoError(t, err)
+	require.Equal(t, MsgExtended, msg.ID)
+	require.Equal(t, byte(extHandshakeID), msg.Payload[0])
+
+	var hs ExtendedHandshake
+	require.NoError(t, bencode.Unmarshal(msg.Payload[1:], &hs))
+	require.Equal(t, 1, hs.M[extMetadataName])
+	require.Equal(t, len(torrent.InfoRaw), hs.MetadataSize)
+	require.Equal(t, defaultMaxRequests, hs.Reqq)
+	require.Equal(t, net.IPv4(127, 0, 0, 1).To4(), net.IP(hs.YourIP))
+	require.Equal(t, net.ParseIP("2001:db8::1"), net.IP(hs.IPv6))
+}
+
+func Test_ExtendedDispatch_OK(t *testing.T) {
+	ext := &recordingExtension{messages: make(chan []byte, 1)}
+	registry := NewExtensionRegistry()
+	registry.Register("custom", ext)
+
+	p := NewPeer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, &bittorrent.Torrent{}, [20]byte{})
+	p.Extensions = registry
+
+	hs, err := bencode.Marshal(ExtendedHandshake{
+		M:       map[string]int{"custom": 7, "unknown": 3},
+		Version: "Other 1.0",
+		Reqq:    500,
+		YourIP:  []byte{10, 0, 0, 2},
+		IPv6:    net.ParseIP("2001:db8::7"),
+		Port:    51413,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{extHandshakeID}, hs...)))
+	require.Equal(t, 1, ext.handshakes)
+	require.Equal(t, "Other 1.0", p.ClientVersion)
+	require.Equal(t, 500, p.MaxRequests)
+	require.Equal(t, 51413, p.ListenPort)
+	require.Equal(t, "10.0.0.2", p.ExternalIP.String())
+	require.Equal(t, "2001:db8::7", p.IPv6.String())
+	require.True(t, p.SupportsExtension("custom"))
+	require.False(t, p.SupportsExtension(extMetadataName))
+
+	// messages come in with the id we handed out, not the peer's
+	require.NoError(t, p.HandleMessage(MsgExtended, []byte{1, 'h', 'i'}))
+	require.Equal(t, []byte("hi"), <-ext.messages)
+
+	// unknown ids are ignored
+	require.NoError(t, p.HandleMessage(MsgExtended, []byte{42, 'x'}))
+	require.Len(t, ext.messages, 0)
+
+	// a later handshake can disable an extension
+	hs, err = bencode.Marshal(ExtendedHandshake{M: map[string]int{"custom": 0}})
+	require.NoError(t, err)
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{extHandshakeID}, hs...)))
+	require.False(t, p.SupportsExtension("custom"))
+	require.Equal(t, 1, ext.handshakes)
+
+	require.NoError(t, p.HandleMessage(MsgExtended, []byte{1, 'h', 'i'}))
+	require.Len(t, ext.messages, 0)
+}
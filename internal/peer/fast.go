@@ -0,0 +1,309 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+)
+
+const (
+	// how many pieces we let a choked peer request (BEP 6 suggests 10)
+	allowedFastCount = 10
+	// suggestions past this many drop the oldest
+	maxSuggested = 32
+	// longest block a peer may request, clients send 16 KiB
+	maxRequestLength = 128 * 1024
+)
+
+var ErrFastNotNegotiated = errors.New("fast extension message without the fast extension")
+
+// blockRequest is the payload of request, cancel and reject messages.
+type blockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, error) {
+	if len(payload) != 12 {
+		return blockRequest{}, fmt.Errorf("request payload has %d bytes, expected 12", len(payload))
+	}
+	var fields [3]int
+	for i := range fields {
+		v := binary.BigEndian.Uint32(payload[i*4:])
+		// past MaxInt32 the value would be negative as a 32 bit int, and no
+		// index, offset or length is that big
+		if v > math.MaxInt32 {
+			return blockRequest{}, fmt.Errorf("request value %d out of range", v)
+		}
+		fields[i] = int(v)
+	}
+	return blockRequest{Index: fields[0], Begin: fields[1], Length: fields[2]}, nil
+}
+
+// validRequest reports whether r lies within a piece of the torrent.
+func (p *Peer) validRequest(r blockRequest) bool {
+	pieceSize := p.torrent.GetPieceSize(r.Index)
+	return r.Length > 0 && r.Length <= maxRequestLength &&
+		r.Begin < pieceSize && r.Length <= pieceSize-r.Begin
+}
+
+func (r blockRequest) serialize() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(r.Index))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(r.Begin))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(r.Length))
+	return buf
+}
+
+func parsePieceIndex(payload []byte, numPieces int) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("piece index payload has %d bytes, expected 4", len(payload))
+	}
+	// compared before the conversion, which can wrap on 32 bit
+	index := binary.BigEndian.Uint32(payload)
+	if uint64(index) >= uint64(max(numPieces, 0)) {
+		return 0, fmt.Errorf("piece index %d out of range", index)
+	}
+	return int(index), nil
+}
+
+func pieceIndexPayload(index int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(index))
+}
+
+// AllowedFastSet computes the k pieces a peer at ip may request while choked
+// (BEP 6). It is only defined for IPv4, other addresses get no set.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	// the last byte of the address is masked so peers in the same /24 get
+	// the same set
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(uint64(binary.BigEndian.Uint32(x[i*4:])) % uint64(numPieces))
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+// SupportsFast reports whether both sides set the fast extension bit.
+func (p *Peer) SupportsFast() bool {
+	return p.reserved.Has(BitFast)
+}
+
+func (p *Peer) numPieces() int {
+	return p.torrent.PiecesCount()
+}
+
+// SendRequest asks for a block. While choked only allowed fast pieces can be
+// requested.
+func (p *Peer) SendRequest(index, begin, length int) error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if p.AmChoked && !p.AllowedFast[index] {
+		return fmt.Errorf("choked, piece %d is not allowed fast", index)
+	}
+
+	p.setBlockRequested(index, begin, true)
+
+	message := p.createMessage(MsgRequest, blockRequest{index, begin, length}.serialize())
+	if _, err := p.conn.Write(message); err != nil {
+		p.setBlockRequested(index, begin, false)
+		return err
+	}
+
+	return nil
+}
+
+// setBlockRequested updates IsBlockRequested for the block starting at begin.
+func (p *Peer) setBlockRequested(index, begin int, requested bool) {
+	if index < 0 || index >= len(p.IsBlockRequested) || p.torrent.BlockSize <= 0 {
+		return
+	}
+
+	if p.IsBlockRequested[index] == nil {
+		if !requested {
+			return
+		}
+		pieceSize := p.torrent.GetPieceSize(index)
+		p.IsBlockRequested[index] = make([]bool, (pieceSize+p.torrent.BlockSize-1)/p.torrent.BlockSize)
+	}
+
+	block := begin / p.torrent.BlockSize
+	if block >= 0 && block < len(p.IsBlockRequested[index]) {
+		p.IsBlockRequested[index][block] = requested
+	}
+}
+
+// SendChoke chokes the peer. With the fast extension every request it has
+// queued is rejected, without it they are dropped and the peer knows it.
+func (p *Peer) SendChoke() error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	if _, err := p.conn.Write(p.createMessage(MsgChoke, nil)); err != nil {
+		return err
+	}
+	p.PeerChoked = true
+
+	queued := p.peerRequests
+	p.peerRequests = nil
+
+	if !p.SupportsFast() {
+		return nil
+	}
+
+	for _, r := range queued {
+		if p.grantedFast[r.Index] {
+			// allowed fast requests survive a choke
+			p.peerRequests = append(p.peerRequests, r)
+			continue
+		}
+		if err := p.sendReject(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Peer) sendReject(r blockRequest) error {
+	_, err := p.conn.Write(p.createMessage(MsgRejectRequest, r.serialize()))
+	return err
+}
+
+// SendAllowedFast tells the peer which pieces it may request while we choke
+// it. Nothing is sent without the fast extension or for IPv6 peers.
+func (p *Peer) SendAllowedFast() error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if !p.SupportsFast() {
+		return nil
+	}
+
+	set := AllowedFastSet(p.Addr.IP, p.torrent.InfoHash, p.numPieces(), allowedFastCount)
+
+	if p.grantedFast == nil {
+		p.grantedFast = make(map[int]bool, len(set))
+	}
+	for _, index := range set {
+		p.grantedFast[index] = true
+	}
+
+	for _, index := range set {
+		if _, err := p.conn.Write(p.createMessage(MsgAllowedFast, pieceIndexPayload(index))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendSuggest suggests a piece to download, only with the fast extension.
+func (p *Peer) SendSuggest(index int) error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if !p.SupportsFast() {
+		return nil
+	}
+
+	_, err := p.conn.Write(p.createMessage(MsgSuggestPiece, pieceIndexPayload(index)))
+	return err
+}
+
+func (p *Peer) processHaveAll(all bool) error {
+	if !p.SupportsFast() {
+		return ErrFastNotNegotiated
+	}
+
+	numPieces := p.numPieces()
+	p.Bitfield = make([]byte, (numPieces+7)/8)
+	p.IsSeeder = all
+
+	if all {
+		for i := 0; i < numPieces; i++ {
+			p.Bitfield[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+
+	return nil
+}
+
+func (p *Peer) processSuggest(payload []byte) error {
+	if !p.SupportsFast() {
+		return ErrFastNotNegotiated
+	}
+
+	index, err := parsePieceIndex(payload, p.numPieces())
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(p.Suggested, index) {
+		return nil
+	}
+	p.Suggested = append(p.Suggested, index)
+	if len(p.Suggested) > maxSuggested {
+		p.Suggested = p.Suggested[1:]
+	}
+
+	return nil
+}
+
+func (p *Peer) processReject(payload []byte) error {
+	if !p.SupportsFast() {
+		return ErrFastNotNegotiated
+	}
+
+	r, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	// the block can be requested again, from this peer or another one
+	p.setBlockRequested(r.Index, r.Begin, false)
+
+	return nil
+}
+
+func (p *Peer) processAllowedFast(payload []byte) error {
+	if !p.SupportsFast() {
+		return ErrFastNotNegotiated
+	}
+
+	index, err := parsePieceIndex(payload, p.numPieces())
+	if err != nil {
+		return err
+	}
+
+	if p.AllowedFast == nil {
+		p.AllowedFast = make(map[int]bool)
+	}
+	p.AllowedFast[index] = true
+
+	return nil
+}
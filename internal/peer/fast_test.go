@@ -0,0 +1,277 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// the example from BEP 6
+func Test_AllowedFastSet_OK(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+
+	require.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(ip, infoHash, 1313, 7))
+	require.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(ip, infoHash, 1313, 9))
+
+	// the last byte of the address does not matter
+	require.Equal(t, AllowedFastSet(ip, infoHash, 1313, 7), AllowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 7))
+
+	require.Len(t, AllowedFastSet(ip, infoHash, 3, 10), 3)
+	require.Nil(t, AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 7))
+}
+
+func fastTorrent() *bittorrent.Torrent {
+	return &bittorrent.Torrent{
+		PieceSize:   32 * 1024,
+		BlockSize:   16 * 1024,
+		PieceHashes: make([][]byte, 10),
+		Files:       []bittorrent.FileItem{bittorrent.NewFileItem("f", 10*32*1024, 0)},
+	}
+}
+
+// fastPeer returns a peer that negotiated the fast extension, with the other
+// end of its connection.
+func fastPeer(t *testing.T, fast bool) (*Peer, *Peer) {
+	p := NewPeer(&net.TCPAddr{IP: net.IPv4(80, 4, 4, 200), Port: 6881}, fastTorrent(), [20]byte{})
+	p.IsBlockRequested = make([][]bool, 10)
+	if fast {
+		p.reserved.Set(BitFast)
+	}
+
+	local, remote := net.Pipe()
+	p.conn = local
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	return p, &Peer{conn: remote}
+}
+
+func readNext(t *testing.T, other *Peer) (messageID, []byte) {
+	id, payload, err := other.ReadMessage()
+	require.NoError(t, err)
+	return messageID(id), payload
+}
+
+func Test_FastHaveAllNone_OK(t *testing.T) {
+	p, _ := fastPeer(t, true)
+
+	require.NoError(t, p.HandleMessage(MsgHaveAll, nil))
+	require.True(t, p.IsSeeder)
+	require.Equal(t, []byte{0xff, 0xc0}, p.Bitfield)
+
+	require.NoError(t, p.HandleMessage(MsgHaveNone, nil))
+	require.False(t, p.IsSeeder)
+	require.Equal(t, []byte{0, 0}, p.Bitfield)
+}
+
+func Test_FastNotNegotiated_Err(t *testing.T) {
+	p, _ := fastPeer(t, false)
+
+	require.ErrorIs(t, p.HandleMessage(MsgHaveAll, nil), ErrFastNotNegotiated)
+	require.ErrorIs(t, p.HandleMessage(MsgAllowedFast, pieceIndexPayload(1)), ErrFastNotNegotiated)
+}
+
+func Test_FastSuggestAndAllowed_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+
+	require.NoError(t, p.HandleMessage(MsgSuggestPiece, pieceIndexPayload(3)))
+	require.NoError(t, p.HandleMessage(MsgSuggestPiece, pieceIndexPayload(3)))
+	require.Equal(t, []int{3}, p.Suggested)
+	require.Error(t, p.HandleMessage(MsgSuggestPiece, pieceIndexPayload(10)))
+
+	// choked, only allowed fast pieces can be requested
+	require.Error(t, p.SendRequest(2, 0, 16*1024))
+	require.NoError(t, p.HandleMessage(MsgAllowedFast, pieceIndexPayload(2)))
+
+	go p.SendRequest(2, 16*1024, 16*1024)
+	id, payload := readNext(t, other)
+	require.Equal(t, MsgRequest, id)
+	require.Equal(t, blockRequest{2, 16 * 1024, 16 * 1024}.serialize(), payload)
+}
+
+func Test_FastReject_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+	p.AmChoked = false
+
+	go func() {
+		p.SendRequest(1, 0, 16*1024)
+		p.SendRequest(1, 16*1024, 16*1024)
+	}()
+	readNext(t, other)
+	readNext(t, other)
+	require.Equal(t, []bool{true, true}, p.IsBlockRequested[1])
+
+	// a choke keeps the requests, the reject frees its block
+	require.NoError(t, p.HandleMessage(MsgChoke, nil))
+	require.Equal(t, []bool{true, true}, p.IsBlockRequested[1])
+
+	require.NoError(t, p.HandleMessage(MsgRejectRequest, blockRequest{1, 16 * 1024, 16 * 1024}.serialize()))
+	require.Equal(t, []bool{true, false}, p.IsBlockRequested[1])
+}
+
+func Test_ChokeWithoutFast_OK(t *testing.T) {
+	p, other := fastPeer(t, false)
+	p.AmChoked = false
+
+	go p.SendRequest(1, 0, 16*1024)
+	readNext(t, other)
+
+	require.NoError(t, p.HandleMessage(MsgChoke, nil))
+	require.Nil(t, p.IsBlockRequested[1])
+}
+
+func Test_FastRejectWhileChoking_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+	p.PeerChoked = true
+
+	r := blockRequest{4, 0, 16 * 1024}
+	go p.HandleMessage(MsgRequest, r.serialize())
+	id, payload := readNext(t, other)
+	require.Equal(t, MsgRejectRequest, id)
+	require.Equal(t, r.serialize(), payload)
+	require.Empty(t, p.peerRequests)
+
+	// queued requests are rejected when we choke
+	p.PeerChoked = false
+	require.NoError(t, p.HandleMessage(MsgRequest, r.serialize()))
+	require.Len(t, p.peerRequests, 1)
+
+	go p.SendChoke()
+	id, _ = readNext(t, other)
+	require.Equal(t, MsgChoke, id)
+	id, payload = readNext(t, other)
+	require.Equal(t, MsgRejectRequest, id)
+	require.Equal(t, r.serialize(), payload)
+}
+
+func Test_FastCancel_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+	p.PeerChoked = false
+
+	r := blockRequest{4, 0, 16 * 1024}
+	require.NoError(t, p.HandleMessage(MsgRequest, r.serialize()))
+
+	go p.HandleMessage(MsgCancel, r.serialize())
+	id, payload := readNext(t, other)
+	require.Equal(t, MsgRejectRequest, id)
+	require.Equal(t, r.serialize(), payload)
+}
+
+func Test_FastSendAllowedFast_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+
+	go p.SendAllowedFast()
+	expected := AllowedFastSet(p.Addr.IP, p.torrent.InfoHash, 10, allowedFastCount)
+	for _, index := range expected {
+		id, payload := readNext(t, other)
+		require.Equal(t, MsgAllowedFast, id)
+		require.Equal(t, pieceIndexPayload(index), payload)
+	}
+
+	// granted pieces can be requested while choked
+	p.PeerChoked = true
+	require.NoError(t, p.HandleMessage(MsgRequest, blockRequest{expected[0], 0, 16 * 1024}.serialize()))
+	require.Len(t, p.peerRequests, 1)
+}
+
+func Test_RequestBounds_Err(t *testing.T) {
+	p, _ := fastPeer(t, true)
+	p.PeerChoked = false
+
+	for _, r := range []blockRequest{
+		{10, 0, 16 * 1024},
+		{1, 32 * 1024, 1},
+		{1, 16 * 1024, 16*1024 + 1},
+		{1, 0, 0},
+		{1, 0, maxRequestLength + 1},
+	} {
+		require.Error(t, p.HandleMessage(MsgRequest, r.serialize()), r)
+	}
+	require.Empty(t, p.peerRequests)
+}
+
+func Test_RequestQueueLimit_OK(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		p, other := fastPeer(t, fast)
+		p.PeerChoked = false
+
+		r := blockRequest{1, 0, 16 * 1024}
+		for range defaultMaxRequests {
+			require.NoError(t, p.HandleMessage(MsgRequest, r.serialize()))
+		}
+
+		// one past the reqq is rejected, or choked without the fast extension
+		go p.HandleMessage(MsgRequest, r.serialize())
+		id, _ := readNext(t, other)
+		if fast {
+			require.Equal(t, MsgRejectRequest, id)
+			require.Len(t, p.peerRequests, defaultMaxRequests)
+		} else {
+			require.Equal(t, MsgChoke, id)
+		}
+	}
+}
+
+func Test_FastBeforeMetadata_OK(t *testing.T) {
+	p, _ := fastPeer(t, true)
+	p.torrent = &bittorrent.Torrent{InfoHash: [20]byte{9}}
+
+	// a magnet can not check the index, it does not drop the peer
+	require.NoError(t, p.HandleMessage(MsgAllowedFast, pieceIndexPayload(3)))
+	require.NoError(t, p.HandleMessage(MsgHaveAll, nil))
+	require.Empty(t, p.AllowedFast)
+}
+
+func Test_ReadMessageTooLong_Err(t *testing.T) {
+	p, other := fastPeer(t, true)
+
+	go func() {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, 1<<31)
+		other.conn.Write(length)
+	}()
+
+	_, _, err := p.ReadMessage()
+	require.ErrorIs(t, err, ErrMessageTooLong)
+}
+
+func Test_ReadMessageLongBitfield_OK(t *testing.T) {
+	p, other := fastPeer(t, true)
+	p.torrent.PieceHashes = make([][]byte, 8*(1+maxRequestLength))
+
+	bitfield := make([]byte, 1+maxRequestLength)
+	go other.conn.Write(other.createMessage(MsgBitfield, bitfield))
+
+	id, payload, err := p.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, byte(MsgBitfield), id)
+	require.Len(t, payload, len(bitfield))
+}
+
+func Test_ParseHugeValues_Err(t *testing.T) {
+	huge := []byte{0xff, 0xff, 0xff, 0xff}
+
+	_, err := parsePieceIndex(huge, 10)
+	require.Error(t, err)
+	_, err = parsePieceIndex(pieceIndexPayload(0), 0)
+	require.Error(t, err)
+
+	for i := 0; i < 3; i++ {
+		payload := blockRequest{1, 0, 16 * 1024}.serialize()
+		copy(payload[i*4:], huge)
+		_, err := parseBlockRequest(payload)
+		require.Error(t, err, i)
+	}
+
+	r, err := parseBlockRequest(blockRequest{1, 16 * 1024, 16 * 1024}.serialize())
+	require.NoError(t, err)
+	require.Equal(t, blockRequest{1, 16 * 1024, 16 * 1024}, r)
+}
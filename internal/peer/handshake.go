@@ -3,15 +3,39 @@ package peer
 import (
 	"errors"
 	"fmt"
+	"io"
 )
 
 
 type Handshake struct {
 	Pstr	string
+	Reserved	Reserved
 	InfoHash	[20]byte
 	PeerId	[20]byte
 }
 
+// Reserved holds the eight reserved handshake bytes, where both sides
+// advertise the extensions they support.
+type Reserved [8]byte
+
+// ReservedBit numbers the reserved bits from the right, the way the BEPs do:
+// bit 20 is reserved[5] & 0x10.
+type ReservedBit int
+
+const (
+	BitDHT       ReservedBit = 0
+	BitFast      ReservedBit = 2
+	BitExtension ReservedBit = 20
+)
+
+func (r *Reserved) Set(bit ReservedBit) {
+	r[7-bit/8] |= 1 << (bit % 8)
+}
+
+func (r Reserved) Has(bit ReservedBit) bool {
+	return r[7-bit/8]&(1<<(bit%8)) != 0
+}
+
 var ErrHandshakeInvalidLen = errors.New("handshake does not have the proper length")
 var ErrPstrLenIsZero = errors.New("pstr length is 0")
 
@@ -20,7 +44,7 @@ func (h *Handshake) Serialize() []byte {
     buf[0] = byte(len(h.Pstr))
     curr := 1
     curr += copy(buf[curr:], h.Pstr)
-    curr += copy(buf[curr:], make([]byte, 8)) //reserved bytes
+    curr += copy(buf[curr:], h.Reserved[:])
     curr += copy(buf[curr:], h.InfoHash[:])
     curr += copy(buf[curr:], h.PeerId[:])
     return buf
@@ -46,7 +70,7 @@ func ReadHandshake(buf []byte) (*Handshake, error) {
     handshake.Pstr = string(buf[1 : 1+pstrLen])
     curr := 1 + pstrLen
 
-    //reserved 8 bytes i dont use it but it can be handy later
+    copy(handshake.Reserved[:], buf[curr:curr+8])
     curr += 8
 
     copy(handshake.InfoHash[:], buf[curr:curr+20])
@@ -57,3 +81,20 @@ func ReadHandshake(buf []byte) (*Handshake, error) {
 
     return &handshake, nil
 }
+
+// readHandshakeFrom reads one handshake, however long its pstr is.
+func readHandshakeFrom(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, 1, 49+255)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] == 0 {
+		return nil, ErrPstrLenIsZero
+	}
+
+	buf = buf[:49+int(buf[0])]
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	return ReadHandshake(buf)
+}
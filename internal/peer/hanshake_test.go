@@ -126,3 +126,17 @@ func Test_HandshakeSerializeThenRead_OK(t *testing.T) {
 		t.Errorf("PeerID mismatch")
 	}
 }
+
+func Test_HandshakeReserved_OK(t *testing.T) {
+	hs := Handshake{Pstr: "BitTorrent protocol"}
+	hs.Reserved.Set(BitExtension)
+	hs.Reserved.Set(BitFast)
+
+	require.Equal(t, Reserved{0, 0, 0, 0, 0, 0x10, 0, 0x04}, hs.Reserved)
+
+	parsed, err := ReadHandshake(hs.Serialize())
+	require.NoError(t, err)
+	require.True(t, parsed.Reserved.Has(BitExtension))
+	require.True(t, parsed.Reserved.Has(BitFast))
+	require.False(t, parsed.Reserved.Has(BitDHT))
+}
@@ -0,0 +1,313 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+)
+
+const (
+	DefaultMaxConns           = 200
+	DefaultMaxConnsPerTorrent = 50
+
+	// how long an incoming connection has to send its handshake
+	incomingHandshakeTimeout = 10 * time.Second
+	// wait after a failed accept, like running out of file descriptors
+	acceptRetryDelay = 100 * time.Millisecond
+)
+
+var (
+	ErrUnknownInfoHash = errors.New("no torrent with this infohash")
+	ErrSelfConnection  = errors.New("connection from our own peer id")
+	ErrTooManyConns    = errors.New("too many connections")
+)
+
+type ListenerConfig struct {
+	// Addr is the TCP address to accept peers on, like ":6881"
+	Addr string
+	// PeerID is ours, peers sending it are ourselves
+	PeerID [20]byte
+
+	// MaxConns limits the accepted connections, counting the ones still in
+	// the handshake, and MaxConnsPerTorrent the ones of each torrent. The
+	// defaults are used when zero.
+	MaxConns           int
+	MaxConnsPerTorrent int
+
+	// Torrent returns the torrent with infoHash, nil when we do not have it
+	Torrent func(infoHash [20]byte) *bittorrent.Torrent
+	// Pex returns the peer exchange of the torrent, nil disables it
+	Pex func(infoHash [20]byte) *Pex
+	// Extensions replaces DefaultExtensions for accepted peers when set
+	Extensions *ExtensionRegistry
+	// Handle gets every peer with its torrent once both handshakes are
+	// done, closing the peer frees its slot
+	Handle func(t *bittorrent.Torrent, p *Peer)
+}
+
+// Listener accepts incoming peer connections and hands each to the torrent
+// named in its handshake.
+type Listener struct {
+	cfg ListenerConfig
+	ln  net.Listener
+
+	mu         sync.Mutex
+	conns      int
+	perTorrent map[[20]byte]int
+	// connections still in the handshake, Close drops them
+	handshaking map[net.Conn]bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewListener listens on cfg.Addr and accepts peers in the background until
+// Close.
+func NewListener(cfg ListenerConfig) (*Listener, error) {
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultMaxConns
+	}
+	if cfg.MaxConnsPerTorrent <= 0 {
+		cfg.MaxConnsPerTorrent = DefaultMaxConnsPerTorrent
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		cfg:         cfg,
+		ln:          ln,
+		perTorrent:  make(map[[20]byte]int),
+		handshaking: make(map[net.Conn]bool),
+		done:        make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.serve()
+	}()
+
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Conns returns how many accepted connections are open.
+func (l *Listener) Conns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.conns
+}
+
+// Close stops accepting and drops the connections still in the handshake,
+// peers already handed over stay connected.
+func (l *Listener) Close() error {
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+
+	close(l.done)
+	err := l.ln.Close()
+
+	l.mu.Lock()
+	for conn := range l.handshaking {
+		conn.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			case <-time.After(acceptRetryDelay):
+				continue
+			}
+		}
+
+		// over the limit the connection is dropped before reading anything
+		if !l.reserve() {
+			conn.Close()
+			continue
+		}
+		if !l.startHandshake(conn) {
+			conn.Close()
+			l.release(nil)
+			return
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+
+			p, err := l.accept(conn)
+			l.endHandshake(conn)
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-l.done:
+				p.Close()
+			default:
+				l.cfg.Handle(p.torrent, p)
+			}
+		}()
+	}
+}
+
+// accept reads the handshake of conn, which holds one of the MaxConns slots,
+// and answers it when the torrent is ours and has room. The slot and conn
+// are freed on error.
+func (l *Listener) accept(conn net.Conn) (*Peer, error) {
+	var infoHash *[20]byte
+	fail := func(err error) (*Peer, error) {
+		conn.Close()
+		l.release(infoHash)
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(incomingHandshakeTimeout))
+
+	hs, err := readHandshakeFrom(conn)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read handshake: %w", err))
+	}
+	if hs.Pstr != "BitTorrent protocol" {
+		return fail(fmt.Errorf("unknown protocol %q", hs.Pstr))
+	}
+	if hs.PeerId == l.cfg.PeerID {
+		return fail(ErrSelfConnection)
+	}
+
+	torrent := l.cfg.Torrent(hs.InfoHash)
+	if torrent == nil {
+		return fail(ErrUnknownInfoHash)
+	}
+	if !l.reserveTorrent(hs.InfoHash) {
+		return fail(fmt.Errorf("%w for the torrent", ErrTooManyConns))
+	}
+	infoHash = &hs.InfoHash
+
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	p := NewPeer(addr, torrent, l.cfg.PeerID)
+	p.conn = conn
+	p.reserved = hs.Reserved
+	p.IsHandshakeReceived = true
+	if l.cfg.Pex != nil {
+		p.Pex = l.cfg.Pex(hs.InfoHash)
+	}
+	if l.cfg.Extensions != nil {
+		p.Extensions = l.cfg.Extensions
+	}
+
+	if err := p.sendHandshake(); err != nil {
+		return fail(fmt.Errorf("handshake failed: %w", err))
+	}
+	p.IsHandshakeSent = true
+
+	if err := p.start(); err != nil {
+		return fail(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	p.release = sync.OnceFunc(func() { l.release(infoHash) })
+
+	return p, nil
+}
+
+// Reserve takes the slots an accepted peer of its torrent would hold for p,
+// which we are about to dial, so both directions share MaxConns and
+// MaxConnsPerTorrent. Closing p, or Connect failing, frees them.
+func (l *Listener) Reserve(p *Peer) error {
+	if !l.reserve() {
+		return ErrTooManyConns
+	}
+	infoHash := [20]byte(p.torrent.InfoHash)
+	if !l.reserveTorrent(infoHash) {
+		l.release(nil)
+		return fmt.Errorf("%w for the torrent", ErrTooManyConns)
+	}
+
+	p.release = sync.OnceFunc(func() { l.release(&infoHash) })
+	return nil
+}
+
+// startHandshake records conn as in the handshake, false once the listener
+// is closed.
+func (l *Listener) startHandshake(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	l.handshaking[conn] = true
+	return true
+}
+
+func (l *Listener) endHandshake(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.handshaking, conn)
+}
+
+// reserve takes one of the MaxConns slots.
+func (l *Listener) reserve() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns >= l.cfg.MaxConns {
+		return false
+	}
+	l.conns++
+	return true
+}
+
+// reserveTorrent takes one of the slots of infoHash, on top of the one the
+// connection already holds.
+func (l *Listener) reserveTorrent(infoHash [20]byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perTorrent[infoHash] >= l.cfg.MaxConnsPerTorrent {
+		return false
+	}
+	l.perTorrent[infoHash]++
+	return true
+}
+
+// release frees the slot of a connection, and its torrent slot when it got
+// one.
+func (l *Listener) release(infoHash *[20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+	if infoHash == nil {
+		return
+	}
+	if l.perTorrent[*infoHash]--; l.perTorrent[*infoHash] <= 0 {
+		delete(l.perTorrent, *infoHash)
+	}
+}
@@ -0,0 +1,144 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestListener(t *testing.T, cfg ListenerConfig) (*Listener, chan *Peer) {
+	torrent := &bittorrent.Torrent{InfoHash: [20]byte{9}}
+	peers := make(chan *Peer, 4)
+
+	cfg.Addr = "127.0.0.1:0"
+	cfg.PeerID = [20]byte{'-', 'B', 'C'}
+	cfg.Torrent = func(infoHash [20]byte) *bittorrent.Torrent {
+		if infoHash == torrent.InfoHash {
+			return torrent
+		}
+		return nil
+	}
+	cfg.Handle = func(_ *bittorrent.Torrent, p *Peer) { peers <- p }
+
+	l, err := NewListener(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l, peers
+}
+
+// dialPeer connects to l and sends a handshake for infoHash from peerID.
+func dialPeer(t *testing.T, l *Listener, infoHash, peerID [20]byte) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	hs := Handshake{Pstr: "BitTorrent protocol", InfoHash: infoHash, PeerId: peerID}
+	_, err = conn.Write(hs.Serialize())
+	require.NoError(t, err)
+	return conn
+}
+
+func Test_ListenerAccept_OK(t *testing.T) {
+	l, peers := newTestListener(t, ListenerConfig{})
+
+	conn := dialPeer(t, l, [20]byte{9}, [20]byte{1})
+	reply, err := readHandshakeFrom(conn)
+	require.NoError(t, err)
+	require.Equal(t, [20]byte{9}, reply.InfoHash)
+	require.Equal(t, [20]byte{'-', 'B', 'C'}, reply.PeerId)
+
+	p := <-peers
+	require.Equal(t, conn.LocalAddr().String(), p.Addr.String())
+	require.True(t, p.IsHandshakeSent && p.IsHandshakeReceived)
+	require.Equal(t, 1, l.Conns())
+
+	// closing the peer frees its slot, twice does not free another
+	require.NoError(t, p.Close())
+	p.Close()
+	require.Equal(t, 0, l.Conns())
+}
+
+func Test_ListenerReject_Err(t *testing.T) {
+	l, _ := newTestListener(t, ListenerConfig{})
+
+	for _, tc := range []struct {
+		name     string
+		infoHash [20]byte
+		peerID   [20]byte
+		err      error
+	}{
+		{"unknown infohash", [20]byte{8}, [20]byte{1}, ErrUnknownInfoHash},
+		{"ourselves", [20]byte{9}, l.cfg.PeerID, ErrSelfConnection},
+	} {
+		local, remote := net.Pipe()
+		go func() {
+			hs := Handshake{Pstr: "BitTorrent protocol", InfoHash: tc.infoHash, PeerId: tc.peerID}
+			remote.Write(hs.Serialize())
+		}()
+
+		require.True(t, l.reserve())
+		_, err := l.accept(local)
+		require.ErrorIs(t, err, tc.err, tc.name)
+		require.Equal(t, 0, l.Conns(), tc.name)
+
+		// the connection is closed without an answer
+		_, err = remote.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF, tc.name)
+	}
+}
+
+func Test_ListenerLimits_Err(t *testing.T) {
+	l, peers := newTestListener(t, ListenerConfig{MaxConns: 2, MaxConnsPerTorrent: 1})
+
+	dialPeer(t, l, [20]byte{9}, [20]byte{1})
+	p := <-peers
+
+	// the torrent is full
+	conn := dialPeer(t, l, [20]byte{9}, [20]byte{2})
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// and so is the listener while a connection waits for its handshake
+	require.True(t, l.reserve())
+	conn = dialPeer(t, l, [20]byte{9}, [20]byte{3})
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err) // closed unread, it can be a reset
+	l.release(nil)
+
+	p.Close()
+	dialPeer(t, l, [20]byte{9}, [20]byte{4})
+	require.NotNil(t, <-peers)
+}
+
+func Test_ListenerCloseDuringHandshake_OK(t *testing.T) {
+	l, _ := newTestListener(t, ListenerConfig{})
+
+	// connected but silent, the listener waits for its handshake
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.handshaking) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		l.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(incomingHandshakeTimeout / 2):
+		t.Fatal("close waited for the handshake")
+	}
+
+	require.Equal(t, 0, l.Conns())
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
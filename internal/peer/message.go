@@ -2,9 +2,12 @@ package peer
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
+var ErrMessageTooLong = errors.New("message too long")
+
 type messageID byte
 
 const (
@@ -17,6 +20,15 @@ const (
     MsgRequest       messageID = 6
     MsgPiece         messageID = 7
     MsgCancel        messageID = 8
+
+    // Fast extension (BEP 6)
+    MsgSuggestPiece  messageID = 0x0D
+    MsgHaveAll       messageID = 0x0E
+    MsgHaveNone      messageID = 0x0F
+    MsgRejectRequest messageID = 0x10
+    MsgAllowedFast   messageID = 0x11
+
+    MsgExtended      messageID = 20 // BEP 10, first payload byte is the extended message id
 )
 
 // Message stores ID and payload of a message
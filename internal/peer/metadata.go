@@ -0,0 +1,349 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+)
+
+const (
+	MetadataPieceSize = 16 * 1024
+	// MaxMetadataSize caps what a peer can make us allocate with metadata_size
+	MaxMetadataSize = 32 * 1024 * 1024
+
+	// a piece requested from a peer that never answered is handed to another
+	// one after this long
+	metadataRequestTimeout = 30 * time.Second
+)
+
+const extMetadataName = "ut_metadata"
+
+// ut_metadata msg_type values
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+var (
+	ErrMetadataSize     = errors.New("invalid metadata size")
+	ErrMetadataHash     = errors.New("metadata does not match the info hash")
+	ErrMetadataComplete = errors.New("metadata already downloaded")
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// MetadataDownloader fetches the info dictionary of a torrent that was added
+// from a magnet link. One downloader is shared by every peer of the torrent,
+// so pieces are requested from whoever has them and are only fetched once.
+type MetadataDownloader struct {
+	mu sync.Mutex
+
+	// base only has the info hash and trackers
+	base *bittorrent.Torrent
+
+	size      int
+	pieces    [][]byte
+	requested []time.Time
+	received  int
+
+	torrent *bittorrent.Torrent
+	done    chan struct{}
+}
+
+func NewMetadataDownloader(base *bittorrent.Torrent) *MetadataDownloader {
+	return &MetadataDownloader{
+		base: base,
+		done: make(chan struct{}),
+	}
+}
+
+// SetSize is called with the metadata_size each peer reports. The first one
+// wins, peers that disagree with it are refused.
+func (d *MetadataDownloader) SetSize(size int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent != nil {
+		return nil
+	}
+
+	if size <= 0 || size > MaxMetadataSize {
+		return fmt.Errorf("%w: %d", ErrMetadataSize, size)
+	}
+
+	if d.size != 0 {
+		if d.size != size {
+			return fmt.Errorf("%w: peer reports %d, expected %d", ErrMetadataSize, size, d.size)
+		}
+		return nil
+	}
+
+	numPieces := (size + MetadataPieceSize - 1) / MetadataPieceSize
+	d.size = size
+	d.pieces = make([][]byte, numPieces)
+	d.requested = make([]time.Time, numPieces)
+	d.received = 0
+
+	return nil
+}
+
+// NextPiece picks a piece nobody has been asked for recently and marks it as
+// requested.
+func (d *MetadataDownloader) NextPiece() (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent != nil {
+		return 0, false
+	}
+
+	now := time.Now()
+	for i := range d.pieces {
+		if d.pieces[i] != nil {
+			continue
+		}
+		if !d.requested[i].IsZero() && now.Sub(d.requested[i]) < metadataRequestTimeout {
+			continue
+		}
+		d.requested[i] = now
+		return i, true
+	}
+
+	return 0, false
+}
+
+// Reject makes a piece available to be requested from another peer.
+func (d *MetadataDownloader) Reject(piece int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if piece >= 0 && piece < len(d.requested) {
+		d.requested[piece] = time.Time{}
+	}
+}
+
+// Receive stores a piece. Once every piece is in, the metadata is checked
+// against the info hash; on a mismatch everything is thrown away and
+// ErrMetadataHash is returned, since there is no way to tell which peer lied.
+func (d *MetadataDownloader) Receive(piece int, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrent != nil {
+		return ErrMetadataComplete
+	}
+
+	// left over from before a hash mismatch reset
+	if d.size == 0 {
+		return nil
+	}
+
+	if piece < 0 || piece >= len(d.pieces) {
+		return fmt.Errorf("metadata piece %d out of range", piece)
+	}
+
+	expected := MetadataPieceSize
+	if piece == len(d.pieces)-1 {
+		expected = d.size - piece*MetadataPieceSize
+	}
+	if len(data) != expected {
+		d.requested[piece] = time.Time{}
+		return fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), expected)
+	}
+
+	if d.pieces[piece] != nil {
+		return nil
+	}
+
+	d.pieces[piece] = bytes.Clone(data)
+	d.received++
+
+	if d.received < len(d.pieces) {
+		return nil
+	}
+
+	raw := bytes.Join(d.pieces, nil)
+
+	if sha1.Sum(raw) != d.base.InfoHash {
+		d.size = 0
+		d.pieces = nil
+		d.requested = nil
+		d.received = 0
+		return ErrMetadataHash
+	}
+
+	t, err := d.buildTorrent(raw)
+	if err != nil {
+		return err
+	}
+
+	d.torrent = t
+	close(d.done)
+
+	return nil
+}
+
+// buildTorrent puts the info dictionary and the trackers we already know into
+// a metainfo dictionary, so the torrent goes through the same NewTorrent as a
+// .torrent file.
+func (d *MetadataDownloader) buildTorrent(raw []byte) (*bittorrent.Torrent, error) {
+	info, err := bencode.NewDecoder(bytes.NewReader(raw)).Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	dic := map[string]any{
+		"announce": d.base.Announce,
+		"info":     info,
+	}
+
+	if len(d.base.AnnounceList) > 0 {
+		tiers := make([]any, len(d.base.AnnounceList))
+		for i, tier := range d.base.AnnounceList {
+			urls := make([]any, len(tier))
+			for j, url := range tier {
+				urls[j] = url
+			}
+			tiers[i] = urls
+		}
+		dic["announce-list"] = tiers
+	}
+
+	t, err := bittorrent.NewTorrent(dic, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	t.DownloadDir = d.base.DownloadDir
+
+	return t, nil
+}
+
+// Done is closed once the metadata is downloaded and verified.
+func (d *MetadataDownloader) Done() <-chan struct{} {
+	return d.done
+}
+
+// Torrent returns the complete torrent, or nil while still downloading.
+func (d *MetadataDownloader) Torrent() *bittorrent.Torrent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.torrent
+}
+
+// metadataExtension plugs ut_metadata into the extension registry.
+type metadataExtension struct{}
+
+func (metadataExtension) Handshake(p *Peer, hs *ExtendedHandshake) error {
+	if p.Metadata == nil || p.metadataSize == 0 {
+		return nil
+	}
+	if err := p.Metadata.SetSize(p.metadataSize); err != nil {
+		return err
+	}
+	return p.requestMetadata()
+}
+
+func (metadataExtension) HandleMessage(p *Peer, payload []byte) error {
+	return p.processMetadata(payload)
+}
+
+func (p *Peer) requestMetadata() error {
+	piece, ok := p.Metadata.NextPiece()
+	if !ok {
+		return nil
+	}
+
+	payload, err := bencode.Marshal(metadataMessage{MsgType: metadataRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+
+	if err := p.SendExtended(extMetadataName, payload); err != nil {
+		p.Metadata.Reject(piece)
+		return err
+	}
+
+	return nil
+}
+
+func (p *Peer) processMetadata(body []byte) error {
+	dec := bencode.NewDecoder(bytes.NewReader(body))
+
+	var msg metadataMessage
+	if err := dec.DecodeInto(&msg); err != nil {
+		return fmt.Errorf("invalid ut_metadata message: %w", err)
+	}
+
+	switch msg.MsgType {
+	case metadataRequest:
+		return p.serveMetadata(msg.Piece)
+
+	case metadataData:
+		if p.Metadata == nil {
+			return nil
+		}
+		// the piece data follows the dictionary
+		err := p.Metadata.Receive(msg.Piece, body[dec.InputOffset():])
+		switch {
+		case errors.Is(err, ErrMetadataComplete):
+			return nil
+		case errors.Is(err, ErrMetadataHash):
+			// start over, the size has to be agreed on again
+			if err := p.Metadata.SetSize(p.metadataSize); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+		return p.requestMetadata()
+
+	case metadataReject:
+		if p.Metadata != nil {
+			p.Metadata.Reject(msg.Piece)
+		}
+	}
+
+	return nil
+}
+
+// serveMetadata answers a request with the piece of our info dictionary, or
+// a reject while we do not have it ourselves.
+func (p *Peer) serveMetadata(piece int) error {
+	raw := p.torrent.InfoRaw
+	numPieces := (len(raw) + MetadataPieceSize - 1) / MetadataPieceSize
+
+	if piece < 0 || piece >= numPieces {
+		payload, err := bencode.Marshal(metadataMessage{MsgType: metadataReject, Piece: piece})
+		if err != nil {
+			return err
+		}
+		return p.SendExtended(extMetadataName, payload)
+	}
+
+	payload, err := bencode.Marshal(metadataMessage{
+		MsgType:   metadataData,
+		Piece:     piece,
+		TotalSize: len(raw),
+	})
+	if err != nil {
+		return err
+	}
+
+	start := piece * MetadataPieceSize
+	end := min(start+MetadataPieceSize, len(raw))
+
+	return p.SendExtended(extMetadataName, append(payload, raw[start:end]...))
+}
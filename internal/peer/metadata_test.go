@@ -0,0 +1,163 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// testInfo returns an info dictionary spanning more than one metadata piece.
+func testInfo(t *testing.T) []byte {
+	info := map[string]any{
+		"name":         "data.bin",
+		"length":       int64(1000 * 16 * 1024),
+		"piece length": int64(16 * 1024),
+		"pieces":       string(bytes.Repeat([]byte{0xab}, 1000*20)),
+	}
+	raw, err := bencode.Marshal(info)
+	require.NoError(t, err)
+	require.Greater(t, len(raw), MetadataPieceSize)
+	return raw
+}
+
+func magnetTorrent(raw []byte) *bittorrent.Torrent {
+	return &bittorrent.Torrent{
+		Announce:     "http://tracker/announce",
+		AnnounceList: [][]string{{"http://tracker/announce"}, {"udp://other:80"}},
+		InfoHash:     sha1.Sum(raw),
+	}
+}
+
+func Test_MetadataDownloaderMultiplePeers_OK(t *testing.T) {
+	raw := testInfo(t)
+	d := NewMetadataDownloader(magnetTorrent(raw))
+
+	require.NoError(t, d.SetSize(len(raw)))
+	require.Error(t, d.SetSize(len(raw)+1))
+
+	// two peers asking at the same time get different pieces
+	first, ok := d.NextPiece()
+	require.True(t, ok)
+	second, ok := d.NextPiece()
+	require.True(t, ok)
+	require.NotEqual(t, first, second)
+
+	_, ok = d.NextPiece()
+	require.False(t, ok)
+
+	// a rejected piece can be asked from someone else
+	d.Reject(first)
+	again, ok := d.NextPiece()
+	require.True(t, ok)
+	require.Equal(t, first, again)
+
+	require.NoError(t, d.Receive(1, raw[MetadataPieceSize:]))
+	require.Nil(t, d.Torrent())
+	require.NoError(t, d.Receive(0, raw[:MetadataPieceSize]))
+
+	select {
+	case <-d.Done():
+	default:
+		t.Fatal("Done was not closed")
+	}
+
+	torrent := d.Torrent()
+	require.NotNil(t, torrent)
+	require.Equal(t, "data.bin", torrent.Name)
+	require.Equal(t, sha1.Sum(raw), [20]byte(torrent.InfoHash))
+	require.Equal(t, raw, torrent.InfoRaw)
+	require.Equal(t, 1000, len(torrent.PieceHashes))
+	require.Len(t, torrent.AnnounceList, 2)
+
+	require.ErrorIs(t, d.Receive(0, raw[:MetadataPieceSize]), ErrMetadataComplete)
+}
+
+func Test_MetadataDownloaderHashMismatch_Err(t *testing.T) {
+	raw := testInfo(t)
+	d := NewMetadataDownloader(magnetTorrent(raw))
+	require.NoError(t, d.SetSize(len(raw)))
+
+	bad := bytes.Clone(raw)
+	bad[len(bad)-2] ^= 0xff
+
+	require.NoError(t, d.Receive(0, bad[:MetadataPieceSize]))
+	require.ErrorIs(t, d.Receive(1, bad[MetadataPieceSize:]), ErrMetadataHash)
+	require.Nil(t, d.Torrent())
+
+	// everything starts over
+	require.NoError(t, d.SetSize(len(raw)))
+	require.NoError(t, d.Receive(0, raw[:MetadataPieceSize]))
+	require.NoError(t, d.Receive(1, raw[MetadataPieceSize:]))
+	require.NotNil(t, d.Torrent())
+}
+
+func Test_MetadataDownloaderSize_Err(t *testing.T) {
+	d := NewMetadataDownloader(&bittorrent.Torrent{})
+
+	require.ErrorIs(t, d.SetSize(0), ErrMetadataSize)
+	require.ErrorIs(t, d.SetSize(MaxMetadataSize+1), ErrMetadataSize)
+
+	require.NoError(t, d.SetSize(MetadataPieceSize+10))
+	require.Error(t, d.Receive(1, make([]byte, 9)))
+	require.Error(t, d.Receive(2, make([]byte, 10)))
+}
+
+// runPeer handles messages until the connection is closed.
+func runPeer(p *Peer, errs chan<- error) {
+	for {
+		id, payload, err := p.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := p.HandleMessage(messageID(id), payload); err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+func Test_MetadataExchange_OK(t *testing.T) {
+	raw := testInfo(t)
+
+	seedTorrent := magnetTorrent(raw)
+	seedTorrent.InfoRaw = raw
+	seed := NewPeer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, seedTorrent, [20]byte{1})
+
+	magnet := magnetTorrent(raw)
+	leech := NewPeer(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6882}, magnet, [20]byte{2})
+	leech.Metadata = NewMetadataDownloader(magnet)
+
+	seed.conn, leech.conn = net.Pipe()
+	defer seed.conn.Close()
+	defer leech.conn.Close()
+
+	errs := make(chan error, 2)
+	go runPeer(seed, errs)
+	go runPeer(leech, errs)
+
+	go func() { errs <- seed.SendExtendedHandshake() }()
+	require.NoError(t, leech.SendExtendedHandshake())
+
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		select {
+		case <-leech.Metadata.Done():
+			break wait
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-timeout:
+			t.Fatal("metadata was not downloaded")
+		}
+	}
+
+	require.Equal(t, raw, leech.Metadata.Torrent().InfoRaw)
+	require.Equal(t, len(raw), leech.metadataSize)
+	require.True(t, seed.SupportsExtension(extMetadataName))
+}
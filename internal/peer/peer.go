@@ -3,7 +3,11 @@ package peer
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math/bits"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
@@ -12,8 +16,7 @@ import (
 const bufferSize = 4096 //  default buffer size for now
 
 type Peer struct {
-	Port     string
-	Address  string
+	Addr     *net.TCPAddr
 	Protocol string // tcp for BitTorrent (UDP is for tracker communication)
 	LocalId  [20]byte
 	torrent  *bittorrent.Torrent
@@ -42,13 +45,49 @@ type Peer struct {
 	Downloaded     int64
 
 	IsSeeder bool
+
+	// Extensions
+	Extensions     *ExtensionRegistry
+	reserved       Reserved
+	peerExtensions map[string]int // keyed by name with the ids the peer wants us to use
+	metadataSize   int
+
+	// from the extended handshake
+	ClientVersion string
+	MaxRequests   int    // reqq, how many requests the peer queues
+	ListenPort    int    // p, where the peer accepts connections
+	ExternalIP    net.IP // yourip, our address as the peer sees it
+	IPv6          net.IP // ipv6, where the peer is reachable over IPv6
+
+	// Pex is shared by all peers of the torrent, nil disables peer exchange
+	Pex             *Pex
+	pexSent         map[string]byte // what this peer was told is connected
+	lastPexSent     time.Time
+	lastPexReceived time.Time
+	outgoing        bool // we dialed the peer, so it accepts connections
+
+	// Fast extension
+	Suggested    []int        // pieces the peer suggested, oldest first
+	AllowedFast  map[int]bool // pieces we may request while choked
+	grantedFast  map[int]bool // pieces the peer may request while we choke it
+	peerRequests []blockRequest
+
+	// Metadata is set while the torrent was added from a magnet and has no
+	// info dictionary yet
+	Metadata *MetadataDownloader
+
+	// release frees the listener slot of an accepted peer, once
+	release func()
+
+	// held by Run while it handles a message, others acting on the peer
+	// take it to go in between
+	mu sync.Mutex
 }
 
-func NewPeer(address, port string, torrent *bittorrent.Torrent, localId [20]byte) *Peer {
+func NewPeer(addr *net.TCPAddr, torrent *bittorrent.Torrent, localId [20]byte) *Peer {
 	numPieces := len(torrent.IsPieceVerified)
 	return &Peer{
-		Address:         address,
-		Port:           port,
+		Addr:           addr,
 		Protocol:       "tcp",
 		LocalId:        localId,
 		torrent:        torrent,
@@ -57,17 +96,26 @@ func NewPeer(address, port string, torrent *bittorrent.Torrent, localId [20]byte
 		//HasPieces:      make([]bool, numPieces),
 		IsBlockRequested: make([][]bool, numPieces),
 		LastActive:     time.Now(),
+		Extensions:     DefaultExtensions,
+		MaxRequests:    peerDefaultMaxRequests,
 	}
 }
 
-func (p *Peer) Connect() error {
-	addr := net.JoinHostPort(p.Address, p.Port)
-	conn, err := net.DialTimeout(p.Protocol, addr, 10*time.Second)
+func (p *Peer) Connect() (err error) {
+	// a peer that could not connect is done with its listener slot
+	defer func() {
+		if err != nil && p.release != nil {
+			p.release()
+		}
+	}()
+
+	conn, err := net.DialTimeout(p.Protocol, p.Addr.String(), 10*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer %s:%s: %w", p.Address, p.Port, err)
+		return fmt.Errorf("failed to connect to peer %s: %w", p.Addr, err)
 	}
 	
 	p.conn = conn
+	p.outgoing = true
 	p.LastActive = time.Now()
 	
 	if err := p.sendHandshake(); err != nil {
@@ -82,40 +130,98 @@ func (p *Peer) Connect() error {
 	
 	p.IsHandshakeSent = true
 	p.IsHandshakeReceived = true
+
+	if err := p.start(); err != nil {
+		p.conn.Close()
+		return err
+	}
 	
 	return nil
 }
 
+// start sends what follows the handshakes, the same for connections we
+// dialed and ones we accepted.
+func (p *Peer) start() error {
+	if p.SupportsExtensionProtocol() {
+		if err := p.SendExtendedHandshake(); err != nil {
+			return fmt.Errorf("extended handshake failed: %w", err)
+		}
+	}
+
+	if p.SupportsFast() {
+		if err := p.SendAllowedFast(); err != nil {
+			return fmt.Errorf("allowed fast failed: %w", err)
+		}
+	}
+
+	if !p.Pex.Disabled() {
+		p.Pex.AddPeer(p.pexAddr(), p.PexFlags())
+	}
+
+	return nil
+}
+
+func (p *Peer) Close() error {
+	if !p.Pex.Disabled() {
+		p.Pex.DropPeer(p.pexAddr())
+	}
+	if p.release != nil {
+		p.release()
+	}
+
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
+
+// Disconnect drops the connection of a peer that is in Run, from another
+// goroutine. Run notices and closes the peer itself.
+func (p *Peer) Disconnect() error {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
+
+// Run handles the messages of the peer until the connection fails or the
+// peer breaks the protocol, then closes it.
+func (p *Peer) Run() error {
+	defer p.Close()
+
+	for {
+		msgType, payload, err := p.ReadMessage()
+		if err != nil {
+			return err
+		}
+		// keep-alives come back without a payload, a choke has an empty one
+		if payload == nil {
+			continue
+		}
+		p.mu.Lock()
+		err = p.HandleMessage(messageID(msgType), payload)
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (p *Peer) sendHandshake() error {
 	handshake := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: p.torrent.InfoHash, 
 		PeerId:   p.LocalId,
 	}
+	handshake.Reserved.Set(BitExtension)
+	handshake.Reserved.Set(BitFast)
 	
 	_, err := p.conn.Write(handshake.Serialize())
 	return err
 }
 
 func (p *Peer) readHandshakeResponse() error {
-	lengthBuf := make([]byte, 1)
-	if _, err := p.conn.Read(lengthBuf); err != nil {
-		return err
-	}
-	
-	pstrLen := int(lengthBuf[0])
-	if pstrLen == 0 {
-		return fmt.Errorf("invalid pstr length: 0")
-	}
-	
-	handshakeBuf := make([]byte, pstrLen+48)
-	if _, err := p.conn.Read(handshakeBuf); err != nil {
-		return err
-	}
-	
-	fullHandshake := append(lengthBuf, handshakeBuf...)
-	
-	handshake, err := ReadHandshake(fullHandshake)
+	handshake, err := readHandshakeFrom(p.conn)
 	if err != nil {
 		return err
 	}
@@ -125,6 +231,7 @@ func (p *Peer) readHandshakeResponse() error {
 	}
 	
 	p.LocalId = handshake.PeerId
+	p.reserved = handshake.Reserved
 	
 	return nil
 }
@@ -136,6 +243,16 @@ func (p *Peer) SendBitfield() error {
 	
 	bitfield := p.createBitfield()
 	message := p.createMessage(MsgBitfield, bitfield)
+
+	// fast peers get the one byte versions when we have all or nothing
+	if p.SupportsFast() {
+		switch countBits(bitfield) {
+		case p.numPieces():
+			message = p.createMessage(MsgHaveAll, nil)
+		case 0:
+			message = p.createMessage(MsgHaveNone, nil)
+		}
+	}
 	
 	_, err := p.conn.Write(message)
 	return err
@@ -212,6 +329,19 @@ func (p *Peer) createMessage(msgType messageID, payload []byte) []byte {
 	return message
 }
 
+// maxMessageLen is the longest message a peer may send, a block with its
+// header or our bitfield when that is longer.
+func (p *Peer) maxMessageLen() uint32 {
+	limit := 1 + 8 + maxRequestLength
+	if p.torrent == nil {
+		return uint32(limit)
+	}
+	if bitfield := 1 + (p.numPieces()+7)/8; bitfield > limit {
+		limit = bitfield
+	}
+	return uint32(limit)
+}
+
 func (p *Peer) ReadMessage() (byte, []byte, error) {
 	if p.conn == nil {
 		return 0, nil, fmt.Errorf("not connected")
@@ -219,7 +349,7 @@ func (p *Peer) ReadMessage() (byte, []byte, error) {
 	
 	// Read message length
 	lengthBuf := make([]byte, 4)
-	if _, err := p.conn.Read(lengthBuf); err != nil {
+	if _, err := io.ReadFull(p.conn, lengthBuf); err != nil {
 		return 0, nil, err
 	}
 	
@@ -231,9 +361,15 @@ func (p *Peer) ReadMessage() (byte, []byte, error) {
 		return 0, nil, nil // Special case for keep-alive
 	}
 	
+	// the length comes from the peer, it must not decide what we allocate
+	if messageLen > p.maxMessageLen() {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLong, messageLen)
+	}
+
 	// Read message
 	messageBuf := make([]byte, messageLen)
-	if _, err := p.conn.Read(messageBuf); err != nil {
+	// a single Read can return part of a large message, like a piece
+	if _, err := io.ReadFull(p.conn, messageBuf); err != nil {
 		return 0, nil, err
 	}
 	
@@ -247,9 +383,26 @@ func (p *Peer) ReadMessage() (byte, []byte, error) {
 
 // Process incoming messages
 func (p *Peer) HandleMessage(msgType messageID, payload []byte) error {
+	// a magnet has no pieces until its info dictionary arrives, what the
+	// peer says about them can not be checked and is ignored
+	if p.numPieces() == 0 {
+		switch msgType {
+		case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgExtended:
+		default:
+			return nil
+		}
+	}
+
 	switch msgType {
 	case MsgChoke:
 		p.AmChoked = true
+		// without the fast extension a choke drops every pending request,
+		// with it only rejects do
+		if !p.SupportsFast() {
+			for i := range p.IsBlockRequested {
+				p.IsBlockRequested[i] = nil
+			}
+		}
 	case MsgUnchoke:
 		p.AmChoked = false
 	case MsgInterested:
@@ -266,6 +419,18 @@ func (p *Peer) HandleMessage(msgType messageID, payload []byte) error {
 		return p.processPiece(payload)
 	case MsgCancel:
 		return p.processCancel(payload)
+	case MsgSuggestPiece:
+		return p.processSuggest(payload)
+	case MsgHaveAll:
+		return p.processHaveAll(true)
+	case MsgHaveNone:
+		return p.processHaveAll(false)
+	case MsgRejectRequest:
+		return p.processReject(payload)
+	case MsgAllowedFast:
+		return p.processAllowedFast(payload)
+	case MsgExtended:
+		return p.processExtended(payload)
 	}
 	
 	return nil
@@ -283,7 +448,33 @@ func (p *Peer) processHave(payload []byte) error {
 }
 
 func (p *Peer) processRequest(payload []byte) error {
-	// TODO: Implement request handling
+	r, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+	if !p.validRequest(r) {
+		return fmt.Errorf("invalid request for %d bytes at %d of piece %d", r.Length, r.Begin, r.Index)
+	}
+
+	if p.PeerChoked && !p.grantedFast[r.Index] {
+		// without the fast extension the peer knows a choke drops requests
+		if p.SupportsFast() {
+			return p.sendReject(r)
+		}
+		return nil
+	}
+
+	// past the reqq we advertised the request is refused, without the fast
+	// extension the only way to say so is a choke
+	if len(p.peerRequests) >= defaultMaxRequests {
+		if p.SupportsFast() {
+			return p.sendReject(r)
+		}
+		return p.SendChoke()
+	}
+
+	// queued until the upload side serves it
+	p.peerRequests = append(p.peerRequests, r)
 	return nil
 }
 
@@ -293,7 +484,21 @@ func (p *Peer) processPiece(payload []byte) error {
 }
 
 func (p *Peer) processCancel(payload []byte) error {
-	// TODO: Implement cancel handling
+	r, err := parseBlockRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	i := slices.Index(p.peerRequests, r)
+	if i == -1 {
+		return nil
+	}
+	p.peerRequests = slices.Delete(p.peerRequests, i, i+1)
+
+	// fast peers expect every request to end in a piece or a reject
+	if p.SupportsFast() {
+		return p.sendReject(r)
+	}
 	return nil
 }
 
@@ -301,4 +506,12 @@ func (p *Peer) processCancel(payload []byte) error {
 
 func (p *Peer) HasPiece(pieceIndex int) bool {
 	return false
-}
\ No newline at end of file
+}
+
+func countBits(bitfield []byte) int {
+	n := 0
+	for _, b := range bitfield {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
@@ -0,0 +1,366 @@
+package peer
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+)
+
+const extPexName = "ut_pex"
+
+// flags sent for every added peer (BEP 11)
+const (
+	PexEncryption byte = 0x01
+	PexSeed       byte = 0x02
+	PexUTP        byte = 0x04
+	PexHolepunch  byte = 0x08
+	PexReachable  byte = 0x10
+)
+
+const (
+	// BEP 11 asks for at most one message a minute per peer
+	PexInterval = time.Minute
+	// messages from a peer closer together than this are ignored, a bit
+	// under PexInterval so timer jitter does not drop honest ones
+	pexMinReceiveInterval = 45 * time.Second
+	// added and dropped are each capped to this many peers per message
+	maxPexPeers = 50
+	// how many delivered addresses are remembered to skip repeats
+	maxPexSeen = 2000
+	// how often Run looks for peers due a round
+	pexCheckInterval = time.Second
+)
+
+type pexMessage struct {
+	Added    []byte `bencode:"added"`
+	AddedF   []byte `bencode:"added.f"`
+	Added6   []byte `bencode:"added6,omitempty"`
+	Added6F  []byte `bencode:"added6.f,omitempty"`
+	Dropped  []byte `bencode:"dropped"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// Pex is the peer exchange state of one torrent. It knows the peers we are
+// connected to, which get sent to everyone else, and delivers the peers
+// learned from others on UpdatePeers, the same way the DHT does.
+type Pex struct {
+	mu        sync.Mutex
+	disabled  bool
+	connected map[string]byte // address -> flags
+	seen      map[string]bool
+
+	UpdatePeers chan<- []net.Addr
+}
+
+// NewPex returns the exchange for torrent. Private torrents must only get
+// peers from their trackers (BEP 27), so for them it is disabled and ut_pex
+// is left out of the handshake.
+func NewPex(torrent *bittorrent.Torrent, updates chan<- []net.Addr) *Pex {
+	return &Pex{
+		disabled:    torrent.IsPrivate,
+		connected:   make(map[string]byte),
+		seen:        make(map[string]bool),
+		UpdatePeers: updates,
+	}
+}
+
+func (x *Pex) Disabled() bool {
+	return x == nil || x.disabled
+}
+
+// AddPeer marks a peer as connected, it is sent as added on the next round.
+func (x *Pex) AddPeer(addr string, flags byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.connected[addr] = flags
+	x.seen[addr] = true
+}
+
+// DropPeer marks a peer as disconnected, it is sent as dropped to the peers
+// that were told about it.
+func (x *Pex) DropPeer(addr string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.connected, addr)
+}
+
+// movePeer changes the address of a connected peer, when it is one.
+func (x *Pex) movePeer(from, to string, flags byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := x.connected[from]; !ok {
+		return
+	}
+	delete(x.connected, from)
+	x.connected[to] = flags
+	x.seen[to] = true
+}
+
+func (x *Pex) snapshot() map[string]byte {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	peers := make(map[string]byte, len(x.connected))
+	for addr, flags := range x.connected {
+		peers[addr] = flags
+	}
+	return peers
+}
+
+// deliver passes on the peers we did not know about yet. The send does not
+// block, a read loop must never wait on whoever consumes the pool.
+func (x *Pex) deliver(addrs []*net.TCPAddr) {
+	x.mu.Lock()
+	var fresh []net.Addr
+	for _, addr := range addrs {
+		key := addr.String()
+		if x.seen[key] {
+			continue
+		}
+		if len(x.seen) >= maxPexSeen {
+			// forget everything rather than track age, repeats are harmless
+			x.seen = make(map[string]bool)
+		}
+		x.seen[key] = true
+		fresh = append(fresh, addr)
+	}
+	x.mu.Unlock()
+
+	if len(fresh) == 0 || x.UpdatePeers == nil {
+		return
+	}
+
+	select {
+	case x.UpdatePeers <- fresh:
+	default:
+	}
+}
+
+// Run sends a pex round to every peer returned by peers each PexInterval,
+// until stop is closed. Peers are checked more often than that so a new one
+// gets its first round right away.
+func (x *Pex) Run(peers func() []*Peer, stop <-chan struct{}) {
+	if x.Disabled() {
+		return
+	}
+
+	ticker := time.NewTicker(pexCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, p := range peers() {
+				// between two messages of the read loop
+				p.mu.Lock()
+				p.SendPex()
+				p.mu.Unlock()
+			}
+		}
+	}
+}
+
+// PexFlags describes the peer for others. Peers we connected to, or that
+// told us their listen port, can accept connections.
+func (p *Peer) PexFlags() byte {
+	var flags byte
+	if p.IsSeeder {
+		flags |= PexSeed
+	}
+	if p.outgoing || p.ListenPort != 0 {
+		flags |= PexReachable
+	}
+	return flags
+}
+
+// setListenPort records where the peer accepts connections. An accepted peer
+// was exchanged at the port it connected from until now.
+func (p *Peer) setListenPort(port int) {
+	from := p.pexAddr()
+	p.ListenPort = port
+	if !p.Pex.Disabled() {
+		p.Pex.movePeer(from, p.pexAddr(), p.PexFlags())
+	}
+}
+
+// pexAddr is the address other peers should connect to.
+func (p *Peer) pexAddr() string {
+	addr := *p.Addr
+	if !p.outgoing && p.ListenPort != 0 {
+		addr.Port = p.ListenPort
+	}
+	return addr.String()
+}
+
+// SendPex sends the peers that connected or dropped since the last message
+// to this peer. It does nothing if the peer does not support ut_pex or was
+// sent one less than PexInterval ago.
+func (p *Peer) SendPex() error {
+	if p.Pex.Disabled() || !p.SupportsExtension(extPexName) {
+		return nil
+	}
+	if !p.lastPexSent.IsZero() && time.Since(p.lastPexSent) < PexInterval {
+		return nil
+	}
+
+	current := p.Pex.snapshot()
+	delete(current, p.pexAddr())
+
+	if p.pexSent == nil {
+		p.pexSent = make(map[string]byte)
+	}
+
+	var added, dropped []string
+	for addr := range current {
+		if _, ok := p.pexSent[addr]; !ok && len(added) < maxPexPeers {
+			added = append(added, addr)
+		}
+	}
+	for addr := range p.pexSent {
+		if _, ok := current[addr]; !ok && len(dropped) < maxPexPeers {
+			dropped = append(dropped, addr)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	msg := pexMessage{Added: []byte{}, AddedF: []byte{}, Dropped: []byte{}}
+	for _, addr := range added {
+		ip, port, ok := splitAddr(addr)
+		if !ok {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.Added = appendCompact(msg.Added, ip4, port)
+			msg.AddedF = append(msg.AddedF, current[addr])
+		} else {
+			msg.Added6 = appendCompact(msg.Added6, ip, port)
+			msg.Added6F = append(msg.Added6F, current[addr])
+		}
+	}
+	for _, addr := range dropped {
+		ip, port, ok := splitAddr(addr)
+		if !ok {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.Dropped = appendCompact(msg.Dropped, ip4, port)
+		} else {
+			msg.Dropped6 = appendCompact(msg.Dropped6, ip, port)
+		}
+	}
+
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := p.SendExtended(extPexName, payload); err != nil {
+		return err
+	}
+
+	for _, addr := range added {
+		p.pexSent[addr] = current[addr]
+	}
+	for _, addr := range dropped {
+		delete(p.pexSent, addr)
+	}
+	p.lastPexSent = time.Now()
+
+	return nil
+}
+
+func (p *Peer) processPex(payload []byte) error {
+	if p.Pex.Disabled() {
+		return nil
+	}
+
+	// a peer flooding us with messages gets ignored until it slows down
+	now := time.Now()
+	if !p.lastPexReceived.IsZero() && now.Sub(p.lastPexReceived) < pexMinReceiveInterval {
+		return nil
+	}
+	p.lastPexReceived = now
+
+	var msg pexMessage
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		// a broken pex message is not worth dropping the connection for
+		return nil
+	}
+
+	addrs := parseCompact(msg.Added, net.IPv4len)
+	addrs = append(addrs, parseCompact(msg.Added6, net.IPv6len)...)
+	if len(addrs) > maxPexPeers {
+		addrs = addrs[:maxPexPeers]
+	}
+
+	p.Pex.deliver(addrs)
+
+	return nil
+}
+
+// pexExtension plugs ut_pex into the extension registry.
+type pexExtension struct{}
+
+func (pexExtension) Enabled(p *Peer) bool {
+	return !p.torrent.IsPrivate && !p.Pex.Disabled()
+}
+
+func (pexExtension) Handshake(p *Peer, hs *ExtendedHandshake) error {
+	return nil
+}
+
+func (pexExtension) HandleMessage(p *Peer, payload []byte) error {
+	return p.processPex(payload)
+}
+
+// splitAddr parses host:port, only literal addresses can be sent in compact
+// form.
+func splitAddr(addr string) (net.IP, int, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, 0, false
+	}
+	return ip, port, true
+}
+
+func appendCompact(buf []byte, ip net.IP, port int) []byte {
+	buf = append(buf, ip...)
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// parseCompact reads ip:port entries of ipLen+2 bytes, a trailing partial
+// entry is ignored.
+func parseCompact(buf []byte, ipLen int) []*net.TCPAddr {
+	size := ipLen + 2
+	addrs := make([]*net.TCPAddr, 0, len(buf)/size)
+
+	for i := 0; i+size <= len(buf); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, buf[i:i+ipLen])
+		port := int(binary.BigEndian.Uint16(buf[i+ipLen : i+size]))
+		if port == 0 {
+			continue
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+	}
+
+	return addrs
+}
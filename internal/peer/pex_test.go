@@ -0,0 +1,143 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/stretchr/testify/require"
+)
+
+// pexPeer returns a peer of torrent with the other end of its connection,
+// after a handshake that lists ut_pex with id 5.
+func pexPeer(t *testing.T, torrent *bittorrent.Torrent, pex *Pex) (*Peer, net.Conn) {
+	p := NewPeer(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 6881}, torrent, [20]byte{})
+	p.Pex = pex
+
+	hs, err := bencode.Marshal(ExtendedHandshake{M: map[string]int{extPexName: 5}})
+	require.NoError(t, err)
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{extHandshakeID}, hs...)))
+
+	local, remote := net.Pipe()
+	p.conn = local
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	return p, remote
+}
+
+func readPex(t *testing.T, conn net.Conn) pexMessage {
+	other := &Peer{conn: conn}
+	id, payload, err := other.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, byte(MsgExtended), id)
+	require.Equal(t, byte(5), payload[0])
+
+	var msg pexMessage
+	require.NoError(t, bencode.Unmarshal(payload[1:], &msg))
+	return msg
+}
+
+func Test_PexSend_OK(t *testing.T) {
+	pex := NewPex(&bittorrent.Torrent{}, nil)
+	pex.AddPeer("10.0.0.1:6881", PexSeed|PexReachable)
+	pex.AddPeer("[2001:db8::1]:51413", 0)
+	pex.AddPeer("10.0.0.9:6881", 0) // the receiver itself
+
+	p, remote := pexPeer(t, &bittorrent.Torrent{}, pex)
+
+	errs := make(chan error, 1)
+	go func() { errs <- p.SendPex() }()
+	msg := readPex(t, remote)
+	require.NoError(t, <-errs)
+
+	require.Equal(t, []byte{10, 0, 0, 1, 0x1a, 0xe1}, msg.Added)
+	require.Equal(t, []byte{PexSeed | PexReachable}, msg.AddedF)
+	require.Len(t, msg.Added6, 18)
+	require.Equal(t, []byte{0}, msg.Added6F)
+	require.Empty(t, msg.Dropped)
+
+	// nothing is sent again before PexInterval
+	require.NoError(t, p.SendPex())
+
+	// the next round only has the difference
+	pex.DropPeer("10.0.0.1:6881")
+	pex.AddPeer("10.0.0.2:6882", 0)
+	p.lastPexSent = p.lastPexSent.Add(-PexInterval)
+
+	go func() { errs <- p.SendPex() }()
+	msg = readPex(t, remote)
+	require.NoError(t, <-errs)
+
+	require.Equal(t, []byte{10, 0, 0, 2, 0x1a, 0xe2}, msg.Added)
+	require.Equal(t, []byte{10, 0, 0, 1, 0x1a, 0xe1}, msg.Dropped)
+	require.Empty(t, msg.Added6)
+}
+
+func Test_PexReceive_OK(t *testing.T) {
+	updates := make(chan []net.Addr, 1)
+	pex := NewPex(&bittorrent.Torrent{}, updates)
+	pex.AddPeer("10.0.0.1:6881", 0) // already connected, not delivered again
+
+	p, _ := pexPeer(t, &bittorrent.Torrent{}, pex)
+
+	var added []byte
+	for i := 1; i <= maxPexPeers+10; i++ {
+		added = appendCompact(added, net.IPv4(10, 0, 1, byte(i)).To4(), 6881)
+	}
+	added = appendCompact(added, net.IPv4(10, 0, 0, 1).To4(), 6881)
+
+	payload, err := bencode.Marshal(pexMessage{
+		Added:  added,
+		Added6: appendCompact(nil, net.ParseIP("2001:db8::2"), 6881),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{DefaultExtensions.ID(extPexName)}, payload...)))
+
+	peers := <-updates
+	require.Len(t, peers, maxPexPeers)
+	require.Equal(t, "10.0.1.1:6881", peers[0].String())
+
+	// a second message right away is ignored
+	payload, err = bencode.Marshal(pexMessage{Added: appendCompact(nil, net.IPv4(10, 0, 2, 1).To4(), 6881)})
+	require.NoError(t, err)
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{DefaultExtensions.ID(extPexName)}, payload...)))
+	require.Len(t, updates, 0)
+}
+
+func Test_PexPrivate_OK(t *testing.T) {
+	private := &bittorrent.Torrent{IsPrivate: true}
+	updates := make(chan []net.Addr, 1)
+	pex := NewPex(private, updates)
+	require.True(t, pex.Disabled())
+
+	p, _ := pexPeer(t, private, pex)
+
+	// ut_pex is not offered to peers of private torrents
+	_, ok := DefaultExtensions.m(p)[extPexName]
+	require.False(t, ok)
+
+	payload, err := bencode.Marshal(pexMessage{Added: appendCompact(nil, net.IPv4(10, 0, 2, 1).To4(), 6881)})
+	require.NoError(t, err)
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{DefaultExtensions.ID(extPexName)}, payload...)))
+	require.Len(t, updates, 0)
+
+	require.NoError(t, p.SendPex())
+}
+
+func Test_PexListenPort_OK(t *testing.T) {
+	pex := NewPex(&bittorrent.Torrent{}, nil)
+	p := NewPeer(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 40000}, &bittorrent.Torrent{}, [20]byte{})
+	p.Pex = pex
+	pex.AddPeer(p.pexAddr(), p.PexFlags())
+
+	// an accepted peer is exchanged where it listens once it says so
+	hs, err := bencode.Marshal(ExtendedHandshake{Port: 6881})
+	require.NoError(t, err)
+	require.NoError(t, p.HandleMessage(MsgExtended, append([]byte{extHandshakeID}, hs...)))
+	require.Equal(t, map[string]byte{"10.0.0.9:6881": PexReachable}, pex.snapshot())
+}
@@ -1,72 +1,650 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
-	bt "github.com/dmsosa6/bittorrent-client/internal/bittorrent"
+	bt "github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/dmsRosa6/bittorrent-client/internal/dht"
+	"github.com/dmsRosa6/bittorrent-client/internal/lsd"
+	"github.com/dmsRosa6/bittorrent-client/internal/peer"
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
 )
 
-// TODO have a way to save the session state so u can return to downloads
+// how often the DHT is asked for peers of each torrent
+const dhtLookupInterval = 15 * time.Minute
+
+// how often each torrent is checked for completion and announced again to
+// the DHT and local discovery, which throttle it further
+const torrentTick = 30 * time.Second
+
+// how long Close waits for the trackers to hear we stopped
+const stopTimeout = 10 * time.Second
+
+// Session holds the torrents and everything that finds and connects their
+// peers. It is saved to StatePath on Close and restored with Load.
 type Session struct {
 	Torrents    map[bt.InfoHash]*bt.Torrent
 	CurrTorrent *bt.Torrent
+	ListenPort  int
+	PeerID      bt.PeerID
+
+	// StatePath is where Close saves the session, empty to not save it
+	StatePath string
+
+	// Extensions are offered to every peer. StartListener sets the port
+	// they advertise, and our global IPv6 address unless one is set.
+	Extensions *peer.ExtensionRegistry
+
+	// Listener accepts peers on ListenPort, limited to MaxConns at once and
+	// MaxConnsPerTorrent for each torrent, the peer defaults when zero
+	Listener           *peer.Listener
+	MaxConns           int
+	MaxConnsPerTorrent int
+	// guards Torrents, CurrTorrent, DHT, LSD and the maps below against the
+	// listener, the peer goroutines and the one of each torrent
+	mu sync.Mutex
+
+	// connected peers of each torrent, by address, and the ones being dialed
+	peers   map[bt.InfoHash]map[string]*peer.Peer
+	dialing map[bt.InfoHash]map[string]bool
+
+	DHT        *dht.Node
+	dhtState   *dht.State
+	dhtLookups map[bt.InfoHash]time.Time
+
+	LSD *lsd.Service
+
+	// peers found for each torrent, from any source
+	peerUpdates map[bt.InfoHash]chan []net.Addr
+
+	schedulers map[bt.InfoHash]*tracker.Scheduler
+	seeding    map[bt.InfoHash]bool
+
+	// info dictionaries being fetched for torrents added from magnets, and
+	// the pieces they had verified when they were saved
+	metadata map[bt.InfoHash]*peer.MetadataDownloader
+	restored map[bt.InfoHash][]bool
+	// peer exchange of each torrent, disabled for private ones
+	pex map[bt.InfoHash]*peer.Pex
+
+	// closed by Close, stops the goroutine of every torrent
+	done chan struct{}
 }
 
 func NewSession() *Session {
 	return &Session{
-		Torrents: make(map[bt.InfoHash]*bt.Torrent),
+		Torrents:    make(map[bt.InfoHash]*bt.Torrent),
+		peers:       make(map[bt.InfoHash]map[string]*peer.Peer),
+		dialing:     make(map[bt.InfoHash]map[string]bool),
+		dhtLookups:  make(map[bt.InfoHash]time.Time),
+		peerUpdates: make(map[bt.InfoHash]chan []net.Addr),
+		schedulers:  make(map[bt.InfoHash]*tracker.Scheduler),
+		seeding:     make(map[bt.InfoHash]bool),
+		metadata:    make(map[bt.InfoHash]*peer.MetadataDownloader),
+		restored:    make(map[bt.InfoHash][]bool),
+		pex:         make(map[bt.InfoHash]*peer.Pex),
+		done:        make(chan struct{}),
+		Extensions:  peer.NewDefaultExtensions(),
+		PeerID:      bt.NewPeerID(),
+	}
+}
+
+// StartDHT joins the DHT on the UDP address addr, reusing the routing table
+// of the last saved session when there is one.
+func (s *Session) StartDHT(addr string) error {
+	node, err := dht.New(dht.Config{Addr: addr, State: s.dhtState})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.DHT = node
+	s.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		node.Bootstrap(ctx)
+	}()
+	return nil
+}
+
+// StartLSD announces our torrents on the local network and listens for the
+// announcements of other clients.
+func (s *Session) StartLSD() error {
+	service, err := lsd.New(lsd.Config{Port: s.ListenPort})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.LSD = service
+	s.mu.Unlock()
+	return nil
+}
+
+// StartListener accepts connections from peers of our torrents on
+// ListenPort, over IPv4 and IPv6.
+func (s *Session) StartListener() error {
+	ln, err := peer.NewListener(peer.ListenerConfig{
+		Addr:               net.JoinHostPort("", strconv.Itoa(s.ListenPort)),
+		PeerID:             s.PeerID,
+		MaxConns:           s.MaxConns,
+		MaxConnsPerTorrent: s.MaxConnsPerTorrent,
+		Torrent:            s.torrent,
+		Pex:                s.torrentPex,
+		Extensions:         s.Extensions,
+		Handle:             s.addPeer,
+	})
+	if err != nil {
+		return err
+	}
+	s.Listener = ln
+
+	// with port 0 the system picked one, peers and trackers need the real one
+	s.ListenPort = ln.Addr().(*net.TCPAddr).Port
+	s.Extensions.ListenPort = s.ListenPort
+	if s.Extensions.IPv6 == nil {
+		s.Extensions.IPv6 = globalIPv6()
+	}
+	return nil
+}
+
+func (s *Session) torrent(infoHash [20]byte) *bt.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Torrents[infoHash]
+}
+
+func (s *Session) torrentPex(infoHash [20]byte) *peer.Pex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pex[infoHash]
+}
+
+// addPeer adds an accepted peer to the swarm of t, unless it is already
+// connected, and handles its messages until it disconnects.
+func (s *Session) addPeer(t *bt.Torrent, p *peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := p.Addr.String()
+	if _, ok := s.peers[t.InfoHash][key]; ok {
+		p.Close()
+		return
+	}
+	if s.peers[t.InfoHash] == nil {
+		s.peers[t.InfoHash] = make(map[string]*peer.Peer)
+	}
+	s.peers[t.InfoHash][key] = p
+	// set before the peer sends its extended handshake, which starts the
+	// requests
+	p.Metadata = s.metadata[t.InfoHash]
+
+	go s.runPeer(t, p)
+}
+
+// runPeer runs p until it disconnects, which closes it and frees its
+// listener slot, and then drops it from the swarm of t.
+func (s *Session) runPeer(t *bt.Torrent, p *peer.Peer) {
+	p.Run()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := p.Addr.String()
+	if s.peers[t.InfoHash][key] == p {
+		delete(s.peers[t.InfoHash], key)
+	}
+}
+
+// Peers returns the connected peers of t.
+func (s *Session) Peers(t *bt.Torrent) []*peer.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*peer.Peer, 0, len(s.peers[t.InfoHash]))
+	for _, p := range s.peers[t.InfoHash] {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// dial connects to the peers of t in addrs that are neither connected nor
+// being dialed, up to MaxConnsPerTorrent and as long as the listener has
+// room. s.mu is held.
+func (s *Session) dial(t *bt.Torrent, addrs []net.Addr) {
+	limit := s.MaxConnsPerTorrent
+	if limit <= 0 {
+		limit = peer.DefaultMaxConnsPerTorrent
+	}
+
+	if s.dialing[t.InfoHash] == nil {
+		s.dialing[t.InfoHash] = make(map[string]bool)
+	}
+	dialing := s.dialing[t.InfoHash]
+
+	for _, addr := range addrs {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || len(s.peers[t.InfoHash])+len(dialing) >= limit {
+			continue
+		}
+		key := tcpAddr.String()
+		if _, ok := s.peers[t.InfoHash][key]; ok || dialing[key] {
+			continue
+		}
+
+		p := peer.NewPeer(tcpAddr, t, s.PeerID)
+		p.Extensions = s.Extensions
+		p.Pex = s.pex[t.InfoHash]
+		// dialed peers count against the limits of the listener too
+		if s.Listener != nil && s.Listener.Reserve(p) != nil {
+			return
+		}
+		dialing[key] = true
+
+		go func() {
+			err := p.Connect()
+
+			s.mu.Lock()
+			delete(dialing, key)
+			s.mu.Unlock()
+
+			if err == nil {
+				s.addPeer(t, p)
+			}
+		}()
 	}
 }
 
+// lookupDHT looks for peers of t in the DHT and announces us. Peers go to
+// updates, the same way they come from LSD. s.mu is held.
+func (s *Session) lookupDHT(t *bt.Torrent, updates chan<- []net.Addr) {
+	if s.DHT == nil || time.Since(s.dhtLookups[t.InfoHash]) < dhtLookupInterval {
+		return
+	}
+	s.dhtLookups[t.InfoHash] = time.Now()
+
+	node := s.DHT
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		node.LookupPeers(ctx, dht.NodeID(t.InfoHash), s.ListenPort, updates)
+	}()
+}
+
+// PeerUpdates returns the channel trackers, DHT, LSD and PEX deliver the
+// peers of t on.
+func (s *Session) PeerUpdates(t *bt.Torrent) chan []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.updates(t)
+}
+
+func (s *Session) updates(t *bt.Torrent) chan []net.Addr {
+	updates, ok := s.peerUpdates[t.InfoHash]
+	if !ok {
+		updates = make(chan []net.Addr, 16)
+		s.peerUpdates[t.InfoHash] = updates
+	}
+	return updates
+}
+
+// announce starts announcing t to its trackers the first time, and sends
+// completed when it turns to seeding. s.mu is held.
+func (s *Session) announce(t *bt.Torrent) {
+	sched, ok := s.schedulers[t.InfoHash]
+	if !ok {
+		if t.Trackers == nil || t.Trackers.Len() == 0 {
+			return
+		}
+		infoHash := t.InfoHash
+		sched = tracker.NewScheduler(t.Trackers, func(ev tracker.TrackerEvent) tracker.AnnounceRequest {
+			// a magnet is swapped for the full torrent once it has its info
+			req := s.torrent(infoHash).AnnounceRequest(s.PeerID, s.ListenPort, ev)
+			req.IPv6 = globalIPv6()
+			return req
+		}, s.updates(t))
+		s.schedulers[t.InfoHash] = sched
+		s.seeding[t.InfoHash] = t.IsSeeding
+		sched.Start()
+		return
+	}
+
+	if t.IsSeeding && !s.seeding[t.InfoHash] {
+		sched.Completed()
+	}
+	s.seeding[t.InfoHash] = t.IsSeeding
+}
+
+// globalIPv6 returns a global IPv6 address of this host, nil when there is
+// none. Trackers reached over IPv4 pass it on to IPv6 peers.
+func globalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() && !ipnet.IP.IsPrivate() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// Reannounce asks the trackers of t for peers now, or as soon as they allow.
+func (s *Session) Reannounce(t *bt.Torrent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, ok := s.schedulers[t.InfoHash]
+	if !ok {
+		return errors.New("torrent is not being announced")
+	}
+	sched.Reannounce()
+	return nil
+}
+
+// NextAnnounce returns when t is announced next, and why the last announce
+// failed if it did.
+func (s *Session) NextAnnounce(t *bt.Torrent) (time.Time, error) {
+	s.mu.Lock()
+	sched, ok := s.schedulers[t.InfoHash]
+	s.mu.Unlock()
+
+	if !ok {
+		return time.Time{}, errors.New("torrent is not being announced")
+	}
+	return sched.NextAnnounce()
+}
+
+// Close stops accepting peers, tells the trackers of every torrent that we
+// stopped, waiting at most stopTimeout, and leaves the DHT and local
+// discovery.
+func (s *Session) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+
+	var errs []error
+	if s.StatePath != "" {
+		// before the DHT closes, its routing table goes in too
+		if err := s.Save(s.StatePath); err != nil {
+			errs = append(errs, fmt.Errorf("saving the session: %w", err))
+		}
+	}
+
+	s.mu.Lock()
+	schedulers := make([]*tracker.Scheduler, 0, len(s.schedulers))
+	for _, sched := range s.schedulers {
+		schedulers = append(schedulers, sched)
+	}
+	var peers []*peer.Peer
+	for _, swarm := range s.peers {
+		for _, p := range swarm {
+			peers = append(peers, p)
+		}
+	}
+	s.mu.Unlock()
+
+	// their goroutines close them and drop them from the swarms
+	for _, p := range peers {
+		p.Disconnect()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, sched := range schedulers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sched.Stop(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.DHT != nil {
+		s.DHT.Close()
+	}
+	if s.LSD != nil {
+		s.LSD.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// AddTorrentToSession adds t and starts announcing it to its trackers.
+// Adding a torrent that is already in the session does nothing.
 func (s *Session) AddTorrentToSession(t *bt.Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Torrents[t.InfoHash]; ok {
+		return
+	}
+	s.add(t)
+}
+
+// add puts t in the session, starts announcing it everywhere and dials the
+// peers found until Close. s.mu is held.
+func (s *Session) add(t *bt.Torrent) {
 	s.Torrents[t.InfoHash] = t
+
+	updates := s.updates(t)
+	s.announce(t)
+	s.lookupDHT(t, updates)
+	if s.LSD != nil {
+		s.LSD.Add(t.InfoHash, t.IsPrivate, updates)
+	}
+
+	if t.InfoRaw == nil {
+		d := peer.NewMetadataDownloader(t)
+		s.metadata[t.InfoHash] = d
+		go s.fetchMetadata(t, d)
+	}
+
+	pex := peer.NewPex(t, updates)
+	s.pex[t.InfoHash] = pex
+	go pex.Run(func() []*peer.Peer { return s.Peers(t) }, s.done)
+
+	if len(t.InitialPeers) > 0 {
+		go s.initialPeers(t.InitialPeers, updates)
+	}
+
+	go s.run(t.InfoHash, updates)
 }
 
-func (s *Session) SetCurrTorrent(t *bt.Torrent) {
-	s.CurrTorrent = t
+// initialPeers resolves the peers a torrent came with and hands them over to
+// be dialed like any other found peers.
+func (s *Session) initialPeers(hostports []string, updates chan<- []net.Addr) {
+	var addrs []net.Addr
+	for _, hostport := range hostports {
+		if addr, err := net.ResolveTCPAddr("tcp", hostport); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	select {
+	case updates <- addrs:
+	case <-s.done:
+	}
 }
 
-// TODO i will probabily remove this on the future
-func (s *Session) Run() {
-	ticker := time.NewTicker(30 * time.Second)
+// run dials the peers of the torrent as they are found, and keeps announcing
+// it until Close.
+func (s *Session) run(infoHash bt.InfoHash, updates chan []net.Addr) {
+	ticker := time.NewTicker(torrentTick)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-s.done:
+			return
+		case addrs := <-updates:
+			s.mu.Lock()
+			s.dial(s.Torrents[infoHash], addrs)
+			s.mu.Unlock()
 		case <-ticker.C:
-			for _, torrent := range s.Torrents {
-				torrent.UpdateTrackers()
-				torrent.ManagePeers()
+			s.mu.Lock()
+			t := s.Torrents[infoHash]
+			s.announce(t)
+			s.lookupDHT(t, updates)
+			if s.LSD != nil {
+				// announces are throttled, adding again is cheap
+				s.LSD.Add(t.InfoHash, t.IsPrivate, updates)
 			}
+			s.mu.Unlock()
 		}
 	}
 }
 
+// fetchMetadata waits until the peers of t sent its info dictionary, then
+// puts the full torrent in its place. The peers are connected to the magnet,
+// which has no pieces, so they are dialed again.
+func (s *Session) fetchMetadata(t *bt.Torrent, d *peer.MetadataDownloader) {
+	select {
+	case <-s.done:
+		return
+	case <-d.Done():
+	}
+
+	full := d.Torrent()
+	// the scheduler announces to the trackers of the magnet
+	full.Trackers = t.Trackers
+	full.Downloaded, full.Uploaded = t.Downloaded, t.Uploaded
+
+	s.mu.Lock()
+	restorePieces(full, s.restored[t.InfoHash])
+	delete(s.restored, t.InfoHash)
+	s.Torrents[t.InfoHash] = full
+	if s.CurrTorrent == t {
+		s.CurrTorrent = full
+	}
+	delete(s.metadata, t.InfoHash)
+	if full.IsPrivate {
+		// the magnet did not know, from now on peers come from the trackers
+		s.pex[t.InfoHash] = peer.NewPex(full, nil)
+	}
+	old := s.peers[t.InfoHash]
+	delete(s.peers, t.InfoHash)
+	s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(old))
+	for _, p := range old {
+		p.Disconnect()
+		addrs = append(addrs, p.Addr)
+	}
+
+	s.mu.Lock()
+	s.dial(full, addrs)
+	s.mu.Unlock()
+}
+
+func (s *Session) SetCurrTorrent(t *bt.Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.CurrTorrent = t
+}
+
+// Current returns the torrent commands act on by default, nil when none is
+// loaded.
+func (s *Session) Current() *bt.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.CurrTorrent
+}
+
+// List returns the torrents of the session.
+func (s *Session) List() []*bt.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrents := make([]*bt.Torrent, 0, len(s.Torrents))
+	for _, t := range s.Torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// PersistedTorrent is a torrent as the .torrent file it came from, or as its
+// magnet link while the info dictionary is still missing.
 type PersistedTorrent struct {
 	InfoHash    bt.InfoHash `json:"info_hash"`
 	Downloaded  int64       `json:"downloaded"`
 	TotalLength int64       `json:"total_length"`
 	SavePath    string      `json:"save_path"`
 	Bitfield    []bool      `json:"bitfield"`
+
+	// older files only have the fields above, their torrents come back as
+	// magnets of the info hash
+	Uploaded int64  `json:"uploaded,omitempty"`
+	Torrent  []byte `json:"torrent,omitempty"`
+	Magnet   string `json:"magnet,omitempty"`
 }
 
 type PersistedSession struct {
 	Torrents    []PersistedTorrent `json:"torrents"`
 	CurrTorrent bt.InfoHash        `json:"curr_torrent"`
+	DHT         *dht.State         `json:"dht,omitempty"`
 }
 
+// Save writes the torrents of the session and the DHT routing table to path.
 func (s *Session) Save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	persisted := PersistedSession{}
 
 	for _, t := range s.Torrents {
 		pt := PersistedTorrent{
 			InfoHash:    t.InfoHash,
-			Downloaded:  t.BytesDownloaded,
-			TotalLength: t.TotalLength,
-			SavePath:    t.SavePath,
-			Bitfield:    t.Bitfield,
+			Downloaded:  t.Downloaded,
+			TotalLength: t.TotalSize(),
+			SavePath:    t.DownloadDir,
+			Bitfield:    t.IsPieceVerified,
+			Uploaded:    t.Uploaded,
+		}
+		if bitfield, ok := s.restored[t.InfoHash]; ok {
+			// still fetching the info, the pieces from before are kept
+			pt.Bitfield = bitfield
+		}
+		if t.InfoRaw != nil {
+			buf, err := bt.BEncoding{}.EncodeTorrent(*t)
+			if err != nil {
+				return err
+			}
+			pt.Torrent = buf
+		} else {
+			pt.Magnet = t.Magnet().String()
 		}
 		persisted.Torrents = append(persisted.Torrents, pt)
 	}
@@ -75,6 +653,11 @@ func (s *Session) Save(path string) error {
 		persisted.CurrTorrent = s.CurrTorrent.InfoHash
 	}
 
+	persisted.DHT = s.dhtState
+	if s.DHT != nil {
+		persisted.DHT = s.DHT.State()
+	}
+
 	data, err := json.MarshalIndent(persisted, "", "  ")
 	if err != nil {
 		return err
@@ -87,6 +670,8 @@ func (s *Session) Save(path string) error {
 	return os.Rename(tmp, path)
 }
 
+// Load adds the torrents saved at path. The routing table is used by
+// StartDHT, so Load comes first.
 func (s *Session) Load(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -98,10 +683,31 @@ func (s *Session) Load(path string) error {
 		return err
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dhtState = persisted.DHT
+
 	for _, pt := range persisted.Torrents {
-		//need a way to reconstruct a Torrent
-		t := bt.NewTorrentFromState(pt.InfoHash, pt.SavePath, pt.TotalLength, pt.Bitfield)
-		s.Torrents[t.InfoHash] = t
+		t, err := loadTorrent(pt)
+		if err != nil {
+			return fmt.Errorf("torrent %x: %w", pt.InfoHash, err)
+		}
+		t.DownloadDir = pt.SavePath
+		t.Downloaded = pt.Downloaded
+		t.Uploaded = pt.Uploaded
+		if existing, ok := s.Torrents[t.InfoHash]; ok {
+			t = existing
+		} else {
+			if t.InfoRaw == nil {
+				if len(pt.Bitfield) > 0 {
+					s.restored[t.InfoHash] = pt.Bitfield
+				}
+			} else {
+				restorePieces(t, pt.Bitfield)
+			}
+			s.add(t)
+		}
 
 		if pt.InfoHash == persisted.CurrTorrent {
 			s.CurrTorrent = t
@@ -110,3 +716,32 @@ func (s *Session) Load(path string) error {
 
 	return nil
 }
+
+func loadTorrent(pt PersistedTorrent) (*bt.Torrent, error) {
+	switch {
+	case pt.Torrent != nil:
+		return bt.BEncoding{}.DecodeTorrent(pt.Torrent)
+	case pt.Magnet != "":
+		m, err := bt.ParseMagnet(pt.Magnet)
+		if err != nil {
+			return nil, err
+		}
+		return bt.NewTorrentFromMagnet(m)
+	default:
+		return bt.NewTorrentFromMagnet(&bt.Magnet{InfoHash: pt.InfoHash, HasInfoHash: true})
+	}
+}
+
+// restorePieces marks the pieces verified before the restart, a bitfield of
+// another size is not for this torrent and is ignored.
+func restorePieces(t *bt.Torrent, bitfield []bool) {
+	if len(bitfield) != len(t.IsPieceVerified) {
+		return
+	}
+	for i, verified := range bitfield {
+		if verified {
+			t.MarkPieceComplete(i)
+		}
+	}
+	t.IsSeeding = t.IsCompleted()
+}
@@ -0,0 +1,392 @@
+package session
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	bt "github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
+	"github.com/dmsRosa6/bittorrent-client/internal/peer"
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+	"github.com/dmsRosa6/bittorrent-client/internal/trackerserver"
+)
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestSession(t *testing.T) *Session {
+	s := NewSession()
+	if err := s.StartListener(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// dialSession connects to the listener of s as a peer of infoHash and reads
+// the answer to its handshake.
+func dialSession(t *testing.T, s *Session, infoHash bt.InfoHash) net.Conn {
+	return dialSessionReserved(t, s, infoHash, peer.Reserved{})
+}
+
+func dialSessionReserved(t *testing.T, s *Session, infoHash bt.InfoHash, reserved peer.Reserved) net.Conn {
+	// over IPv4, which is what the ipv6 key is sent on
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.Listener.Addr().(*net.TCPAddr).Port}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	hs := peer.Handshake{Pstr: "BitTorrent protocol", Reserved: reserved, InfoHash: infoHash, PeerId: [20]byte{1}}
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(hs.Serialize()))); err != nil {
+		t.Fatalf("no handshake back: %v", err)
+	}
+	return conn
+}
+
+func TestPeerDisconnect(t *testing.T) {
+	s := newTestSession(t)
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}}
+	s.AddTorrentToSession(torrent)
+
+	conn := dialSession(t, s, torrent.InfoHash)
+	waitFor(t, "the peer to join", func() bool { return len(s.Peers(torrent)) == 1 })
+	if n := s.Listener.Conns(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+
+	// the peer goroutine notices and gives the slot back
+	conn.Close()
+	waitFor(t, "the peer to leave", func() bool { return len(s.Peers(torrent)) == 0 })
+	waitFor(t, "the slot to be released", func() bool { return s.Listener.Conns() == 0 })
+}
+
+func TestAnnounceOnAdd(t *testing.T) {
+	server := trackerserver.New(trackerserver.Config{HTTPAddr: "127.0.0.1:0"})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	s := NewSession()
+	s.ListenPort = 6881
+	defer s.Close()
+
+	announce := "http://" + server.HTTPAddr().String() + "/announce"
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}, Trackers: tracker.NewManager([][]string{{announce}})}
+	s.AddTorrentToSession(torrent)
+
+	waitFor(t, "the started announce", func() bool {
+		scrape, err := server.Scrape([][20]byte{torrent.InfoHash})
+		return err == nil && scrape[torrent.InfoHash].Seeders == 1
+	})
+	if _, err := s.NextAnnounce(torrent); err != nil {
+		t.Errorf("next announce: %v", err)
+	}
+}
+
+func TestDialPeerUpdates(t *testing.T) {
+	a := newTestSession(t)
+	b := NewSession()
+	defer b.Close()
+
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}}
+	a.AddTorrentToSession(torrent)
+	b.AddTorrentToSession(torrent)
+
+	// twice, the second is already connected or being dialed
+	addr := a.Listener.Addr().(*net.TCPAddr)
+	b.PeerUpdates(torrent) <- []net.Addr{addr}
+	b.PeerUpdates(torrent) <- []net.Addr{addr}
+
+	waitFor(t, "b to dial a", func() bool {
+		return len(a.Peers(torrent)) == 1 && len(b.Peers(torrent)) == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := a.Listener.Conns(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestDialLimits(t *testing.T) {
+	a1, a2 := newTestSession(t), newTestSession(t)
+	b := NewSession()
+	b.MaxConns = 1
+	if err := b.StartListener(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}}
+	for _, s := range []*Session{a1, a2, b} {
+		s.AddTorrentToSession(torrent)
+	}
+
+	// the dialed peer takes the only slot of the listener
+	b.PeerUpdates(torrent) <- []net.Addr{a1.Listener.Addr(), a2.Listener.Addr()}
+	waitFor(t, "b to dial", func() bool { return len(b.Peers(torrent)) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(b.Peers(torrent)); n != 1 {
+		t.Errorf("expected 1 peer, got %d", n)
+	}
+	if n := b.Listener.Conns(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+
+	// and gives it back when it leaves
+	for _, p := range b.Peers(torrent) {
+		p.Disconnect()
+	}
+	waitFor(t, "the slot to be released", func() bool { return b.Listener.Conns() == 0 })
+}
+
+func TestSaveLoad(t *testing.T) {
+	magnet, err := bt.ParseMagnet("magnet:?xt=urn:btih:0909090909090909090909090909090909090909&dn=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := bt.NewTorrentFromMagnet(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Downloaded = 100
+
+	path := t.TempDir() + "/session.json"
+	s := NewSession()
+	s.StatePath = path
+	s.AddTorrentToSession(torrent)
+	s.SetCurrTorrent(torrent)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSession()
+	defer loaded.Close()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	current := loaded.Current()
+	if current == nil || current.InfoHash != torrent.InfoHash || current.Name != "test" {
+		t.Fatalf("expected the saved torrent, got %+v", current)
+	}
+	if current.Downloaded != 100 {
+		t.Errorf("expected 100 bytes downloaded, got %d", current.Downloaded)
+	}
+	if len(loaded.List()) != 1 {
+		t.Errorf("expected 1 torrent, got %d", len(loaded.List()))
+	}
+}
+
+func TestSavePieces(t *testing.T) {
+	torrent := testTorrent(t, 40*1024)
+	torrent.MarkPieceComplete(1)
+	torrent.Downloaded = 16 * 1024
+
+	path := t.TempDir() + "/session.json"
+	s := NewSession()
+	s.StatePath = path
+	s.AddTorrentToSession(torrent)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSession()
+	defer loaded.Close()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := loaded.List()[0]
+	if want := []bool{false, true, false}; !slices.Equal(restored.IsPieceVerified, want) {
+		t.Errorf("expected pieces %v, got %v", want, restored.IsPieceVerified)
+	}
+	if left := restored.Left(); left != 24*1024 {
+		t.Errorf("expected %d bytes left, got %d", 24*1024, left)
+	}
+}
+
+func TestLoadOldFormat(t *testing.T) {
+	path := t.TempDir() + "/session.json"
+	old := `{
+  "torrents": [{
+    "info_hash": [9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9],
+    "downloaded": 100,
+    "total_length": 1000,
+    "save_path": "downloads",
+    "bitfield": [true]
+  }],
+  "curr_torrent": [9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9,9]
+}`
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSession()
+	defer s.Close()
+	if err := s.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// back as a magnet, its info comes from peers
+	current := s.Current()
+	want := bt.InfoHash{9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9}
+	if current == nil || current.InfoHash != want || current.DownloadDir != "downloads" {
+		t.Fatalf("expected the saved torrent, got %+v", current)
+	}
+	if current.Downloaded != 100 {
+		t.Errorf("expected 100 bytes downloaded, got %d", current.Downloaded)
+	}
+}
+
+func TestExtendedHandshakeAddresses(t *testing.T) {
+	s := NewSession()
+	s.Extensions.IPv6 = net.ParseIP("2001:db8::1")
+	if err := s.StartListener(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}}
+	s.AddTorrentToSession(torrent)
+
+	var reserved peer.Reserved
+	reserved.Set(peer.BitExtension)
+	conn := dialSessionReserved(t, s, torrent.InfoHash, reserved)
+
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Fatalf("no extended handshake: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(length))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg[0] != byte(peer.MsgExtended) || msg[1] != 0 {
+		t.Fatalf("expected the extended handshake, got message %d", msg[0])
+	}
+
+	var hs peer.ExtendedHandshake
+	if err := bencode.Unmarshal(msg[2:], &hs); err != nil {
+		t.Fatal(err)
+	}
+	if port := s.Listener.Addr().(*net.TCPAddr).Port; hs.Port != port {
+		t.Errorf("expected p %d, got %d", port, hs.Port)
+	}
+	if !net.IP(hs.IPv6).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected ipv6 2001:db8::1, got %v", net.IP(hs.IPv6))
+	}
+}
+
+// testTorrent returns a torrent named f of size bytes in pieces of 16 KiB.
+func testTorrent(t *testing.T, size int) *bt.Torrent {
+	buf, err := bencode.Marshal(map[string]any{
+		"announce": "",
+		"info": map[string]any{
+			"name":         "f",
+			"length":       size,
+			"piece length": 16 * 1024,
+			"pieces":       string(make([]byte, 20*((size+16*1024-1)/(16*1024)))),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := bt.BEncoding{}.DecodeTorrent(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+func TestMagnetMetadata(t *testing.T) {
+	full := testTorrent(t, 100)
+	magnet, err := bt.NewTorrentFromMagnet(&bt.Magnet{InfoHash: full.InfoHash, HasInfoHash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestSession(t)
+	a.AddTorrentToSession(full)
+	b := NewSession()
+	defer b.Close()
+	b.AddTorrentToSession(magnet)
+	b.SetCurrTorrent(magnet)
+
+	b.PeerUpdates(magnet) <- []net.Addr{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.ListenPort}}
+
+	waitFor(t, "the info dictionary", func() bool {
+		current := b.Current()
+		return current != magnet && current.InfoRaw != nil
+	})
+	if current := b.Current(); current.Name != "f" || current.PiecesCount() != 1 {
+		t.Errorf("unexpected torrent %q with %d pieces", current.Name, current.PiecesCount())
+	}
+	// the peer is dialed again for the full torrent
+	waitFor(t, "the peer to be dialed again", func() bool { return len(b.Peers(b.Current())) == 1 })
+}
+
+func TestMagnetPeers(t *testing.T) {
+	full := testTorrent(t, 100)
+	a := newTestSession(t)
+	a.AddTorrentToSession(full)
+
+	// the magnet knows a, nothing else would tell b about it
+	m, err := bt.ParseMagnet(full.Magnet().String() + "&x.pe=127.0.0.1:" + strconv.Itoa(a.ListenPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	magnet, err := bt.NewTorrentFromMagnet(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewSession()
+	defer b.Close()
+	b.AddTorrentToSession(magnet)
+
+	waitFor(t, "b to dial the peer of the magnet", func() bool { return len(a.Peers(full)) == 1 })
+}
+
+func TestPeerExchange(t *testing.T) {
+	a, b, c := newTestSession(t), newTestSession(t), newTestSession(t)
+	torrent := &bt.Torrent{InfoHash: bt.InfoHash{9}, PieceHashes: make([][]byte, 1)}
+	for _, s := range []*Session{a, b, c} {
+		s.AddTorrentToSession(torrent)
+	}
+
+	toA := []net.Addr{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.ListenPort}}
+	b.PeerUpdates(torrent) <- toA
+	waitFor(t, "b to dial a", func() bool { return len(a.Peers(torrent)) == 1 })
+	c.PeerUpdates(torrent) <- toA
+
+	// a tells c about b, and c dials it
+	waitFor(t, "c to learn about b", func() bool {
+		for _, p := range c.Peers(torrent) {
+			if p.Addr.Port == b.ListenPort {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,282 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+)
+
+const (
+	// how long one HTTP announce may take, connecting included
+	httpTimeout = 30 * time.Second
+
+	// tracker responses are small, anything bigger is not one
+	maxHTTPResponseSize = 1 << 20
+
+	// infohashes in one scrape, to keep the url short
+	httpMaxScrapeHashes = 50
+)
+
+var ErrMalformedHTTP = errors.New("tracker: malformed http response")
+
+// httpAnnounceResponse is the bencoded body of an HTTP announce response.
+// Peers is either a compact string or a list of dictionaries.
+type httpAnnounceResponse struct {
+	FailureReason  *string `bencode:"failure reason"`
+	WarningMessage string  `bencode:"warning message"`
+	Interval       int64   `bencode:"interval"`
+	MinInterval    int64   `bencode:"min interval"`
+	TrackerID      string  `bencode:"tracker id"`
+	Complete       int64   `bencode:"complete"`
+	Incomplete     int64   `bencode:"incomplete"`
+	Peers          any     `bencode:"peers"`
+	Peers6         []byte  `bencode:"peers6"`
+}
+
+// httpScrapeResponse is the bencoded body of an HTTP scrape response, with
+// files keyed by the raw infohash (BEP 48).
+type httpScrapeResponse struct {
+	FailureReason *string `bencode:"failure reason"`
+	Files         map[string]struct {
+		Complete   int64  `bencode:"complete"`
+		Downloaded int64  `bencode:"downloaded"`
+		Incomplete int64  `bencode:"incomplete"`
+		Name       string `bencode:"name"`
+	} `bencode:"files"`
+}
+
+func (t *Tracker) announceHTTP(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	announceURL := fmt.Sprintf("%s%sinfo_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=1",
+		t.Address,
+		querySeparator(t.Address),
+		url.QueryEscape(string(req.InfoHash[:])),
+		url.QueryEscape(string(req.PeerID[:])),
+		req.Port,
+		req.Uploaded,
+		req.Downloaded,
+		req.Left,
+	)
+	if ev := EventName[req.Event]; ev != "" {
+		announceURL += "&event=" + ev
+	}
+	if req.NumWant > 0 {
+		announceURL += fmt.Sprintf("&numwant=%d", req.NumWant)
+	}
+	if req.Key != 0 {
+		announceURL += fmt.Sprintf("&key=%08x", req.Key)
+	}
+	if req.IPv6 != nil && req.IPv6.To4() == nil {
+		announceURL += "&ipv6=" + url.QueryEscape(req.IPv6.String())
+	}
+	if id := t.trackerID(); id != "" {
+		announceURL += "&trackerid=" + url.QueryEscape(id)
+	}
+
+	body, status, err := t.get(ctx, announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var r httpAnnounceResponse
+	if err := bencode.Unmarshal(body, &r); err != nil {
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("tracker: http status %d", status)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+	}
+	if r.FailureReason != nil {
+		return nil, &Error{Reason: *r.FailureReason}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("tracker: http status %d", status)
+	}
+
+	peers, err := parseHTTPPeers(r.Peers)
+	if err != nil {
+		return nil, err
+	}
+	peers = append(peers, parseCompactPeers(r.Peers6, 18)...)
+
+	// the tracker id is only sent when it changes, keep the last one
+	if r.TrackerID != "" {
+		t.setTrackerID(r.TrackerID)
+	}
+
+	return &AnnounceResponse{
+		Interval:    time.Duration(r.Interval) * time.Second,
+		MinInterval: time.Duration(r.MinInterval) * time.Second,
+		Seeders:     int(r.Complete),
+		Leechers:    int(r.Incomplete),
+		Peers:       peers,
+		TrackerID:   r.TrackerID,
+		Warning:     r.WarningMessage,
+	}, nil
+}
+
+// ScrapeURL derives the scrape url of an HTTP tracker from its announce url.
+// By convention it is only possible when the last path element starts with
+// "announce", which becomes "scrape".
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+func (t *Tracker) scrapeHTTP(ctx context.Context, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(t.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), httpMaxScrapeHashes)]
+		infoHashes = infoHashes[len(batch):]
+
+		u := scrapeURL
+		sep := querySeparator(u)
+		for _, infoHash := range batch {
+			u += sep + "info_hash=" + url.QueryEscape(string(infoHash[:]))
+			sep = "&"
+		}
+
+		body, status, err := t.get(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+
+		var r httpScrapeResponse
+		if err := bencode.Unmarshal(body, &r); err != nil {
+			if status != http.StatusOK {
+				return nil, fmt.Errorf("tracker: http status %d", status)
+			}
+			return nil, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+		}
+		if r.FailureReason != nil {
+			return nil, &Error{Reason: *r.FailureReason}
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("tracker: http status %d", status)
+		}
+
+		// torrents the tracker does not know are left out
+		for hash, f := range r.Files {
+			if len(hash) != 20 {
+				continue
+			}
+			results[[20]byte([]byte(hash))] = ScrapeResult{
+				Seeders:   int(f.Complete),
+				Completed: int(f.Downloaded),
+				Leechers:  int(f.Incomplete),
+				Name:      f.Name,
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// get fetches u and returns the body, decompressed when the tracker sent it
+// gzipped.
+func (t *Tracker) get(ctx context.Context, u string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// asking ourselves turns off the transparent decompression of the
+	// transport, so bodies of trackers that gzip without being asked to are
+	// handled the same way
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPResponseSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) > maxHTTPResponseSize {
+		return nil, 0, fmt.Errorf("%w: response too large", ErrMalformedHTTP)
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" || bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+		}
+		body, err = io.ReadAll(io.LimitReader(zr, maxHTTPResponseSize+1))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+		}
+		if len(body) > maxHTTPResponseSize {
+			return nil, 0, fmt.Errorf("%w: response too large", ErrMalformedHTTP)
+		}
+	}
+
+	return body, resp.StatusCode, nil
+}
+
+// parseHTTPPeers reads the peers of an announce response, compact or as a
+// list of dictionaries.
+func parseHTTPPeers(v any) ([]net.Addr, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return parseCompactPeers([]byte(v), 6), nil
+	case []any:
+		var peers []net.Addr
+		for _, p := range v {
+			d, ok := p.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%w: peer is not a dictionary", ErrMalformedHTTP)
+			}
+			ip, _ := d["ip"].(string)
+			port, _ := d["port"].(int64)
+			// the ip can be a dns name, those are left out rather than
+			// resolved while announcing
+			addr := net.ParseIP(ip)
+			if addr == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			if v4 := addr.To4(); v4 != nil {
+				addr = v4
+			}
+			peers = append(peers, &net.TCPAddr{IP: addr, Port: int(port)})
+		}
+		return peers, nil
+	default:
+		return nil, fmt.Errorf("%w: peers is %T", ErrMalformedHTTP, v)
+	}
+}
+
+func querySeparator(u string) string {
+	if strings.Contains(u, "?") {
+		return "&"
+	}
+	return "?"
+}
@@ -0,0 +1,284 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHTTPTracker answers every announce with body, and records the queries.
+type fakeHTTPTracker struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	queries []url.Values
+	status  int
+	body    string
+	gzip    bool
+	delay   time.Duration
+}
+
+func newFakeHTTPTracker(t *testing.T, body string) *fakeHTTPTracker {
+	f := &fakeHTTPTracker{status: http.StatusOK, body: body}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHTTPTracker) set(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+func (f *fakeHTTPTracker) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.queries = append(f.queries, r.URL.Query())
+	status, body, gz, delay := f.status, f.body, f.gzip, f.delay
+	f.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if gz {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(body))
+		zw.Close()
+		body = buf.String()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	f := newFakeHTTPTracker(t, "d8:completei7e10:incompletei3e8:intervali1800e12:min intervali900e"+
+		"5:peers12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2"+
+		"6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe3"+
+		"10:tracker id3:abc15:warning message4:slowe")
+	tr := NewTracker(f.URL + "/announce")
+
+	req := AnnounceRequest{
+		InfoHash: [20]byte{1, 2, 3},
+		PeerID:   [20]byte{'-', 'B', 'C'},
+		Port:     6881,
+		Left:     30,
+		Event:    StartedEvent,
+		NumWant:  50,
+		Key:      0xdeadbeef,
+		IPv6:     net.ParseIP("2001:db8::2"),
+	}
+	resp, err := tr.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+
+	if resp.Interval != 30*time.Minute || resp.MinInterval != 15*time.Minute {
+		t.Errorf("wrong intervals %v %v", resp.Interval, resp.MinInterval)
+	}
+	if resp.Seeders != 7 || resp.Leechers != 3 || resp.TrackerID != "abc" || resp.Warning != "slow" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(resp.Peers) != 3 || resp.Peers[0].String() != "10.0.0.1:6881" ||
+		resp.Peers[1].String() != "10.0.0.2:6882" || resp.Peers[2].String() != "[2001:db8::1]:6883" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+
+	var q url.Values
+	f.set(func() { q = f.queries[0] })
+	if q.Get("info_hash") != string(req.InfoHash[:]) || q.Get("peer_id") != string(req.PeerID[:]) {
+		t.Errorf("wrong info hash or peer id")
+	}
+	if q.Get("event") != "started" || q.Get("numwant") != "50" || q.Get("key") != "deadbeef" || q.Get("compact") != "1" {
+		t.Errorf("unexpected query %v", q)
+	}
+	if q.Get("ipv6") != "2001:db8::2" {
+		t.Errorf("expected our ipv6 address, got %q", q.Get("ipv6"))
+	}
+	if q.Has("trackerid") {
+		t.Errorf("sent a tracker id before getting one")
+	}
+
+	// the tracker id is echoed from then on, even when not sent again
+	f.set(func() { f.body = "d8:intervali1800e5:peers0:e" })
+	req.Event = NoneEvent
+	if _, err := tr.Announce(context.Background(), req); err != nil {
+		t.Fatalf("second announce: %v", err)
+	}
+	if _, err := tr.Announce(context.Background(), req); err != nil {
+		t.Fatalf("third announce: %v", err)
+	}
+	f.set(func() { q = f.queries[2] })
+	if q.Get("trackerid") != "abc" {
+		t.Errorf("expected tracker id abc, got %q", q.Get("trackerid"))
+	}
+	if q.Has("event") {
+		t.Errorf("regular announce sent event %q", q.Get("event"))
+	}
+}
+
+func TestHTTPAnnounceDictionaryPeers(t *testing.T) {
+	f := newFakeHTTPTracker(t, "d8:intervali60e5:peersl"+
+		"d2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881ee"+
+		"d2:ip11:2001:db8::24:porti6882ee"+
+		"d2:ip15:tracker.example4:porti6883ee"+
+		"d2:ip8:10.0.0.34:porti0ee"+
+		"ee")
+	f.set(func() { f.gzip = true })
+
+	resp, err := NewTracker(f.URL+"/announce?passkey=x").Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if resp.Interval != time.Minute {
+		t.Errorf("wrong interval %v", resp.Interval)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "[2001:db8::2]:6882" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+
+	var q url.Values
+	f.set(func() { q = f.queries[0] })
+	if q.Get("passkey") != "x" || q.Get("port") != "0" {
+		t.Errorf("query of an announce url with parameters is %v", q)
+	}
+}
+
+func TestHTTPAnnounceErrors(t *testing.T) {
+	f := newFakeHTTPTracker(t, "d14:failure reason22:torrent not registerede")
+	tr := NewTracker(f.URL + "/announce")
+
+	_, err := tr.Announce(context.Background(), AnnounceRequest{})
+	var trackerErr *Error
+	if !errors.As(err, &trackerErr) || trackerErr.Reason != "torrent not registered" {
+		t.Errorf("expected tracker error, got %v", err)
+	}
+
+	// failures can come with an error status
+	f.set(func() { f.status = http.StatusForbidden })
+	_, err = tr.Announce(context.Background(), AnnounceRequest{})
+	if !errors.As(err, &trackerErr) {
+		t.Errorf("expected tracker error, got %v", err)
+	}
+
+	f.set(func() { f.status, f.body = http.StatusBadGateway, "<html>bad gateway</html>" })
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); err == nil || errors.As(err, &trackerErr) {
+		t.Errorf("expected a status error, got %v", err)
+	}
+
+	f.set(func() { f.status, f.body = http.StatusOK, "d5:peersi3ee" })
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); !errors.Is(err, ErrMalformedHTTP) {
+		t.Errorf("expected ErrMalformedHTTP, got %v", err)
+	}
+
+	f.set(func() { f.body = "not bencode" })
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); !errors.Is(err, ErrMalformedHTTP) {
+		t.Errorf("expected ErrMalformedHTTP, got %v", err)
+	}
+
+	f.set(func() { f.body, f.delay = "d8:intervali60ee", time.Second })
+	tr.client.Timeout = 20 * time.Millisecond
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); err == nil {
+		t.Errorf("expected a timeout")
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	for announce, want := range map[string]string{
+		"http://example.com/announce":          "http://example.com/scrape",
+		"http://example.com/x/announce":        "http://example.com/x/scrape",
+		"http://example.com/announce.php":      "http://example.com/scrape.php",
+		"http://example.com/announce?x2%0644":  "http://example.com/scrape?x2%0644",
+		"http://example.com/announce?passkey=": "http://example.com/scrape?passkey=",
+	} {
+		got, err := ScrapeURL(announce)
+		if err != nil || got != want {
+			t.Errorf("ScrapeURL(%q) = %q, %v, want %q", announce, got, err, want)
+		}
+	}
+
+	for _, announce := range []string{
+		"http://example.com/a",
+		"http://example.com/announce/",
+		"http://example.com/x%064announce",
+	} {
+		if _, err := ScrapeURL(announce); !errors.Is(err, ErrScrapeUnsupported) {
+			t.Errorf("ScrapeURL(%q) expected ErrScrapeUnsupported, got %v", announce, err)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		// every hash but the first is known, seeded by its first byte
+		body := "d5:filesd"
+		for _, hash := range r.URL.Query()["info_hash"] {
+			if hash[0] == 0 {
+				continue
+			}
+			body += "20:" + hash + "d8:completei" + strconv.Itoa(int(hash[0])) +
+				"e10:downloadedi100e10:incompletei5e4:name3:fooe"
+		}
+		w.Write([]byte(body + "e5:flagsd20:min_request_intervali900eee"))
+	}))
+	t.Cleanup(srv.Close)
+
+	var hashes [][20]byte
+	for i := 0; i < httpMaxScrapeHashes+10; i++ {
+		hashes = append(hashes, [20]byte{byte(i)})
+	}
+
+	results, err := NewTracker(srv.URL+"/announce").Scrape(context.Background(), hashes)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if len(results) != len(hashes)-1 {
+		t.Fatalf("expected %d results, got %d", len(hashes)-1, len(results))
+	}
+	if r := results[[20]byte{42}]; r.Seeders != 42 || r.Completed != 100 || r.Leechers != 5 || r.Name != "foo" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if _, ok := results[[20]byte{0}]; ok {
+		t.Errorf("got a result for an unknown torrent")
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+
+	f := newFakeHTTPTracker(t, "d14:failure reason9:forbiddene")
+	_, err = NewTracker(f.URL+"/announce").Scrape(context.Background(), hashes[:1])
+	var trackerErr *Error
+	if !errors.As(err, &trackerErr) || trackerErr.Reason != "forbidden" {
+		t.Errorf("expected tracker error, got %v", err)
+	}
+
+	_, err = NewTracker(f.URL+"/tracker").Scrape(context.Background(), hashes[:1])
+	if !errors.Is(err, ErrScrapeUnsupported) {
+		t.Errorf("expected ErrScrapeUnsupported, got %v", err)
+	}
+}
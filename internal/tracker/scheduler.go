@@ -0,0 +1,234 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// used when a tracker does not say how often to announce
+	defaultInterval = 30 * time.Minute
+
+	// failed announces are retried after 15s, 30s, 1m... up to maxBackoff
+	baseBackoff = 15 * time.Second
+	maxBackoff  = 30 * time.Minute
+)
+
+// Scheduler announces one torrent to its trackers. It sends started first,
+// then regular announces as often as the trackers ask, completed when the
+// torrent finishes and stopped when it is stopped. Failed announces are
+// retried with exponential backoff, keeping their event.
+type Scheduler struct {
+	manager *Manager
+	// request returns the announce for event with the current stats
+	request func(TrackerEvent) AnnounceRequest
+	peers   chan<- []net.Addr
+
+	// first retry after a failure, baseBackoff outside tests
+	backoff time.Duration
+
+	reannounce chan struct{}
+	complete   chan struct{}
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mu           sync.Mutex
+	running      bool
+	started      bool
+	completed    bool
+	nextAnnounce time.Time
+	lastErr      error
+}
+
+// NewScheduler returns a scheduler announcing to the trackers of m. The
+// peers they return are sent to peers, dropped when it is full.
+func NewScheduler(m *Manager, request func(TrackerEvent) AnnounceRequest, peers chan<- []net.Addr) *Scheduler {
+	return &Scheduler{
+		manager:    m,
+		request:    request,
+		peers:      peers,
+		backoff:    baseBackoff,
+		reannounce: make(chan struct{}, 1),
+		complete:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start sends the started announce and keeps announcing until Stop. A stopped
+// scheduler can not be started again.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running || s.cancel != nil {
+		return
+	}
+	s.running = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx)
+}
+
+// Reannounce announces as soon as the min interval of the trackers allows.
+func (s *Scheduler) Reannounce() {
+	select {
+	case s.reannounce <- struct{}{}:
+	default:
+	}
+}
+
+// Completed sends the completed event, once. Before the started announce got
+// through it waits for it. A torrent that was already complete when it
+// started never sends it.
+func (s *Scheduler) Completed() {
+	select {
+	case s.complete <- struct{}{}:
+	default:
+	}
+}
+
+// NextAnnounce returns when the next announce is due and why the last one
+// failed, if it did.
+func (s *Scheduler) NextAnnounce() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextAnnounce, s.lastErr
+}
+
+// Stop ends the announces and tells the trackers we are gone, if they knew
+// about us. ctx bounds how long that may take.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	s.mu.Unlock()
+
+	<-s.done
+
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	_, err := s.manager.Announce(ctx, s.request(StoppedEvent))
+	return err
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	defer close(s.done)
+
+	event := StartedEvent
+	// completed came while started was still failing
+	pendingCompleted := false
+	failures := 0
+	var lastAnnounce time.Time
+	var minInterval time.Duration
+	var lastErr error
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-s.complete:
+			s.mu.Lock()
+			started, completed := s.started, s.completed
+			s.mu.Unlock()
+			if completed || event == CompletedEvent {
+				continue
+			}
+			if !started {
+				pendingCompleted = true
+				continue
+			}
+			// completed is sent right away, whatever the interval
+			event = CompletedEvent
+
+		case <-s.reannounce:
+			if wait := time.Until(lastAnnounce.Add(minInterval)); wait > 0 {
+				s.schedule(timer, wait, lastErr)
+				continue
+			}
+
+		case <-timer.C:
+		}
+
+		lastAnnounce = time.Now()
+		resp, err := s.manager.Announce(ctx, s.request(event))
+		if ctx.Err() != nil {
+			return
+		}
+		lastErr = err
+
+		if err != nil {
+			// the shift is bounded so the backoff can not overflow
+			failures = min(failures+1, 16)
+			s.schedule(timer, min(s.backoff<<(failures-1), maxBackoff), err)
+			continue
+		}
+
+		s.mu.Lock()
+		switch event {
+		case StartedEvent:
+			s.started = true
+		case CompletedEvent:
+			s.completed = true
+		}
+		s.mu.Unlock()
+
+		failures = 0
+		minInterval = resp.MinInterval
+
+		interval := resp.Interval
+		if interval <= 0 {
+			interval = defaultInterval
+		}
+		if event == StartedEvent && pendingCompleted {
+			// the completed that had to wait for started goes right after it
+			event = CompletedEvent
+			pendingCompleted = false
+			s.schedule(timer, 0, nil)
+		} else {
+			event = NoneEvent
+			s.schedule(timer, max(interval, minInterval), nil)
+		}
+
+		if s.peers != nil && len(resp.Peers) > 0 {
+			select {
+			case s.peers <- resp.Peers:
+			default:
+			}
+		}
+	}
+}
+
+// schedule resets timer to fire after wait, and records it with the error of
+// the last announce.
+func (s *Scheduler) schedule(timer *time.Timer, wait time.Duration, err error) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(wait)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextAnnounce = time.Now().Add(wait)
+	s.lastErr = err
+}
@@ -0,0 +1,178 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitEvents waits until f got n announces and returns their events.
+func waitEvents(t *testing.T, f *fakeHTTPTracker, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var events []string
+		f.set(func() {
+			for _, q := range f.queries {
+				events = append(events, q.Get("event"))
+			}
+		})
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d announces, got %v", n, events)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestScheduler(f *fakeHTTPTracker, peers chan<- []net.Addr) *Scheduler {
+	m := NewManager([][]string{{f.URL + "/announce"}})
+	s := NewScheduler(m, func(ev TrackerEvent) AnnounceRequest {
+		return AnnounceRequest{Port: 6881, Event: ev}
+	}, peers)
+	s.backoff = 10 * time.Millisecond
+	return s
+}
+
+func TestSchedulerEvents(t *testing.T) {
+	f := newFakeHTTPTracker(t, "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	peers := make(chan []net.Addr, 10)
+	s := newTestScheduler(f, peers)
+
+	s.Start()
+	if events := waitEvents(t, f, 1); events[0] != "started" {
+		t.Fatalf("expected started first, got %v", events)
+	}
+	select {
+	case got := <-peers:
+		if len(got) != 1 || got[0].String() != "10.0.0.1:6881" {
+			t.Errorf("unexpected peers %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no peers delivered")
+	}
+	if next, err := s.NextAnnounce(); err != nil || time.Until(next) < 29*time.Minute {
+		t.Errorf("next announce should follow the interval, got %v %v", next, err)
+	}
+
+	s.Reannounce()
+	if events := waitEvents(t, f, 2); events[1] != "" {
+		t.Errorf("expected a regular announce, got %v", events)
+	}
+
+	s.Completed()
+	s.Completed()
+	if events := waitEvents(t, f, 3); events[2] != "completed" {
+		t.Errorf("expected completed, got %v", events)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if events := waitEvents(t, f, 4); len(events) != 4 || events[3] != "stopped" {
+		t.Errorf("expected completed once and then stopped, got %v", events)
+	}
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	f := newFakeHTTPTracker(t, failing)
+	s := newTestScheduler(f, nil)
+
+	s.Start()
+	// 10ms, 20ms and 40ms after the first
+	events := waitEvents(t, f, 4)
+	for _, ev := range events {
+		if ev != "started" {
+			t.Errorf("retries must keep the started event, got %v", events)
+		}
+	}
+	if _, err := s.NextAnnounce(); err == nil {
+		t.Errorf("expected the last error")
+	}
+
+	f.set(func() { f.body = "d8:intervali1800e12:min intervali900e5:peers0:e" })
+	n := len(waitEvents(t, f, 5))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := s.NextAnnounce(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("announce did not recover")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a reannounce within the min interval waits for it
+	s.Reannounce()
+	time.Sleep(50 * time.Millisecond)
+	if got := len(waitEvents(t, f, n)); got > n+1 {
+		t.Errorf("reannounce ignored the min interval: %d announces", got)
+	}
+	if next, _ := s.NextAnnounce(); time.Until(next) < 14*time.Minute {
+		t.Errorf("expected the reannounce after the min interval, got %v", next)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
+
+func TestSchedulerStopUnstarted(t *testing.T) {
+	f := newFakeHTTPTracker(t, failing)
+	s := newTestScheduler(f, nil)
+	s.backoff = time.Hour
+
+	s.Start()
+	waitEvents(t, f, 1)
+
+	// the tracker never heard of us, there is nothing to stop
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if events := waitEvents(t, f, 1); len(events) != 1 {
+		t.Errorf("expected no stopped event, got %v", events)
+	}
+}
+
+func TestSchedulerCompletedBeforeStarted(t *testing.T) {
+	f := newFakeHTTPTracker(t, failing)
+	s := newTestScheduler(f, nil)
+	s.backoff = 50 * time.Millisecond
+
+	s.Start()
+	waitEvents(t, f, 1)
+
+	// the torrent finishes while started is backing off
+	s.Completed()
+	f.set(func() { f.body = "d8:intervali1800e5:peers0:e" })
+
+	var events []string
+	for n := 2; !slices.Contains(events, "completed"); n++ {
+		events = waitEvents(t, f, n)
+	}
+	if events[len(events)-2] != "started" || events[len(events)-1] != "completed" {
+		t.Errorf("expected completed right after started, got %v", events)
+	}
+	for _, ev := range events[:len(events)-1] {
+		if ev != "started" {
+			t.Errorf("completed was sent before started, got %v", events)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
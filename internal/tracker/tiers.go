@@ -0,0 +1,255 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long one tracker of a tier gets before the next one is tried
+const announceTimeout = 60 * time.Second
+
+var ErrNoTrackers = errors.New("tracker: no trackers")
+
+// TrackerState is what the last announce to one tracker gave.
+type TrackerState struct {
+	Address string
+	Tier    int
+
+	// LastAnnounce is zero until the tracker has been tried
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	Err          error
+	Warning      string
+
+	Seeders  int
+	Leechers int
+	Peers    int
+}
+
+// Working reports whether the last announce got an answer.
+func (s TrackerState) Working() bool {
+	return !s.LastAnnounce.IsZero() && s.Err == nil
+}
+
+// Manager announces to the trackers of a torrent by tiers (BEP 12). Trackers
+// are tried in order within a tier, and the first one that answers moves to
+// the front of its tier. The next tier is only tried when a whole tier failed,
+// unless AnnounceToAll is set.
+type Manager struct {
+	// AnnounceToAll announces to the first working tracker of every tier
+	// instead of stopping at the first tier that answers
+	AnnounceToAll bool
+
+	// Timeout bounds the announce to each tracker, announceTimeout when zero
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	tiers  [][]*Tracker
+	states map[*Tracker]*TrackerState
+}
+
+// NewManager returns a manager for the announce list tiers, each shuffled
+// once. Empty urls and urls already in an earlier tier are left out.
+func NewManager(tiers [][]string) *Manager {
+	m := &Manager{states: make(map[*Tracker]*TrackerState)}
+
+	seen := make(map[string]bool)
+	for _, tier := range tiers {
+		var trackers []*Tracker
+		for _, addr := range tier {
+			addr = strings.TrimSpace(addr)
+			if addr == "" || seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			trackers = append(trackers, NewTracker(addr))
+		}
+		if len(trackers) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		for _, tr := range trackers {
+			m.states[tr] = &TrackerState{Address: tr.Address, Tier: len(m.tiers)}
+		}
+		m.tiers = append(m.tiers, trackers)
+	}
+
+	return m
+}
+
+// Len returns the number of trackers.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.states)
+}
+
+// Trackers returns the state of every tracker, tier by tier in the order they
+// are tried.
+func (m *Manager) Trackers() []TrackerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var states []TrackerState
+	for _, tier := range m.tiers {
+		for _, tr := range tier {
+			states = append(states, *m.states[tr])
+		}
+	}
+	return states
+}
+
+// Announce sends req to the trackers tier by tier, and returns the answers of
+// every tier that was announced to merged into one. It only fails when no
+// tracker answered.
+func (m *Manager) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	m.mu.Lock()
+	numTiers := len(m.tiers)
+	m.mu.Unlock()
+
+	if numTiers == 0 {
+		return nil, ErrNoTrackers
+	}
+
+	var merged *AnnounceResponse
+	var errs []error
+	for i := 0; i < numTiers; i++ {
+		resp, err := m.announceTier(ctx, i, req)
+		if err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		merged = mergeResponses(merged, resp)
+		if !m.AnnounceToAll {
+			break
+		}
+	}
+
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+	return merged, nil
+}
+
+// announceTier tries the trackers of one tier in order until one answers,
+// which is then moved to the front.
+func (m *Manager) announceTier(ctx context.Context, tier int, req AnnounceRequest) (*AnnounceResponse, error) {
+	m.mu.Lock()
+	trackers := slices.Clone(m.tiers[tier])
+	m.mu.Unlock()
+
+	var errs []error
+	for _, tr := range trackers {
+		resp, err := m.announceTracker(ctx, tr, req)
+		m.record(tr, resp, err)
+		if err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		m.promote(tier, tr)
+		return resp, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// announceTracker announces to one tracker, giving up after the timeout so a
+// tracker that never answers does not hold up the rest of its tier.
+func (m *Manager) announceTracker(ctx context.Context, tr *Tracker, req AnnounceRequest) (*AnnounceResponse, error) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = announceTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return tr.Announce(ctx, req)
+}
+
+func (m *Manager) record(tr *Tracker, resp *AnnounceResponse, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	state := m.states[tr]
+	state.LastAnnounce = now
+	state.Err = err
+	if err != nil {
+		return
+	}
+
+	state.NextAnnounce = now.Add(max(resp.Interval, resp.MinInterval))
+	state.Warning = resp.Warning
+	state.Seeders = resp.Seeders
+	state.Leechers = resp.Leechers
+	state.Peers = len(resp.Peers)
+}
+
+func (m *Manager) promote(tier int, tr *Tracker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	trackers := m.tiers[tier]
+	i := slices.Index(trackers, tr)
+	if i <= 0 {
+		return
+	}
+	copy(trackers[1:i+1], trackers[:i])
+	trackers[0] = tr
+}
+
+// mergeResponses adds the answer of another tier to merged. Peers are
+// deduplicated, and the shortest interval is kept so no tier is announced to
+// later than it asked.
+func mergeResponses(merged, resp *AnnounceResponse) *AnnounceResponse {
+	if merged == nil {
+		merged = &AnnounceResponse{
+			Interval:    resp.Interval,
+			MinInterval: resp.MinInterval,
+			TrackerID:   resp.TrackerID,
+		}
+	}
+
+	if resp.Interval > 0 && (merged.Interval == 0 || resp.Interval < merged.Interval) {
+		merged.Interval = resp.Interval
+	}
+	merged.MinInterval = max(merged.MinInterval, resp.MinInterval)
+	merged.Seeders = max(merged.Seeders, resp.Seeders)
+	merged.Leechers = max(merged.Leechers, resp.Leechers)
+	if resp.Warning != "" {
+		if merged.Warning != "" {
+			merged.Warning += "; "
+		}
+		merged.Warning += resp.Warning
+	}
+
+	seen := make(map[string]bool, len(merged.Peers))
+	for _, p := range merged.Peers {
+		seen[p.String()] = true
+	}
+	for _, p := range resp.Peers {
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			merged.Peers = append(merged.Peers, p)
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,116 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const failing = "d14:failure reason4:downe"
+
+func TestManagerTiers(t *testing.T) {
+	down := newFakeHTTPTracker(t, failing)
+	up := newFakeHTTPTracker(t, "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	backup := newFakeHTTPTracker(t, "d8:intervali60e5:peers6:\x0a\x00\x00\x02\x1a\xe1e")
+
+	m := NewManager([][]string{
+		{down.URL + "/announce", up.URL + "/announce", ""},
+		{backup.URL + "/announce", up.URL + "/announce"},
+		{},
+	})
+	if m.Len() != 3 {
+		t.Fatalf("expected 3 trackers, got %d", m.Len())
+	}
+
+	resp, err := m.Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("expected the peers of the first tier, got %v", resp.Peers)
+	}
+
+	// the working tracker is now first, whatever the shuffle was
+	states := m.Trackers()
+	if states[0].Address != up.URL+"/announce" || !states[0].Working() || states[0].Peers != 1 {
+		t.Errorf("working tracker was not promoted: %+v", states)
+	}
+	if states[2].Tier != 1 || !states[2].LastAnnounce.IsZero() {
+		t.Errorf("second tier was announced to: %+v", states[2])
+	}
+
+	// a failing first tier moves on to the next one
+	up.set(func() { up.body = failing })
+	resp, err = m.Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.2:6881" {
+		t.Errorf("expected the peers of the second tier, got %v", resp.Peers)
+	}
+	for _, s := range m.Trackers()[:2] {
+		if s.Working() || s.Err == nil {
+			t.Errorf("expected %s to have failed: %+v", s.Address, s)
+		}
+	}
+
+	backup.set(func() { backup.body = failing })
+	_, err = m.Announce(context.Background(), AnnounceRequest{})
+	var trackerErr *Error
+	if !errors.As(err, &trackerErr) {
+		t.Errorf("expected the tracker errors, got %v", err)
+	}
+}
+
+func TestManagerAnnounceToAll(t *testing.T) {
+	first := newFakeHTTPTracker(t, "d8:intervali1800e8:completei4e5:peers12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe1e")
+	second := newFakeHTTPTracker(t, "d8:intervali900e8:completei9e5:peers12:\x0a\x00\x00\x02\x1a\xe1\x0a\x00\x00\x03\x1a\xe1e")
+
+	m := NewManager([][]string{{first.URL + "/announce"}, {second.URL + "/announce"}})
+	m.AnnounceToAll = true
+
+	resp, err := m.Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if len(resp.Peers) != 3 {
+		t.Errorf("expected the peers of both tiers once, got %v", resp.Peers)
+	}
+	if resp.Interval.Seconds() != 900 || resp.Seeders != 9 {
+		t.Errorf("unexpected merged response %+v", resp)
+	}
+	for _, s := range m.Trackers() {
+		if !s.Working() {
+			t.Errorf("%s was not announced to", s.Address)
+		}
+	}
+
+	if _, err := NewManager(nil).Announce(context.Background(), AnnounceRequest{}); !errors.Is(err, ErrNoTrackers) {
+		t.Errorf("expected ErrNoTrackers, got %v", err)
+	}
+}
+
+func TestManagerTrackerTimeout(t *testing.T) {
+	stuck := newFakeHTTPTracker(t, "d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	stuck.delay = time.Minute
+	up := newFakeHTTPTracker(t, "d8:intervali60e5:peers6:\x0a\x00\x00\x02\x1a\xe1e")
+
+	m := NewManager([][]string{{stuck.URL + "/announce"}, {up.URL + "/announce"}})
+	m.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	resp, err := m.Announce(context.Background(), AnnounceRequest{})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the stuck tracker held up the announce for %v", elapsed)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.2:6881" {
+		t.Errorf("expected the peers of the working tracker, got %v", resp.Peers)
+	}
+	if s := m.Trackers()[0]; !errors.Is(s.Err, context.DeadlineExceeded) {
+		t.Errorf("expected the stuck tracker to have timed out: %+v", s)
+	}
+}
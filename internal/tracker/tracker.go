@@ -1,115 +1,155 @@
 package tracker
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
-
-	bittorrent "github.com/dmsRosa6/bittorrent-client/internal/bittorrent"
 )
 
 type TrackerEvent int
 
 const (
-	StartedEvent TrackerEvent = iota
-	PausedEvent
+	// NoneEvent is a regular announce
+	NoneEvent TrackerEvent = iota
+	StartedEvent
 	StoppedEvent
+	CompletedEvent
 )
 
 var EventName = map[TrackerEvent]string{
-	StartedEvent: "started",
-	PausedEvent:  "paused",
-	StoppedEvent: "stopped",
+	NoneEvent:      "",
+	StartedEvent:   "started",
+	StoppedEvent:   "stopped",
+	CompletedEvent: "completed",
 }
 
-type Tracker struct {
-	Address             string
-	lastPeerRequest     time.Time
-	peerRequestInterval time.Duration
-	UpdatePeers		chan<- []net.Addr
+var (
+	ErrUnsupportedScheme = errors.New("tracker: unsupported url scheme")
+	ErrScrapeUnsupported = errors.New("tracker: scrape not supported")
+)
+
+// Error is a failure reported by the tracker itself.
+type Error struct {
+	Reason string
 }
 
-func NewTracker(address string) *Tracker {
-	c := make(chan []net.Addr)
-	return &Tracker{
-		Address:             address,
-		lastPeerRequest:     time.Time{},
-		peerRequestInterval: 30 * time.Minute,
-		UpdatePeers:c,
-	}
+func (e *Error) Error() string {
+	return "tracker: " + e.Reason
 }
 
-func (t *Tracker) Update(torrent *bittorrent.Torrent, ev TrackerEvent, id string, port int) error {
-	now := time.Now().UTC()
+// AnnounceRequest is what we tell a tracker about a torrent.
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      TrackerEvent
+	// NumWant is how many peers we want, the tracker default when zero
+	NumWant int
+	// Key identifies us to the tracker when our IP changes
+	Key uint32
+	// IPv6 is our global IPv6 address, sent to HTTP trackers so peers can
+	// reach us over IPv6 while we announce over IPv4 (BEP 7)
+	IPv6 net.IP
+}
 
-	if ev == StartedEvent && now.Before(t.lastPeerRequest.Add(t.peerRequestInterval)) {
-		return nil
-	}
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Peers       []net.Addr
+	TrackerID   string
+	Warning     string
+}
+
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+	// Name is only sent by some HTTP trackers
+	Name string
+}
+
+type Tracker struct {
+	Address string
 
-	t.lastPeerRequest = now
-
-	url := fmt.Sprintf("%s?info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&event=%s&compact=1",
-		t.Address,
-		torrent.UrlSafeStringInfohash(),
-		id,
-		port,
-		torrent.Uploaded,
-		torrent.Downloaded,
-		torrent.Left(),
-		EventName[ev],
-	)
-
-	t.request(url)
-	return nil
+	client *http.Client
+
+	mu sync.Mutex
+	// id the tracker asked to be sent back on every announce
+	id string
+
+	udpOnce sync.Once
+	udp     *udpTracker
 }
 
-func (t *Tracker) ResetLastRequest() {
-	t.lastPeerRequest = time.Time{}
+func NewTracker(address string) *Tracker {
+	return &Tracker{
+		Address: address,
+		client:  &http.Client{Timeout: httpTimeout},
+	}
 }
 
-func (t *Tracker) request(url string) error {
-	resp, err := http.Get(url)
+// Announce sends req over the protocol of the tracker url, HTTP or UDP.
+func (t *Tracker) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(t.Address)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response:", err)
-		return err
+	switch u.Scheme {
+	case "http", "https":
+		return t.announceHTTP(ctx, req)
+	case "udp":
+		return t.udpTracker(u).announce(ctx, req)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
 	}
+}
 
-	bencode := bittorrent.BEncoding{}
-	m, err := bencode.Decode(body)
+// Scrape asks the tracker for the swarm counts of infoHashes.
+func (t *Tracker) Scrape(ctx context.Context, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(t.Address)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	trackerInfo := m.(map[string]any)
-	t.peerRequestInterval, err = time.ParseDuration(trackerInfo["interval"].(string))
-	if err != nil {
-		return err
+	switch u.Scheme {
+	case "udp":
+		return t.udpTracker(u).scrape(ctx, infoHashes)
+	case "http", "https":
+		return t.scrapeHTTP(ctx, infoHashes)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
 	}
+}
 
-	peerInfo := trackerInfo["peers"].([]byte)
+func (t *Tracker) trackerID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	var peers []net.Addr
+	return t.id
+}
 
-	for i := 0; i+6 <= len(peerInfo); i += 6 {
-		ip := net.IPv4(peerInfo[i], peerInfo[i+1], peerInfo[i+2], peerInfo[i+3])
-		port := int(binary.BigEndian.Uint16(peerInfo[i+4 : i+6]))
-		addr := &net.TCPAddr{
-			IP:   ip,
-			Port: port,
-		}
-		peers = append(peers, addr)
-	}
+func (t *Tracker) setTrackerID(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	t.UpdatePeers <- peers
-	return nil
-}
\ No newline at end of file
+	t.id = id
+}
+
+// udpTracker keeps one client per tracker so the connection id is reused.
+func (t *Tracker) udpTracker(u *url.URL) *udpTracker {
+	t.udpOnce.Do(func() {
+		t.udp = newUDPTracker(u.Host)
+	})
+	return t.udp
+}
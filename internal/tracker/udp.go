@@ -0,0 +1,294 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// a connection id can be used for a minute after we got it
+	udpConnectionTTL = time.Minute
+
+	// requests are sent again after 15 * 2^n seconds, up to n = 8
+	udpBaseTimeout = 15 * time.Second
+	udpMaxRetries  = 8
+
+	// infohashes in one scrape, to stay in one packet
+	udpMaxScrapeHashes = 74
+
+	udpEventNone      = 0
+	udpEventCompleted = 1
+	udpEventStarted   = 2
+	udpEventStopped   = 3
+)
+
+var (
+	ErrTimeout          = errors.New("tracker: no response")
+	ErrMalformedUDP     = errors.New("tracker: malformed udp response")
+	errUDPAttemptFailed = errors.New("tracker: udp attempt timed out")
+)
+
+var udpEvents = map[TrackerEvent]uint32{
+	NoneEvent:      udpEventNone,
+	StartedEvent:   udpEventStarted,
+	StoppedEvent:   udpEventStopped,
+	CompletedEvent: udpEventCompleted,
+}
+
+type udpTracker struct {
+	host string
+	// base of the retransmission schedule, udpBaseTimeout outside tests
+	timeout    time.Duration
+	maxRetries int
+
+	mu          sync.Mutex
+	connID      uint64
+	connExpires time.Time
+}
+
+func newUDPTracker(host string) *udpTracker {
+	return &udpTracker{host: host, timeout: udpBaseTimeout, maxRetries: udpMaxRetries}
+}
+
+func (u *udpTracker) connectionID() (uint64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.connID, time.Now().Before(u.connExpires)
+}
+
+func (u *udpTracker) setConnectionID(id uint64, expires time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.connID = id
+	u.connExpires = expires
+}
+
+// do sends a request until it gets a response, waiting 15 * 2^n seconds for
+// the n-th attempt. It gets a new connection id first whenever the cached one
+// has expired.
+func (u *udpTracker) do(ctx context.Context, action uint32, body []byte) ([]byte, *net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", u.host)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for n := 0; n <= u.maxRetries; n++ {
+		if err := ctx.Err(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		timeout := u.timeout << n
+
+		connID, ok := u.connectionID()
+		if !ok {
+			payload, err := u.exchange(ctx, conn, udpProtocolID, udpActionConnect, nil, timeout)
+			if errors.Is(err, errUDPAttemptFailed) {
+				continue
+			}
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+			if len(payload) < 8 {
+				conn.Close()
+				return nil, nil, ErrMalformedUDP
+			}
+			connID = binary.BigEndian.Uint64(payload)
+			u.setConnectionID(connID, time.Now().Add(udpConnectionTTL))
+		}
+
+		payload, err := u.exchange(ctx, conn, connID, action, body, timeout)
+		if errors.Is(err, errUDPAttemptFailed) {
+			continue
+		}
+		if err != nil {
+			// the tracker may have refused the connection id, get a new
+			// one next time
+			var trackerErr *Error
+			if errors.As(err, &trackerErr) {
+				u.setConnectionID(0, time.Time{})
+			}
+			conn.Close()
+			return nil, nil, err
+		}
+		return payload, conn, nil
+	}
+
+	conn.Close()
+	return nil, nil, ErrTimeout
+}
+
+// exchange sends one request and returns the payload of the response with the
+// same transaction id, after the action and transaction id.
+func (u *udpTracker) exchange(ctx context.Context, conn *net.UDPConn, connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	var tid [4]byte
+	rand.Read(tid[:])
+
+	packet := binary.BigEndian.AppendUint64(nil, connID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = append(packet, tid[:]...)
+	packet = append(packet, body...)
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctxDeadline, ok := ctx.Deadline()
+	if ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	// a cancel that landed before this deadline was set would be overwritten
+	// by it, the AfterFunc does not run twice
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && deadline.Equal(ctxDeadline) {
+				return nil, context.DeadlineExceeded
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, errUDPAttemptFailed
+			}
+			return nil, err
+		}
+
+		// anything that is not an answer to this request is dropped
+		if n < 8 || [4]byte(buf[4:8]) != tid {
+			continue
+		}
+
+		got := binary.BigEndian.Uint32(buf[:4])
+		if got == udpActionError {
+			return nil, &Error{Reason: string(buf[8:n])}
+		}
+		if got != action {
+			return nil, ErrMalformedUDP
+		}
+		return append([]byte(nil), buf[8:n]...), nil
+	}
+}
+
+func (u *udpTracker) announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+
+	body := make([]byte, 0, 82)
+	body = append(body, req.InfoHash[:]...)
+	body = append(body, req.PeerID[:]...)
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, udpEvents[req.Event])
+	body = binary.BigEndian.AppendUint32(body, 0) // ip, the one we send from
+	body = binary.BigEndian.AppendUint32(body, req.Key)
+	body = binary.BigEndian.AppendUint32(body, uint32(numWant))
+	body = binary.BigEndian.AppendUint16(body, uint16(req.Port))
+
+	payload, conn, err := u.do(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if len(payload) < 12 {
+		return nil, ErrMalformedUDP
+	}
+
+	// trackers reached over IPv6 answer with IPv6 peers
+	peerLen := 6
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		peerLen = 18
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(payload[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(payload[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(payload[8:12])),
+		Peers:    parseCompactPeers(payload[12:], peerLen),
+	}, nil
+}
+
+func (u *udpTracker) scrape(ctx context.Context, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), udpMaxScrapeHashes)]
+		infoHashes = infoHashes[len(batch):]
+
+		body := make([]byte, 0, len(batch)*20)
+		for _, infoHash := range batch {
+			body = append(body, infoHash[:]...)
+		}
+
+		payload, conn, err := u.do(ctx, udpActionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+
+		if len(payload) < len(batch)*12 {
+			return nil, ErrMalformedUDP
+		}
+		for i, infoHash := range batch {
+			entry := payload[i*12:]
+			results[infoHash] = ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// parseCompactPeers reads peers of peerLen bytes each, an IPv4 or IPv6
+// address followed by the port.
+func parseCompactPeers(b []byte, peerLen int) []net.Addr {
+	var peers []net.Addr
+	for i := 0; i+peerLen <= len(b); i += peerLen {
+		ip := net.IP(append([]byte(nil), b[i:i+peerLen-2]...))
+		port := int(binary.BigEndian.Uint16(b[i+peerLen-2 : i+peerLen]))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return peers
+}
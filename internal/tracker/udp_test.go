@@ -0,0 +1,287 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on loopback.
+type fakeUDPTracker struct {
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	connects  int
+	announces [][]byte
+	// requests to ignore before answering, to test retransmission
+	drop int
+	// when set every announce gets this error
+	failure string
+}
+
+func newFakeUDPTracker(t *testing.T, network string, ip net.IP) *fakeUDPTracker {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeUDPTracker{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) tracker() *Tracker {
+	tr := NewTracker("udp://" + f.conn.LocalAddr().String() + "/announce")
+	u, _ := url.Parse(tr.Address)
+	tr.udpTracker(u).timeout = 20 * time.Millisecond
+	return tr
+}
+
+func (f *fakeUDPTracker) set(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+func (f *fakeUDPTracker) serve() {
+	const connID = 0x1122334455667788
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+
+		f.mu.Lock()
+		if f.drop > 0 {
+			f.drop--
+			f.mu.Unlock()
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(req[8:12])
+		resp := binary.BigEndian.AppendUint32(nil, action)
+		resp = append(resp, req[12:16]...)
+
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(req) == udpProtocolID:
+			f.connects++
+			resp = binary.BigEndian.AppendUint64(resp, connID)
+
+		case binary.BigEndian.Uint64(req) != connID:
+			resp = binary.BigEndian.AppendUint32(nil, udpActionError)
+			resp = append(resp, req[12:16]...)
+			resp = append(resp, "bad connection id"...)
+
+		case action == udpActionAnnounce && f.failure != "":
+			resp = binary.BigEndian.AppendUint32(nil, udpActionError)
+			resp = append(resp, req[12:16]...)
+			resp = append(resp, f.failure...)
+
+		case action == udpActionAnnounce:
+			f.announces = append(f.announces, req[16:])
+			resp = binary.BigEndian.AppendUint32(resp, 1800)
+			resp = binary.BigEndian.AppendUint32(resp, 3)
+			resp = binary.BigEndian.AppendUint32(resp, 7)
+			if addr.IP.To4() != nil {
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+				resp = append(resp, 10, 0, 0, 2, 0x1a, 0xe2)
+			} else {
+				resp = append(resp, net.ParseIP("2001:db8::1")...)
+				resp = append(resp, 0x1a, 0xe1)
+			}
+
+		case action == udpActionScrape:
+			for i := 16; i+20 <= len(req); i += 20 {
+				resp = binary.BigEndian.AppendUint32(resp, uint32(req[i]))
+				resp = binary.BigEndian.AppendUint32(resp, 100)
+				resp = binary.BigEndian.AppendUint32(resp, 5)
+			}
+		}
+		f.mu.Unlock()
+
+		// a stray packet with another transaction id must be ignored
+		f.conn.WriteToUDP([]byte{0, 0, 0, 1, 9, 9, 9, 9}, addr)
+		f.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", net.IPv4(127, 0, 0, 1))
+	tr := f.tracker()
+
+	req := AnnounceRequest{
+		InfoHash:   [20]byte{1, 2, 3},
+		PeerID:     [20]byte{'-', 'B', 'C'},
+		Port:       6881,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+		Event:      StartedEvent,
+		NumWant:    50,
+		Key:        0xdeadbeef,
+	}
+
+	resp, err := tr.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if resp.Interval != 30*time.Minute || resp.Leechers != 3 || resp.Seeders != 7 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+
+	var body []byte
+	f.set(func() { body = f.announces[0] })
+	if len(body) != 82 {
+		t.Fatalf("announce body is %d bytes, want 82", len(body))
+	}
+	if [20]byte(body[0:20]) != req.InfoHash || [20]byte(body[20:40]) != req.PeerID {
+		t.Errorf("wrong info hash or peer id")
+	}
+	if binary.BigEndian.Uint64(body[40:48]) != 20 || binary.BigEndian.Uint64(body[48:56]) != 30 || binary.BigEndian.Uint64(body[56:64]) != 10 {
+		t.Errorf("wrong downloaded, left or uploaded")
+	}
+	if binary.BigEndian.Uint32(body[64:68]) != udpEventStarted {
+		t.Errorf("wrong event %d", binary.BigEndian.Uint32(body[64:68]))
+	}
+	if binary.BigEndian.Uint32(body[72:76]) != 0xdeadbeef || binary.BigEndian.Uint32(body[76:80]) != 50 {
+		t.Errorf("wrong key or numwant")
+	}
+	if binary.BigEndian.Uint16(body[80:82]) != 6881 {
+		t.Errorf("wrong port")
+	}
+
+	// the connection id is reused while it is fresh
+	req.Event, req.NumWant = NoneEvent, 0
+	if _, err := tr.Announce(context.Background(), req); err != nil {
+		t.Fatalf("second announce: %v", err)
+	}
+	var connects int
+	f.set(func() { connects, body = f.connects, f.announces[1] })
+	if connects != 1 {
+		t.Errorf("expected one connect, got %d", connects)
+	}
+	if numWant := int32(binary.BigEndian.Uint32(body[76:80])); numWant != -1 {
+		t.Errorf("expected default numwant -1, got %d", numWant)
+	}
+
+	// and renewed once it expires
+	tr.udp.connExpires = time.Now().Add(-time.Second)
+	if _, err := tr.Announce(context.Background(), req); err != nil {
+		t.Fatalf("third announce: %v", err)
+	}
+	f.set(func() { connects = f.connects })
+	if connects != 2 {
+		t.Errorf("expected a second connect, got %d", connects)
+	}
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp6", net.IPv6loopback)
+
+	resp, err := f.tracker().Announce(context.Background(), AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", net.IPv4(127, 0, 0, 1))
+	tr := f.tracker()
+
+	// lose the first connect
+	f.set(func() { f.drop = 1 })
+
+	start := time.Now()
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	// 20ms for the lost connect
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("answered after %v, before the first timeout", elapsed)
+	}
+
+	// nothing answers at all
+	f.set(func() { f.drop = 1000 })
+	tr.udp.maxRetries = 2
+	if _, err := tr.Announce(context.Background(), AnnounceRequest{}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	tr.udp.maxRetries = udpMaxRetries
+	if _, err := tr.Announce(ctx, AnnounceRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context deadline, got %v", err)
+	}
+	// once canceled no attempt is started, it could wait out its timeout
+	tr.udp.timeout = time.Minute
+	f.set(func() { f.drop = 1000 })
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if _, err := tr.Announce(ctx, AnnounceRequest{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled announce returned after %v", elapsed)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f.set(func() {
+		if f.drop != 1000 {
+			t.Errorf("sent %d requests after the cancel", 1000-f.drop)
+		}
+	})
+}
+
+func TestUDPError(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", net.IPv4(127, 0, 0, 1))
+	f.set(func() { f.failure = "torrent not registered" })
+
+	_, err := f.tracker().Announce(context.Background(), AnnounceRequest{})
+	var trackerErr *Error
+	if !errors.As(err, &trackerErr) || trackerErr.Reason != "torrent not registered" {
+		t.Errorf("expected tracker error, got %v", err)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", net.IPv4(127, 0, 0, 1))
+
+	// more than fit in one packet
+	var hashes [][20]byte
+	for i := 0; i < udpMaxScrapeHashes+6; i++ {
+		hashes = append(hashes, [20]byte{byte(i)})
+	}
+
+	results, err := f.tracker().Scrape(context.Background(), hashes)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("expected %d results, got %d", len(hashes), len(results))
+	}
+	if r := results[[20]byte{42}]; r.Seeders != 42 || r.Completed != 100 || r.Leechers != 5 {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, err := NewTracker("wss://tracker.example/announce").Announce(context.Background(), AnnounceRequest{})
+	if !errors.Is(err, ErrUnsupportedScheme) {
+		t.Errorf("expected ErrUnsupportedScheme, got %v", err)
+	}
+}
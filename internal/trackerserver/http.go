@@ -0,0 +1,188 @@
+package trackerserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+var errBadRequest = errors.New("invalid request")
+
+// Handler serves /announce and /scrape.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.handleAnnounce)
+	mux.HandleFunc("/scrape", s.handleScrape)
+	return mux
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeFailure(w, errBadRequest)
+		return
+	}
+
+	req, err := parseAnnounceQuery(q)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		writeFailure(w, errBadRequest)
+		return
+	}
+
+	resp, err := s.Announce(req, ip)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	body := map[string]any{
+		"interval":     int64(resp.Interval.Seconds()),
+		"min interval": int64(resp.MinInterval.Seconds()),
+		"complete":     int64(resp.Seeders),
+		"incomplete":   int64(resp.Leechers),
+	}
+
+	if q.Get("compact") == "0" {
+		peers := make([]any, 0, len(resp.Peers))
+		for _, p := range resp.Peers {
+			addr := p.(*net.TCPAddr)
+			peers = append(peers, map[string]any{"ip": addr.IP.String(), "port": int64(addr.Port)})
+		}
+		body["peers"] = peers
+	} else {
+		peers, peers6 := compactPeers(resp.Peers)
+		body["peers"] = peers
+		if len(peers6) > 0 {
+			body["peers6"] = peers6
+		}
+	}
+
+	writeBencode(w, body)
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	q, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeFailure(w, errBadRequest)
+		return
+	}
+
+	var infoHashes [][20]byte
+	for _, v := range q["info_hash"] {
+		if len(v) != 20 {
+			writeFailure(w, fmt.Errorf("%w: info_hash", errBadRequest))
+			return
+		}
+		infoHashes = append(infoHashes, [20]byte([]byte(v)))
+	}
+
+	results, err := s.Scrape(infoHashes)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	files := make(map[string]any, len(results))
+	for infoHash, r := range results {
+		files[string(infoHash[:])] = map[string]any{
+			"complete":   int64(r.Seeders),
+			"downloaded": int64(r.Completed),
+			"incomplete": int64(r.Leechers),
+		}
+	}
+	writeBencode(w, map[string]any{
+		"files": files,
+		"flags": map[string]any{"min_request_interval": int64(s.cfg.MinInterval.Seconds())},
+	})
+}
+
+func parseAnnounceQuery(q url.Values) (tracker.AnnounceRequest, error) {
+	var req tracker.AnnounceRequest
+
+	infoHash, peerID := q.Get("info_hash"), q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		return req, fmt.Errorf("%w: info_hash and peer_id must be 20 bytes", errBadRequest)
+	}
+	req.InfoHash = [20]byte([]byte(infoHash))
+	req.PeerID = [20]byte([]byte(peerID))
+
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil {
+		return req, fmt.Errorf("%w: port", errBadRequest)
+	}
+	req.Port = port
+
+	for name, dst := range map[string]*int64{
+		"uploaded":   &req.Uploaded,
+		"downloaded": &req.Downloaded,
+		"left":       &req.Left,
+	} {
+		n, err := strconv.ParseInt(q.Get(name), 10, 64)
+		if err != nil || n < 0 {
+			return req, fmt.Errorf("%w: %s", errBadRequest, name)
+		}
+		*dst = n
+	}
+
+	if v := q.Get("numwant"); v != "" {
+		req.NumWant, _ = strconv.Atoi(v)
+	}
+
+	// only the plain address form of ipv6 is understood, the peer is
+	// reachable on the port it announced
+	if v := q.Get("ipv6"); v != "" {
+		req.IPv6 = net.ParseIP(v)
+	}
+
+	// unknown events, like empty or paused, are regular announces
+	ev := q.Get("event")
+	for event, name := range tracker.EventName {
+		if name != "" && name == ev {
+			req.Event = event
+		}
+	}
+
+	return req, nil
+}
+
+// compactPeers splits peers into the compact IPv4 and IPv6 forms.
+func compactPeers(peers []net.Addr) (peers4, peers6 []byte) {
+	peers4, peers6 = []byte{}, []byte{}
+	for _, p := range peers {
+		addr := p.(*net.TCPAddr)
+		if v4 := addr.IP.To4(); v4 != nil {
+			peers4 = binary.BigEndian.AppendUint16(append(peers4, v4...), uint16(addr.Port))
+		} else {
+			peers6 = binary.BigEndian.AppendUint16(append(peers6, addr.IP.To16()...), uint16(addr.Port))
+		}
+	}
+	return peers4, peers6
+}
+
+func writeFailure(w http.ResponseWriter, err error) {
+	writeBencode(w, map[string]any{"failure reason": err.Error()})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
@@ -0,0 +1,294 @@
+// Package trackerserver is a BitTorrent tracker, answering announces and
+// scrapes over HTTP and UDP (BEP 15) from an in-memory list of swarms.
+package trackerserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+const (
+	DefaultInterval    = 30 * time.Minute
+	DefaultMinInterval = 5 * time.Minute
+
+	// peers returned when the client does not say how many it wants, and the
+	// most it can get
+	defaultNumWant = 50
+	maxNumWant     = 200
+
+	// how often expired peers are dropped
+	reapInterval = time.Minute
+)
+
+var (
+	ErrNotRegistered = errors.New("torrent not registered")
+	ErrInvalidPort   = errors.New("invalid port")
+	ErrNoListener    = errors.New("trackerserver: no http or udp address")
+	ErrFullScrape    = errors.New("full scrape not allowed")
+)
+
+type Config struct {
+	// HTTPAddr and UDPAddr are where to listen, empty to not serve that
+	// protocol
+	HTTPAddr string
+	UDPAddr  string
+
+	// Interval is how often clients should announce, DefaultInterval when
+	// zero, and MinInterval how often they may
+	Interval    time.Duration
+	MinInterval time.Duration
+
+	// PeerTTL is how long a peer stays without announcing, twice the
+	// interval when zero
+	PeerTTL time.Duration
+
+	// Whitelist restricts the tracker to these torrents when not empty
+	Whitelist [][20]byte
+}
+
+type Server struct {
+	cfg       Config
+	whitelist map[[20]byte]bool
+
+	// signs the UDP connection ids
+	secret [32]byte
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+
+	httpServer *http.Server
+	httpLn     net.Listener
+	udpConn    *net.UDPConn
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+}
+
+func New(cfg Config) *Server {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = min(DefaultMinInterval, cfg.Interval)
+	}
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = 2 * cfg.Interval
+	}
+
+	s := &Server{
+		cfg:    cfg,
+		swarms: make(map[[20]byte]*swarm),
+		done:   make(chan struct{}),
+	}
+	if len(cfg.Whitelist) > 0 {
+		s.whitelist = make(map[[20]byte]bool, len(cfg.Whitelist))
+		for _, infoHash := range cfg.Whitelist {
+			s.whitelist[infoHash] = true
+		}
+	}
+	rand.Read(s.secret[:])
+
+	return s
+}
+
+// Start listens on the configured addresses and serves in the background
+// until Close.
+func (s *Server) Start() error {
+	if s.cfg.HTTPAddr == "" && s.cfg.UDPAddr == "" {
+		return ErrNoListener
+	}
+
+	if s.cfg.HTTPAddr != "" {
+		ln, err := net.Listen("tcp", s.cfg.HTTPAddr)
+		if err != nil {
+			return err
+		}
+		s.httpLn = ln
+		s.httpServer = &http.Server{
+			Handler:           s.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.httpServer.Serve(ln)
+		}()
+	}
+
+	if s.cfg.UDPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", s.cfg.UDPAddr)
+		if err == nil {
+			s.udpConn, err = net.ListenUDP("udp", addr)
+		}
+		if err != nil {
+			if s.httpServer != nil {
+				s.httpServer.Close()
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveUDP()
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.reapLoop()
+	}()
+
+	return nil
+}
+
+// HTTPAddr returns the address the HTTP tracker listens on, nil when not
+// serving HTTP.
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpLn == nil {
+		return nil
+	}
+	return s.httpLn.Addr()
+}
+
+// UDPAddr returns the address the UDP tracker listens on, nil when not
+// serving UDP.
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// Close stops serving, calling it again does nothing.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		var errs []error
+		if s.httpServer != nil {
+			errs = append(errs, s.httpServer.Close())
+		}
+		if s.udpConn != nil {
+			errs = append(errs, s.udpConn.Close())
+		}
+		s.wg.Wait()
+
+		s.closeErr = errors.Join(errs...)
+	})
+	return s.closeErr
+}
+
+// Announce records the announce of the peer at ip and returns the peers it
+// should connect to.
+func (s *Server) Announce(req tracker.AnnounceRequest, ip net.IP) (*tracker.AnnounceResponse, error) {
+	if s.whitelist != nil && !s.whitelist[req.InfoHash] {
+		return nil, ErrNotRegistered
+	}
+	if req.Port <= 0 || req.Port > 65535 {
+		return nil, ErrInvalidPort
+	}
+
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[req.InfoHash]
+	if !ok {
+		if req.Event == tracker.StoppedEvent {
+			return &tracker.AnnounceResponse{Interval: s.cfg.Interval, MinInterval: s.cfg.MinInterval}, nil
+		}
+		sw = newSwarm()
+		s.swarms[req.InfoHash] = sw
+	}
+
+	peers := sw.update(req, ip, time.Now(), numWant)
+	seeders, leechers := sw.counts()
+	if len(sw.peers) == 0 {
+		// the completed count is lost with the swarm, like everything a
+		// restart would lose
+		delete(s.swarms, req.InfoHash)
+	}
+
+	return &tracker.AnnounceResponse{
+		Interval:    s.cfg.Interval,
+		MinInterval: s.cfg.MinInterval,
+		Seeders:     seeders,
+		Leechers:    leechers,
+		Peers:       peers,
+	}, nil
+}
+
+// Scrape returns the counts of the torrents in infoHashes that have a swarm,
+// or of every torrent when infoHashes is empty and there is no whitelist.
+func (s *Server) Scrape(infoHashes [][20]byte) (map[[20]byte]tracker.ScrapeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		if s.whitelist != nil {
+			return nil, ErrFullScrape
+		}
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	results := make(map[[20]byte]tracker.ScrapeResult, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if s.whitelist != nil && !s.whitelist[infoHash] {
+			continue
+		}
+		var r tracker.ScrapeResult
+		if sw, ok := s.swarms[infoHash]; ok {
+			r.Seeders, r.Leechers = sw.counts()
+			r.Completed = sw.completed
+		}
+		results[infoHash] = r
+	}
+	return results, nil
+}
+
+func (s *Server) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+		}
+	}
+}
+
+// expire drops the peers that did not announce within the peer TTL of now.
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, sw := range s.swarms {
+		sw.expire(now.Add(-s.cfg.PeerTTL))
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
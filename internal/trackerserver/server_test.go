@@ -0,0 +1,315 @@
+package trackerserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/bencode"
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+func newTestServer(t *testing.T, cfg Config) *Server {
+	if cfg.HTTPAddr == "" && cfg.UDPAddr == "" {
+		cfg.HTTPAddr, cfg.UDPAddr = "127.0.0.1:0", "127.0.0.1:0"
+	}
+	s := New(cfg)
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func announceRequest(peer byte, port int, left int64, ev tracker.TrackerEvent) tracker.AnnounceRequest {
+	return tracker.AnnounceRequest{
+		InfoHash: [20]byte{0xaa},
+		PeerID:   [20]byte{peer},
+		Port:     port,
+		Left:     left,
+		Event:    ev,
+	}
+}
+
+// testSwarm runs the same announces and scrapes against the tracker at url.
+func testSwarm(t *testing.T, url string) {
+	ctx := context.Background()
+	tr := tracker.NewTracker(url)
+
+	resp, err := tr.Announce(ctx, announceRequest(1, 6881, 0, tracker.StartedEvent))
+	if err != nil {
+		t.Fatalf("first announce: %v", err)
+	}
+	if len(resp.Peers) != 0 || resp.Seeders != 1 || resp.Interval != DefaultInterval {
+		t.Errorf("unexpected first response %+v", resp)
+	}
+
+	resp, err = tr.Announce(ctx, announceRequest(2, 6882, 100, tracker.StartedEvent))
+	if err != nil {
+		t.Fatalf("second announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("expected the seeder, got %v", resp.Peers)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 {
+		t.Errorf("expected 1 seeder and 1 leecher, got %+v", resp)
+	}
+
+	// a seeder only gets leechers
+	if _, err := tr.Announce(ctx, announceRequest(3, 6883, 0, tracker.StartedEvent)); err != nil {
+		t.Fatalf("third announce: %v", err)
+	}
+	resp, err = tr.Announce(ctx, announceRequest(1, 6881, 0, tracker.NoneEvent))
+	if err != nil {
+		t.Fatalf("fourth announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6882" {
+		t.Errorf("expected only the leecher, got %v", resp.Peers)
+	}
+
+	if _, err := tr.Announce(ctx, announceRequest(2, 6882, 0, tracker.CompletedEvent)); err != nil {
+		t.Fatalf("completed announce: %v", err)
+	}
+	if _, err := tr.Announce(ctx, announceRequest(3, 6883, 0, tracker.StoppedEvent)); err != nil {
+		t.Fatalf("stopped announce: %v", err)
+	}
+
+	results, err := tr.Scrape(ctx, [][20]byte{{0xaa}, {0xbb}})
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	if r := results[[20]byte{0xaa}]; r.Seeders != 2 || r.Leechers != 0 || r.Completed != 1 {
+		t.Errorf("unexpected scrape %+v", r)
+	}
+	if r := results[[20]byte{0xbb}]; r.Seeders != 0 || r.Leechers != 0 {
+		t.Errorf("unexpected scrape of an unknown torrent %+v", r)
+	}
+}
+
+func TestHTTPTracker(t *testing.T) {
+	s := newTestServer(t, Config{HTTPAddr: "127.0.0.1:0"})
+	testSwarm(t, "http://"+s.HTTPAddr().String()+"/announce")
+}
+
+func TestUDPTracker(t *testing.T) {
+	s := newTestServer(t, Config{UDPAddr: "127.0.0.1:0"})
+	testSwarm(t, "udp://"+s.UDPAddr().String())
+}
+
+func TestIPv6Peers(t *testing.T) {
+	s := newTestServer(t, Config{HTTPAddr: "[::]:0", UDPAddr: "[::]:0"})
+	ctx := context.Background()
+	port := s.HTTPAddr().(*net.TCPAddr).Port
+	udpPort := s.UDPAddr().(*net.UDPAddr).Port
+
+	v4 := tracker.NewTracker("http://127.0.0.1:" + strconv.Itoa(port) + "/announce")
+	v6 := tracker.NewTracker("http://[::1]:" + strconv.Itoa(port) + "/announce")
+	if _, err := v4.Announce(ctx, announceRequest(1, 6881, 0, tracker.StartedEvent)); err != nil {
+		t.Fatalf("ipv4 announce: %v", err)
+	}
+	if _, err := v6.Announce(ctx, announceRequest(2, 6882, 0, tracker.StartedEvent)); err != nil {
+		t.Fatalf("ipv6 announce: %v", err)
+	}
+
+	// HTTP gives both families, in peers and peers6
+	resp, err := v4.Announce(ctx, announceRequest(3, 6883, 10, tracker.StartedEvent))
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if len(resp.Peers) != 2 {
+		t.Errorf("expected peers of both families, got %v", resp.Peers)
+	}
+
+	// UDP only the family of the request
+	udp6 := tracker.NewTracker("udp://[::1]:" + strconv.Itoa(udpPort))
+	resp, err = udp6.Announce(ctx, announceRequest(4, 6884, 10, tracker.StartedEvent))
+	if err != nil {
+		t.Fatalf("udp announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[::1]:6882" {
+		t.Errorf("expected the IPv6 seeder, got %v", resp.Peers)
+	}
+
+	// an IPv4 announce can name the IPv6 address of the peer too
+	req := announceRequest(5, 6885, 0, tracker.StartedEvent)
+	req.IPv6 = net.ParseIP("2001:db8::5")
+	if _, err := v4.Announce(ctx, req); err != nil {
+		t.Fatalf("announce with ipv6: %v", err)
+	}
+	resp, err = udp6.Announce(ctx, announceRequest(4, 6884, 10, tracker.NoneEvent))
+	if err != nil {
+		t.Fatalf("udp announce: %v", err)
+	}
+	found := false
+	for _, p := range resp.Peers {
+		found = found || p.String() == "[2001:db8::5]:6885"
+	}
+	if !found || len(resp.Peers) != 2 {
+		t.Errorf("expected the ipv6 address of the IPv4 peer, got %v", resp.Peers)
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	s := newTestServer(t, Config{Whitelist: [][20]byte{{0xaa}}})
+	ctx := context.Background()
+
+	for _, u := range []string{"http://" + s.HTTPAddr().String() + "/announce", "udp://" + s.UDPAddr().String()} {
+		tr := tracker.NewTracker(u)
+		if _, err := tr.Announce(ctx, announceRequest(1, 6881, 0, tracker.StartedEvent)); err != nil {
+			t.Errorf("%s: whitelisted announce: %v", u, err)
+		}
+
+		req := announceRequest(1, 6881, 0, tracker.StartedEvent)
+		req.InfoHash = [20]byte{0xbb}
+		_, err := tr.Announce(ctx, req)
+		var trackerErr *tracker.Error
+		if !errors.As(err, &trackerErr) || trackerErr.Reason != ErrNotRegistered.Error() {
+			t.Errorf("%s: expected torrent not registered, got %v", u, err)
+		}
+	}
+
+	if _, err := s.Scrape(nil); !errors.Is(err, ErrFullScrape) {
+		t.Errorf("expected ErrFullScrape, got %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := New(Config{Interval: time.Minute})
+
+	if _, err := s.Announce(announceRequest(1, 6881, 0, tracker.StartedEvent), net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	s.expire(time.Now().Add(time.Minute))
+	if results, _ := s.Scrape(nil); results[[20]byte{0xaa}].Seeders != 1 {
+		t.Errorf("peer expired before its ttl")
+	}
+
+	s.expire(time.Now().Add(3 * time.Minute))
+	if results, _ := s.Scrape(nil); len(results) != 0 {
+		t.Errorf("expected the swarm to be gone, got %v", results)
+	}
+
+	if _, err := s.Announce(announceRequest(1, 0, 0, tracker.StartedEvent), net.IPv4(10, 0, 0, 1)); !errors.Is(err, ErrInvalidPort) {
+		t.Errorf("expected ErrInvalidPort, got %v", err)
+	}
+}
+
+func TestHTTPNonCompact(t *testing.T) {
+	s := newTestServer(t, Config{HTTPAddr: "127.0.0.1:0"})
+	if _, err := s.Announce(announceRequest(1, 6881, 0, tracker.StartedEvent), net.IPv4(10, 0, 0, 1)); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+
+	hash := [20]byte{0xaa}
+	q := url.Values{}
+	q.Set("info_hash", string(hash[:]))
+	q.Set("peer_id", string(make([]byte, 20)))
+	q.Set("port", "6882")
+	q.Set("uploaded", "0")
+	q.Set("downloaded", "0")
+	q.Set("left", "10")
+	q.Set("compact", "0")
+
+	resp, err := http.Get("http://" + s.HTTPAddr().String() + "/announce?" + q.Encode())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var r struct {
+		Peers []struct {
+			IP   string `bencode:"ip"`
+			Port int64  `bencode:"port"`
+		} `bencode:"peers"`
+	}
+	if err := bencode.Unmarshal(body, &r); err != nil {
+		t.Fatalf("decode %q: %v", body, err)
+	}
+	if len(r.Peers) != 1 || r.Peers[0].IP != "10.0.0.1" || r.Peers[0].Port != 6881 {
+		t.Errorf("unexpected peers %+v", r.Peers)
+	}
+}
+
+func TestUDPConnectionID(t *testing.T) {
+	s := New(Config{})
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	now := time.Now()
+
+	connect := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	connect = append(connect, 0, 0, 0, udpActionConnect, 1, 2, 3, 4)
+	resp := s.handleUDP(connect, addr, now)
+	if len(resp) != 16 {
+		t.Fatalf("unexpected connect response %x", resp)
+	}
+	id := binary.BigEndian.Uint64(resp[8:])
+
+	if !s.validConnectionID(id, addr, now.Add(time.Minute)) {
+		t.Errorf("connection id expired too soon")
+	}
+	if s.validConnectionID(id, addr, now.Add(3*time.Minute)) {
+		t.Errorf("connection id did not expire")
+	}
+	if !s.validConnectionID(id, &net.UDPAddr{IP: addr.IP, Port: 1235}, now) {
+		t.Errorf("connection id not valid from another port")
+	}
+	if s.validConnectionID(id, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}, now) {
+		t.Errorf("connection id valid for another address")
+	}
+
+	scrape := binary.BigEndian.AppendUint64(nil, id+1)
+	scrape = append(scrape, 0, 0, 0, udpActionScrape, 1, 2, 3, 4)
+	scrape = append(scrape, make([]byte, 20)...)
+	if resp := s.handleUDP(scrape, addr, now); binary.BigEndian.Uint32(resp) != udpActionError {
+		t.Errorf("expected an error for a wrong connection id, got %x", resp)
+	}
+}
+
+func TestPeerIDReuse(t *testing.T) {
+	s := New(Config{})
+	victim, other := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	if _, err := s.Announce(announceRequest(1, 6881, 0, tracker.StartedEvent), victim); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+
+	// the same peer id from elsewhere neither replaces nor stops the peer
+	if _, err := s.Announce(announceRequest(1, 6882, 10, tracker.StartedEvent), other); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	if _, err := s.Announce(announceRequest(1, 6881, 0, tracker.StoppedEvent), other); err != nil {
+		t.Fatalf("stopped announce: %v", err)
+	}
+
+	resp, err := s.Announce(announceRequest(2, 6883, 10, tracker.StartedEvent), other)
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+	found := false
+	for _, p := range resp.Peers {
+		found = found || p.String() == "10.0.0.1:6881"
+	}
+	if !found || resp.Seeders != 1 || resp.Leechers != 2 {
+		t.Errorf("expected the first peer to stay, got %+v", resp)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	s := New(Config{HTTPAddr: "127.0.0.1:0"})
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
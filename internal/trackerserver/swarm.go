@@ -0,0 +1,110 @@
+package trackerserver
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+// peerKey identifies a peer by where it announced from as well as by its
+// id, so nobody can replace or stop another peer by sending its id.
+type peerKey struct {
+	id   [20]byte
+	ip   [16]byte
+	port int
+}
+
+type peerEntry struct {
+	id   [20]byte
+	ip   net.IP
+	port int
+	// ip6 is the address an IPv4 peer gave with the ipv6 parameter (BEP 7)
+	ip6      net.IP
+	left     int64
+	lastSeen time.Time
+}
+
+func (p *peerEntry) seeding() bool {
+	return p.left == 0
+}
+
+func (p *peerEntry) addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, ip := range []net.IP{p.ip, p.ip6} {
+		if ip != nil {
+			addrs = append(addrs, &net.TCPAddr{IP: ip, Port: p.port})
+		}
+	}
+	return addrs
+}
+
+// swarm is every peer announcing one torrent.
+type swarm struct {
+	peers map[peerKey]*peerEntry
+	// completed counts the completed events, it is never reset
+	completed int
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: make(map[peerKey]*peerEntry)}
+}
+
+func (s *swarm) counts() (seeders, leechers int) {
+	for _, p := range s.peers {
+		if p.seeding() {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// update records an announce and returns the addresses of up to numWant
+// other peers, chosen at random. Seeders only get leechers, they have no use
+// for other seeders.
+func (s *swarm) update(req tracker.AnnounceRequest, ip net.IP, now time.Time, numWant int) []net.Addr {
+	key := peerKey{id: req.PeerID, ip: [16]byte(ip.To16()), port: req.Port}
+
+	if req.Event == tracker.StoppedEvent {
+		delete(s.peers, key)
+		return nil
+	}
+	if req.Event == tracker.CompletedEvent {
+		s.completed++
+	}
+
+	p := &peerEntry{id: req.PeerID, ip: ip, port: req.Port, left: req.Left, lastSeen: now}
+	if ip.To4() != nil && req.IPv6 != nil && req.IPv6.To4() == nil && req.IPv6.IsGlobalUnicast() {
+		p.ip6 = req.IPv6
+	}
+	s.peers[key] = p
+
+	candidates := make([]*peerEntry, 0, len(s.peers))
+	for _, p := range s.peers {
+		if p.id == req.PeerID || (req.Left == 0 && p.seeding()) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	peers := make([]net.Addr, 0, min(numWant, len(candidates)))
+	for _, p := range candidates[:min(numWant, len(candidates))] {
+		peers = append(peers, p.addrs()...)
+	}
+	return peers
+}
+
+// expire drops the peers not seen since before.
+func (s *swarm) expire(before time.Time) {
+	for key, p := range s.peers {
+		if p.lastSeen.Before(before) {
+			delete(s.peers, key)
+		}
+	}
+}
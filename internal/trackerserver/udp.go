@@ -0,0 +1,163 @@
+package trackerserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/dmsRosa6/bittorrent-client/internal/tracker"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpAnnounceLen = 98
+
+	// a connection id is accepted for one to two minutes
+	udpConnectionWindow = time.Minute
+
+	// infohashes in one scrape, to stay in one packet
+	udpMaxScrapeHashes = 74
+)
+
+var udpEvents = map[uint32]tracker.TrackerEvent{
+	0: tracker.NoneEvent,
+	1: tracker.CompletedEvent,
+	2: tracker.StartedEvent,
+	3: tracker.StoppedEvent,
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+		if resp := s.handleUDP(buf[:n], addr, time.Now()); resp != nil {
+			s.udpConn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// handleUDP returns the answer to one request, nil when it gets none.
+func (s *Server) handleUDP(req []byte, addr *net.UDPAddr, now time.Time) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	tid := req[12:16]
+
+	resp := binary.BigEndian.AppendUint32(nil, action)
+	resp = append(resp, tid...)
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64(resp, s.connectionID(addr, now))
+	}
+
+	if !s.validConnectionID(connID, addr, now) {
+		return udpError(tid, "invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		if len(req) < udpAnnounceLen {
+			return udpError(tid, errBadRequest.Error())
+		}
+		body := req[16:]
+		announce := tracker.AnnounceRequest{
+			InfoHash:   [20]byte(body[0:20]),
+			PeerID:     [20]byte(body[20:40]),
+			Downloaded: int64(binary.BigEndian.Uint64(body[40:48])),
+			Left:       int64(binary.BigEndian.Uint64(body[48:56])),
+			Uploaded:   int64(binary.BigEndian.Uint64(body[56:64])),
+			Event:      udpEvents[binary.BigEndian.Uint32(body[64:68])],
+			Key:        binary.BigEndian.Uint32(body[72:76]),
+			NumWant:    int(int32(binary.BigEndian.Uint32(body[76:80]))),
+			Port:       int(binary.BigEndian.Uint16(body[80:82])),
+		}
+
+		// the ip field is ignored, peers announce where they send from
+		result, err := s.Announce(announce, addr.IP)
+		if err != nil {
+			return udpError(tid, err.Error())
+		}
+
+		resp = binary.BigEndian.AppendUint32(resp, uint32(result.Interval.Seconds()))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(result.Leechers))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(result.Seeders))
+
+		// only peers of the family of the request fit the response
+		peers4, peers6 := compactPeers(result.Peers)
+		if addr.IP.To4() != nil {
+			return append(resp, peers4...)
+		}
+		return append(resp, peers6...)
+
+	case udpActionScrape:
+		body := req[16:]
+		var infoHashes [][20]byte
+		for i := 0; i+20 <= len(body) && len(infoHashes) < udpMaxScrapeHashes; i += 20 {
+			infoHashes = append(infoHashes, [20]byte(body[i:i+20]))
+		}
+		if len(infoHashes) == 0 {
+			return udpError(tid, errBadRequest.Error())
+		}
+
+		results, err := s.Scrape(infoHashes)
+		if err != nil {
+			return udpError(tid, err.Error())
+		}
+		// every infohash gets an entry, in the order asked
+		for _, infoHash := range infoHashes {
+			r := results[infoHash]
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Seeders))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Completed))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(r.Leechers))
+		}
+		return resp
+
+	default:
+		return udpError(tid, "unknown action")
+	}
+}
+
+// connectionID signs the ip of the client and the current minute, so no
+// state is kept for connections. The port is left out, clients may send each
+// request from a new socket.
+func (s *Server) connectionID(addr *net.UDPAddr, now time.Time) uint64 {
+	window := now.Unix() / int64(udpConnectionWindow.Seconds())
+
+	mac := hmac.New(sha256.New, s.secret[:])
+	mac.Write(addr.IP.To16())
+	binary.Write(mac, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionID accepts the ids of this minute and the previous one.
+func (s *Server) validConnectionID(id uint64, addr *net.UDPAddr, now time.Time) bool {
+	return id == s.connectionID(addr, now) || id == s.connectionID(addr, now.Add(-udpConnectionWindow))
+}
+
+func udpError(tid []byte, msg string) []byte {
+	resp := binary.BigEndian.AppendUint32(nil, udpActionError)
+	resp = append(resp, tid...)
+	return append(resp, msg...)
+}